@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+//base58CheckEncode encodes payload with version byte to base58check string.
+func base58CheckEncode(version byte, payload []byte) string {
+	b := make([]byte, 0, 1+len(payload)+4)
+	b = append(b, version)
+	b = append(b, payload...)
+	b = append(b, hash(b)[:4]...)
+
+	x := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	var enc []byte
+	for x.Sign() > 0 {
+		x.DivMod(x, radix, mod)
+		enc = append(enc, base58Alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		enc = append(enc, base58Alphabet[0])
+	}
+	return string(Reverse(enc))
+}
+
+//base58CheckDecode decodes base58check string and returns version byte and payload.
+func base58CheckDecode(s string) (byte, []byte, error) {
+	x := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range []byte(s) {
+		i := bytes.IndexByte([]byte(base58Alphabet), c)
+		if i < 0 {
+			return 0, nil, errors.New("invalid character in base58 string")
+		}
+		x.Mul(x, radix)
+		x.Add(x, big.NewInt(int64(i)))
+	}
+	dec := x.Bytes()
+	for _, c := range []byte(s) {
+		if c != base58Alphabet[0] {
+			break
+		}
+		dec = append([]byte{0}, dec...)
+	}
+	if len(dec) < 5 {
+		return 0, nil, errors.New("base58 string is too short")
+	}
+	body := dec[:len(dec)-4]
+	if !bytes.Equal(hash(body)[:4], dec[len(dec)-4:]) {
+		return 0, nil, errors.New("checksum of base58 string unmatches")
+	}
+	return body[0], body[1:], nil
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+const (
+	bech32Const  = 1
+	bech32mConst = 0x2bc830a3
+)
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (b>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	v := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		v = append(v, hrp[i]>>5)
+	}
+	v = append(v, 0)
+	for i := 0; i < len(hrp); i++ {
+		v = append(v, hrp[i]&31)
+	}
+	return v
+}
+
+//bech32Encode encodes 5-bit data with hrp, using bech32m checksum if m is true.
+func bech32Encode(hrp string, data []byte, m bool) string {
+	c := uint32(bech32Const)
+	if m {
+		c = bech32mConst
+	}
+	values := append(bech32HRPExpand(hrp), data...)
+	values = append(values, 0, 0, 0, 0, 0, 0)
+	mod := bech32Polymod(values) ^ c
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, d := range data {
+		sb.WriteByte(bech32Charset[d])
+	}
+	for i := 0; i < 6; i++ {
+		sb.WriteByte(bech32Charset[(mod>>uint(5*(5-i)))&31])
+	}
+	return sb.String()
+}
+
+//bech32Decode decodes bech32(m) string and returns hrp, 5-bit data,
+//and whether its checksum is bech32m.
+func bech32Decode(s string) (string, []byte, bool, error) {
+	if len(s) > 90 {
+		return "", nil, false, errors.New("bech32 string is too long")
+	}
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, false, errors.New("bech32 string has mixed case")
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, false, errors.New("invalid separator position in bech32 string")
+	}
+	hrp := s[:pos]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, false, errors.New("invalid character in bech32 hrp")
+		}
+	}
+	data := make([]byte, 0, len(s)-pos-1)
+	for i := pos + 1; i < len(s); i++ {
+		d := strings.IndexByte(bech32Charset, s[i])
+		if d < 0 {
+			return "", nil, false, fmt.Errorf("invalid character %q in bech32 string", s[i])
+		}
+		data = append(data, byte(d))
+	}
+	switch bech32Polymod(append(bech32HRPExpand(hrp), data...)) {
+	case bech32Const:
+		return hrp, data[:len(data)-6], false, nil
+	case bech32mConst:
+		return hrp, data[:len(data)-6], true, nil
+	}
+	return "", nil, false, errors.New("checksum of bech32 string unmatches")
+}
+
+//convertBits regroups bits of data from frombits to tobits per byte.
+func convertBits(data []byte, frombits, tobits uint, pad bool) ([]byte, error) {
+	var acc uint32
+	var bits uint
+	maxv := uint32(1)<<tobits - 1
+	ret := make([]byte, 0, len(data)*int(frombits)/int(tobits)+1)
+	for _, v := range data {
+		if uint32(v)>>frombits != 0 {
+			return nil, errors.New("invalid data range")
+		}
+		acc = acc<<frombits | uint32(v)
+		bits += frombits
+		for bits >= tobits {
+			bits -= tobits
+			ret = append(ret, byte(acc>>bits&maxv))
+		}
+	}
+	switch {
+	case pad && bits > 0:
+		ret = append(ret, byte(acc<<(tobits-bits)&maxv))
+	case !pad && (bits >= frombits || acc<<(tobits-bits)&maxv != 0):
+		return nil, errors.New("invalid padding")
+	}
+	return ret, nil
+}
+
+//segwitAddress encodes witness program to bech32 (version 0) or
+//bech32m (version 1+) address.
+func segwitAddress(hrp string, version byte, program []byte) (string, error) {
+	data, err := convertBits(program, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32Encode(hrp, append([]byte{version}, data...), version > 0), nil
+}
+
+//decodeSegwitAddress decodes bech32(m) address and returns
+//hrp, witness version and witness program.
+func decodeSegwitAddress(addr string) (string, byte, []byte, error) {
+	hrp, data, m, err := bech32Decode(addr)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if len(data) < 1 || data[0] > 16 {
+		return "", 0, nil, errors.New("invalid witness version")
+	}
+	version := data[0]
+	if (version == 0) == m {
+		return "", 0, nil, fmt.Errorf("invalid checksum type for witness version %d", version)
+	}
+	program, err := convertBits(data[1:], 5, 8, false)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if len(program) < 2 || len(program) > 40 {
+		return "", 0, nil, errors.New("invalid length of witness program")
+	}
+	if version == 0 && len(program) != 20 && len(program) != 32 {
+		return "", 0, nil, errors.New("invalid length of witness v0 program")
+	}
+	return hrp, version, program, nil
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+//Breach is a revoked commitment tx broadcasted by remote, and the justice tx
+//which takes all funds of the channel.
+type Breach struct {
+	ID      string
+	Revoked *Tx
+	Justice *Tx
+}
+
+type watched struct {
+	rev  *Revocations
+	addr string
+}
+
+//BreachWatcher detects revoked commitment txs of duplex channels in txs,
+//e.g. from blocks, and builds justice txs for them.
+//It keeps copies of Revocations instead of channels, so it can run as
+//a separate watchtower while the channels are updated.
+//The copies include private keys to sign justice txs, so the watchtower must
+//be trusted with them.
+type BreachWatcher struct {
+	//Fee is the fee of justice txs.
+	Fee uint64
+	//OnError is called with the error of each tx in CheckTxs if not nil.
+	OnError  func(error)
+	mutex    sync.RWMutex
+	channels map[string]*watched
+}
+
+//NewBreachWatcher returns BreachWatcher whose justice txs pay fee.
+func NewBreachWatcher(fee uint64) *BreachWatcher {
+	return &BreachWatcher{
+		Fee:      fee,
+		channels: make(map[string]*watched),
+	}
+}
+
+//Watch starts to watch the channel of r, whose funds are sent to addr when breached,
+//and returns its channel ID.
+func (w *BreachWatcher) Watch(r *Revocations, addr string) (string, error) {
+	rev, err := r.check()
+	if err != nil {
+		return "", err
+	}
+	if _, err = addressScript(r.Net, addr); err != nil {
+		return "", err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, exist := w.channels[r.ID]; exist {
+		return "", errors.New("channel is already watched")
+	}
+	w.channels[r.ID] = &watched{
+		rev:  rev,
+		addr: addr,
+	}
+	return r.ID, nil
+}
+
+//Update replaces revocation data of the watched channel with r,
+//which should be called after each update of the channel.
+func (w *BreachWatcher) Update(r *Revocations) error {
+	rev, err := r.check()
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	ch, exist := w.channels[r.ID]
+	if !exist {
+		return ErrChannelNotFound
+	}
+	w.channels[r.ID] = &watched{
+		rev:  rev,
+		addr: ch.addr,
+	}
+	return nil
+}
+
+//check returns a copy of r if it has all fields to be watched.
+func (r *Revocations) check() (*Revocations, error) {
+	if r.ID == "" || r.Bond == nil || r.Key == nil || r.Remote == nil {
+		return nil, errors.New("revocations are not filled")
+	}
+	rev := *r
+	rev.Secrets = append([][]byte(nil), r.Secrets...)
+	return &rev, nil
+}
+
+//Unwatch stops to watch the channel.
+func (w *BreachWatcher) Unwatch(id string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, exist := w.channels[id]; !exist {
+		return ErrChannelNotFound
+	}
+	delete(w.channels, id)
+	return nil
+}
+
+//Check returns the breach if tx is a revoked commitment tx of a watched channel,
+//or nil if not.
+func (w *BreachWatcher) Check(tx *Tx) (*Breach, error) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	for id, ch := range w.channels {
+		if !spends(tx, ch.rev.Bond) {
+			continue
+		}
+		justice, err := ch.rev.penalty(tx, ch.addr, w.Fee)
+		if err == ErrNotRevoked {
+			//the latest commitment or other close tx.
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Breach{
+			ID:      id,
+			Revoked: tx,
+			Justice: justice,
+		}, nil
+	}
+	return nil, nil
+}
+
+//CheckTxs returns breaches in txs.
+//An error of a tx is passed to OnError and doesn't stop checking others.
+//It returns breaches found with the first error after all txs are checked.
+func (w *BreachWatcher) CheckTxs(txs []*Tx) ([]*Breach, error) {
+	var bs []*Breach
+	var first error
+	for i, tx := range txs {
+		b, err := w.Check(tx)
+		if err != nil {
+			err = fmt.Errorf("tx %d: %s", i, err)
+			if w.OnError != nil {
+				w.OnError(err)
+			}
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		if b != nil {
+			bs = append(bs, b)
+		}
+	}
+	return bs, first
+}
+
+//spends returns true if tx spends prev.
+func spends(tx *Tx, prev *Outpoint) bool {
+	for _, in := range tx.TxIn {
+		if in.Index == prev.Index && bytes.Equal(in.Hash, prev.Hash) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBreachWatcher(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	alice, bob := testDuplex(t, keys)
+	testDuplexPay(t, alice, bob, 0.3*Unit)
+	//the fixture of the revoked commitment tx as seen in a block.
+	dat, err := alice.Commitment().Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := ParseTX(dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewBreachWatcher(0.001 * Unit)
+	if _, err = w.Watch(&Revocations{}, keys[1].PublicKey.Address()); err == nil {
+		t.Error("must be error for empty revocations")
+	}
+	r, err := bob.Revocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := w.Watch(r, keys[1].PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Watch(r, keys[1].PublicKey.Address()); err == nil {
+		t.Error("must be error for duplicated channel")
+	}
+	testDuplexPay(t, bob, alice, 0.1*Unit)
+	if b, err := w.Check(revoked); err != nil || b != nil {
+		t.Error("state revoked after Watch must not be known before Update", err)
+	}
+	if r, err = bob.Revocations(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Update(r); err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range []*Tx{alice.Commitment(), bob.Commitment()} {
+		b, err := w.Check(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != nil {
+			t.Error("latest commitment must not be breach")
+		}
+	}
+	bs, err := w.CheckTxs([]*Tx{alice.Commitment(), revoked})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) != 1 || bs[0].ID != id || bs[0].Revoked != revoked {
+		t.Fatal("breach is not detected")
+	}
+	j := bs[0].Justice
+	if len(j.TxIn) != 2 || j.TxOut[0].Value != 0.998*Unit {
+		t.Error("justice tx doesn't take all funds")
+	}
+	for i, in := range j.TxIn {
+		if !bytes.Equal(in.Hash, revoked.Hash()) || in.Index != uint32(i) {
+			t.Error("justice tx doesn't spend the revoked commitment")
+		}
+	}
+
+	//outputs of bad can't pay the fee of its justice tx.
+	bad := *revoked
+	bad.TxOut = nil
+	for _, out := range revoked.TxOut {
+		bad.TxOut = append(bad.TxOut, &TxOut{Value: 1, Script: out.Script})
+	}
+	var errs []error
+	w.OnError = func(err error) {
+		errs = append(errs, err)
+	}
+	bs, err = w.CheckTxs([]*Tx{&bad, revoked})
+	if err == nil || len(errs) != 1 {
+		t.Error("must be error for bad tx", err, errs)
+	}
+	if len(bs) != 1 || bs[0].Revoked != revoked {
+		t.Error("breach after bad tx must be detected")
+	}
+	if err = w.Unwatch(id); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := w.Check(revoked); b != nil {
+		t.Error("unwatched channel must not be checked")
+	}
+	if err = w.Update(r); err != ErrChannelNotFound {
+		t.Error("must be error for unwatched channel", err)
+	}
+}
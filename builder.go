@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bitgoin/address"
+)
+
+//Builder builds a tx which spends P2SH or P2WSH multisig outputs and P2PKH coins together.
+//Txins are ordered as Multisigs and then Coins, and all of them are spent.
+type Builder struct {
+	//Multisigs are bonds to be spent. Each of them must have its outpoint
+	//by BondTx or SetOutpoint.
+	Multisigs []*PubInfo
+	Coins     UTXOs
+	Sends     []*Send
+	Fee       uint64
+	Locktime  uint32
+	//Net is the network of keys and addresses. No checks if nil.
+	Net *Network
+}
+
+//Tx returns the unsigned tx. Change is paid as in NewP2PK.
+//The tx must not be changed until all txins are filled.
+func (b *Builder) Tx() (*Tx, error) {
+	if len(b.Multisigs)+len(b.Coins) == 0 {
+		return nil, errors.New("no inputs")
+	}
+	txouts, total, change, pos, err := p2pkTxouts(b.Net, b.Fee, b.Sends...)
+	if err != nil {
+		return nil, err
+	}
+	coins := make([]*UTXO, 0, len(b.Multisigs)+len(b.Coins))
+	var amount uint64
+	for i, p := range b.Multisigs {
+		if err := p.check(); err != nil {
+			return nil, fmt.Errorf("%s at multisig %d", err, i)
+		}
+		prev, err := p.Outpoint()
+		if err != nil {
+			return nil, fmt.Errorf("%s at multisig %d", err, i)
+		}
+		coins = append(coins, &UTXO{
+			TxHash:  prev.Hash,
+			TxIndex: prev.Index,
+			Value:   p.Amount,
+		})
+	}
+	coins = append(coins, b.Coins...)
+	for _, c := range coins {
+		amount += c.Value
+	}
+	if amount < total {
+		return nil, fmt.Errorf("shortage of coin %d < %d", amount, total)
+	}
+	txins, err := coinTxins(b.Net, coins, b.Locktime)
+	if err != nil {
+		return nil, err
+	}
+	mto, err := changeTxout(b.Net, change, amount-total)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{
+		Version:  1,
+		TxIn:     txins,
+		TxOut:    insertTxout(txouts, pos, mto),
+		Locktime: b.Locktime,
+	}, nil
+}
+
+//multisig returns i-th multisig, which is spent by i-th txin of tx.
+func (b *Builder) multisig(tx *Tx, i int) (*PubInfo, error) {
+	if i < 0 || i >= len(b.Multisigs) {
+		return nil, fmt.Errorf("no multisig at %d", i)
+	}
+	if len(tx.TxIn) != len(b.Multisigs)+len(b.Coins) {
+		return nil, errors.New("tx is not built by the builder")
+	}
+	return b.Multisigs[i], nil
+}
+
+//SignMultisig signs i-th txin of tx, which spends i-th multisig, by priv.
+func (b *Builder) SignMultisig(tx *Tx, i int, priv *address.PrivateKey) ([]byte, error) {
+	p, err := b.multisig(tx, i)
+	if err != nil {
+		return nil, err
+	}
+	h, err := p.sigHash(tx, i)
+	if err != nil {
+		return nil, err
+	}
+	return signHash(priv, h)
+}
+
+//FillMultisig embeds sigs to i-th txin of tx, which spends i-th multisig.
+//sigs can be in any order and can be more than M.
+func (b *Builder) FillMultisig(tx *Tx, i int, sigs [][]byte) error {
+	p, err := b.multisig(tx, i)
+	if err != nil {
+		return err
+	}
+	matched, err := p.matchSigs(tx, i, sigs)
+	if err != nil {
+		return err
+	}
+	return p.embedSigns(tx, i, matched)
+}
+
+//FillP2PK signs and embeds sign scripts to txins which spend Coins.
+func (b *Builder) FillP2PK(tx *Tx) error {
+	if len(tx.TxIn) != len(b.Multisigs)+len(b.Coins) {
+		return errors.New("tx is not built by the builder")
+	}
+	for j, c := range b.Coins {
+		if c.Key == nil {
+			return fmt.Errorf("no key for coin %d", j)
+		}
+		i := len(b.Multisigs) + j
+		h, err := c.sigHash(tx, i)
+		if err != nil {
+			return err
+		}
+		sign, err := signHash(c.Key, h)
+		if err != nil {
+			return err
+		}
+		c.embedSign(tx.TxIn[i], sign)
+	}
+	return nil
+}
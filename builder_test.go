@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:6])
+	pis := make([]*PubInfo, 2)
+	for i := range pis {
+		pis[i] = &PubInfo{
+			M:   2,
+			Net: TestNet3,
+		}
+		for _, k := range keys[3*i : 3*i+3] {
+			pis[i].Pubs = append(pis[i].Pubs, k.PublicKey)
+		}
+		if err := pis[i].SetOutpoint(bytes.Repeat([]byte{byte(0x10 + i)}, 32), uint32(i), Unit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := &Builder{
+		Multisigs: pis,
+		Coins:     testCoins(t, keys[0], Unit/2),
+		Sends: []*Send{
+			&Send{
+				Addr:   keys[5].PublicKey.Address(),
+				Amount: 2 * Unit,
+			},
+			&Send{
+				Addr: keys[0].PublicKey.Address(),
+			},
+		},
+		Fee: 0.001 * Unit,
+		Net: TestNet3,
+	}
+	tx, err := b.Tx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.TxIn) != 3 || len(tx.TxOut) != 2 {
+		t.Fatal("illegal number of txins or txouts", len(tx.TxIn), len(tx.TxOut))
+	}
+	if tx.TxOut[1].Value != Unit/2-0.001*Unit {
+		t.Error("illegal change", tx.TxOut[1].Value)
+	}
+	for i, pi := range pis {
+		prev, err := pi.Outpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tx.TxIn[i].Hash, prev.Hash) || tx.TxIn[i].Index != prev.Index {
+			t.Error("illegal outpoint at", i)
+		}
+	}
+	if !bytes.Equal(tx.TxIn[2].Hash, b.Coins[0].TxHash) {
+		t.Error("illegal outpoint of coin")
+	}
+
+	//sign with 2nd and 3rd keys for 1st multisig, 3rd and 1st keys for 2nd.
+	signers := [][]int{{1, 2}, {2, 0}}
+	sigs := make([][][]byte, len(pis))
+	for i, s := range signers {
+		for _, k := range s {
+			sig, err := b.SignMultisig(tx, i, keys[3*i+k])
+			if err != nil {
+				t.Fatal(err)
+			}
+			sigs[i] = append(sigs[i], sig)
+		}
+	}
+	if err = b.FillMultisig(tx, 0, sigs[1]); err == nil {
+		t.Error("must be error for sigs of another multisig")
+	}
+	if err = b.FillMultisig(tx, 1, sigs[1][:1]); err == nil {
+		t.Error("must be error for not enough sigs")
+	}
+	if _, err = b.SignMultisig(tx, 2, keys[0]); err == nil {
+		t.Error("must be error for txin of coin")
+	}
+	for i := range pis {
+		if err = b.FillMultisig(tx, i, sigs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = b.FillP2PK(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	//sigs in scriptSig are in the order of keys.
+	ordered := [][]int{{1, 2}, {0, 2}}
+	for i, pi := range pis {
+		ops, err := parseScript(tx.TxIn[i].Script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ops) != 4 || ops[0].code != op0 || !bytes.Equal(ops[3].data, pi.RedeemScript()) {
+			t.Fatal("illegal multisig scriptSig at", i)
+		}
+		for j, k := range ordered[i] {
+			sig := ops[1+j].data
+			if err := pi.verify(tx, i, sig[:len(sig)-1], k); err != nil {
+				t.Error(err, i, j)
+			}
+		}
+	}
+	ops, err := parseScript(tx.TxIn[2].Script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 2 || !bytes.Equal(ops[1].data, keys[0].PublicKey.Serialize()) {
+		t.Fatal("illegal P2PKH scriptSig")
+	}
+	h, err := tx.sigHash(2, b.Coins[0].Script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := ops[0].data
+	if err := keys[0].PublicKey.Verify(sig[:len(sig)-1], h); err != nil {
+		t.Error(err)
+	}
+}
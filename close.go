@@ -0,0 +1,252 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"errors"
+	"fmt"
+)
+
+//CloseFee returns the fee of cooperative close tx for rate (satoshi/kB),
+//assuming it pays to two P2PKH addresses. Size of witness bond is virtual size.
+func (p *PubInfo) CloseFee(rate uint64) uint64 {
+	redeem := len(p.redeemScript())
+	//OP_0, sigs with hash type and redeem script.
+	sigs := 1 + int(p.M)*(1+73) + len(pushData(nil, make([]byte, redeem)))
+	//version, txin count, outpoint, scriptSig, sequence, txout count, txouts and locktime.
+	size := 4 + 1 + 36 + varIntSize(uint64(sigs)) + sigs + 4 + 1 + 2*(8+1+25) + 4
+	if p.Witness {
+		//witness items are counted as a quarter, with marker, flag and number of items.
+		wit := 2 + 1 + 1 + int(p.M)*(1+73) + varIntSize(uint64(redeem)) + redeem
+		size = 4 + 1 + 36 + 1 + 4 + 1 + 2*(8+1+25) + 4 + (wit+3)/4
+	}
+	return rate * uint64(size) / 1000
+}
+
+//isClosed returns true if the channel is closed, or its splice is aborted.
+func (m *mpay) isClosed() bool {
+	return m.closed != nil || m.aborted
+}
+
+//closeInfo returns PubInfo whose fee is fee, and sends of close tx which
+//pays amount to payee. Payer pays the whole fee from its change.
+func (m *mpay) closeInfo(amount, fee uint64) (*PubInfo, []*Send, error) {
+	if m.isClosed() {
+		return nil, nil, ErrChannelClosed
+	}
+	if amount > m.Amount || fee > m.Amount-amount {
+		return nil, nil, fmt.Errorf("amount %d and fee %d exceed bond %d", amount, fee, m.Amount)
+	}
+	p := *m.PubInfo
+	p.Fee = fee
+	sends, err := p.sendstruct(amount)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &p, sends, nil
+}
+
+//signClose signs close tx which pays amount to payee with fee.
+func (m *mpay) signClose(amount, fee uint64) ([]byte, error) {
+	p, sends, err := m.closeInfo(amount, fee)
+	if err != nil {
+		return nil, err
+	}
+	return p.SignMultisig(m.priv, 0, sends...)
+}
+
+//closeTx returns close tx signed by both, and regards the channel as closed.
+//i is the index of own key in Pubs.
+func (m *mpay) closeTx(amount, fee uint64, sign []byte, i int) (*Tx, error) {
+	p, sends, err := m.closeInfo(amount, fee)
+	if err != nil {
+		return nil, err
+	}
+	mysign, err := p.SignMultisig(m.priv, 0, sends...)
+	if err != nil {
+		return nil, err
+	}
+	sigs := [][]byte{sign, sign}
+	sigs[i] = mysign
+	tx, err := p.SpendBondTx(0, sigs, sends...)
+	if err != nil {
+		return nil, err
+	}
+	m.closed = tx
+	m.amount = amount
+	return tx, nil
+}
+
+//SignClose signs cooperative close tx which pays amount to payee with fee.
+//Payer pays the whole fee.
+func (m *MicroPayer) SignClose(amount, fee uint64) ([]byte, error) {
+	return (*mpay)(m).signClose(amount, fee)
+}
+
+//CloseTx returns cooperative close tx signed by both with sign of payee.
+//After that, refund and incremented txs are void.
+func (m *MicroPayer) CloseTx(amount, fee uint64, sign []byte) (*Tx, error) {
+	return (*mpay)(m).closeTx(amount, fee, sign, 0)
+}
+
+//SignClose signs cooperative close tx which pays amount to payee with fee.
+//amount must not be less than the latest incremented amount.
+func (m *MicroPayee) SignClose(amount, fee uint64) ([]byte, error) {
+	if amount < m.amount {
+		return nil, fmt.Errorf("amount %d is less than paid %d", amount, m.amount)
+	}
+	return (*mpay)(m).signClose(amount, fee)
+}
+
+//CloseTx returns cooperative close tx signed by both with sign of payer,
+//and persists it if store is set.
+//amount must not be less than the latest incremented amount.
+//After that, incremented txs are void.
+func (m *MicroPayee) CloseTx(amount, fee uint64, sign []byte) (*Tx, error) {
+	if amount < m.amount {
+		return nil, fmt.Errorf("amount %d is less than paid %d", amount, m.amount)
+	}
+	oamount := m.amount
+	tx, err := (*mpay)(m).closeTx(amount, fee, sign, 1)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.persist(); err != nil {
+		m.closed = nil
+		m.amount = oamount
+		return nil, err
+	}
+	return tx, nil
+}
+
+//Closed returns cooperative close tx, or nil if not closed.
+func (m *MicroPayer) Closed() *Tx {
+	return m.closed
+}
+
+//Closed returns cooperative close tx, or the latest incremented tx if the splice
+//is aborted after payments, or nil otherwise.
+func (m *MicroPayee) Closed() *Tx {
+	return m.closed
+}
+
+//FeeRange is the range of fee which is acceptable for cooperative close.
+type FeeRange struct {
+	Min uint64
+	Max uint64
+}
+
+//clamp returns the fee nearest to fee in the range.
+func (r FeeRange) clamp(fee uint64) uint64 {
+	switch {
+	case fee < r.Min:
+		return r.Min
+	case fee > r.Max:
+		return r.Max
+	}
+	return fee
+}
+
+//NegotiateClose proposes cooperative close with fee over c, and returns close tx
+//if payee agrees or proposes a fee in fees. Payer pays the whole fee.
+func (m *MicroPayer) NegotiateClose(c *Conn, fee uint64, fees FeeRange) (*Tx, error) {
+	amount := m.amount
+	sign, err := m.SignClose(amount, fee)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Send(&MsgCloseSign{Amount: amount, Fee: fee, Sign: sign}); err != nil {
+		return nil, err
+	}
+	msg, err := c.receive(MsgTypeCloseSign)
+	if err != nil {
+		return nil, err
+	}
+	cs := msg.(*MsgCloseSign)
+	if cs.Amount != amount {
+		return nil, c.fail(ErrCodeInvalid, errors.New("amount is changed"))
+	}
+	if cs.Fee == fee {
+		tx, err := m.CloseTx(amount, fee, cs.Sign)
+		if err != nil {
+			return nil, c.fail(ErrCodeInvalid, err)
+		}
+		return tx, nil
+	}
+	//payee proposes another fee.
+	if fees.clamp(cs.Fee) != cs.Fee {
+		return nil, c.fail(ErrCodeRejected, fmt.Errorf("fee %d is not acceptable", cs.Fee))
+	}
+	if sign, err = m.SignClose(amount, cs.Fee); err != nil {
+		return nil, err
+	}
+	tx, err := m.CloseTx(amount, cs.Fee, cs.Sign)
+	if err != nil {
+		return nil, c.fail(ErrCodeInvalid, err)
+	}
+	return tx, c.Send(&MsgCloseSign{Amount: amount, Fee: cs.Fee, Sign: sign})
+}
+
+//NegotiateClose receives a proposal of cooperative close from payer over c.
+//If its fee is not in fees, payee proposes the nearest fee in fees.
+//It returns close tx if both agree.
+func (m *MicroPayee) NegotiateClose(c *Conn, fees FeeRange) (*Tx, error) {
+	msg, err := c.receive(MsgTypeCloseSign)
+	if err != nil {
+		return nil, err
+	}
+	cs := msg.(*MsgCloseSign)
+	fee := fees.clamp(cs.Fee)
+	sign, err := m.SignClose(cs.Amount, fee)
+	if err != nil {
+		return nil, c.fail(ErrCodeInvalid, err)
+	}
+	if fee == cs.Fee {
+		tx, err := m.CloseTx(cs.Amount, fee, cs.Sign)
+		if err != nil {
+			return nil, c.fail(ErrCodeInvalid, err)
+		}
+		return tx, c.Send(&MsgCloseSign{Amount: cs.Amount, Fee: fee, Sign: sign})
+	}
+	if err = c.Send(&MsgCloseSign{Amount: cs.Amount, Fee: fee, Sign: sign}); err != nil {
+		return nil, err
+	}
+	if msg, err = c.receive(MsgTypeCloseSign); err != nil {
+		return nil, err
+	}
+	cs2 := msg.(*MsgCloseSign)
+	if cs2.Amount != cs.Amount || cs2.Fee != fee {
+		return nil, c.fail(ErrCodeInvalid, errors.New("close is not agreed"))
+	}
+	tx, err := m.CloseTx(cs2.Amount, fee, cs2.Sign)
+	if err != nil {
+		return nil, c.fail(ErrCodeInvalid, err)
+	}
+	return tx, nil
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestCloseFee(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	payer, payee := testChannel(t, keys[0], keys[1], 2*Unit, 100)
+	fee := payer.CloseFee(10000)
+	sign, err := payer.SignClose(10000, fee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := payee.CloseTx(10000, fee, sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := uint64(tx.Size()); fee < size*10 || fee > (size+4)*10 {
+		t.Error("illegal estimated fee", fee, size)
+	}
+}
+
+func TestCooperativeClose(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	for i, c := range []struct {
+		payerFee  uint64
+		payerFees FeeRange
+		payeeFees FeeRange
+		fee       uint64
+	}{
+		{3000, FeeRange{0, 5000}, FeeRange{2000, 5000}, 3000},
+		{1000, FeeRange{0, 3000}, FeeRange{2000, 5000}, 2000},
+		{1000, FeeRange{0, 1500}, FeeRange{2000, 5000}, 0},
+	} {
+		payer, payee := testChannel(t, keys[0], keys[1], uint64(2+i)*Unit, 100)
+		sign, err := payer.SignIncremented(20000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = payee.IncrementedTx(20000, sign); err != nil {
+			t.Fatal(err)
+		}
+		p1, p2 := net.Pipe()
+		type result struct {
+			tx  *Tx
+			err error
+		}
+		res := make(chan result, 1)
+		go func() {
+			tx, err := payer.NegotiateClose(NewConn(p1), c.payerFee, c.payerFees)
+			res <- result{tx, err}
+		}()
+		tx, err := payee.NegotiateClose(NewConn(p2), c.payeeFees)
+		r := <-res
+		p1.Close()
+		p2.Close()
+		if c.fee == 0 {
+			if err == nil || r.err == nil {
+				t.Error("must be error for unacceptable fee", i)
+			}
+			if payer.Closed() != nil || payee.Closed() != nil {
+				t.Error("must not be closed", i)
+			}
+			if payer.Refund() == nil {
+				t.Error("refund must be kept if not closed", i)
+			}
+			continue
+		}
+		if err != nil || r.err != nil {
+			t.Fatal(err, r.err, i)
+		}
+		if !bytes.Equal(tx.Hash(), r.tx.Hash()) || payee.Closed() != tx {
+			t.Error("close txs must be same", i)
+		}
+		if tx.TxOut[0].Value != Unit-20000-c.fee || tx.TxOut[1].Value != 20000 {
+			t.Error("illegal outputs of close tx", i)
+		}
+		if _, err = payer.SignIncremented(30000); err != ErrChannelClosed {
+			t.Error("must be closed for payer", err)
+		}
+		if payer.Refund() != nil {
+			t.Error("refund must be void after close", i)
+		}
+		if _, err = payee.IncrementedTx(20000, sign); err != ErrChannelClosed {
+			t.Error("must be closed for payee", err)
+		}
+	}
+
+	payer, payee := testChannel(t, keys[0], keys[1], 5*Unit, 100)
+	sign, err := payer.SignIncremented(20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = payee.IncrementedTx(20000, sign); err != nil {
+		t.Fatal(err)
+	}
+	if sign, err = payer.SignClose(10000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = payee.CloseTx(10000, 1000, sign); err == nil {
+		t.Error("must be error for less amount than paid")
+	}
+	if sign, err = payer.SignClose(20000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := payee.CloseTx(20000, 1000, sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := payee.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payee2, err := LoadMicroPayee(b, keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payee2.Closed() == nil || !bytes.Equal(payee2.Closed().Hash(), tx.Hash()) {
+		t.Error("close tx must be loaded")
+	}
+}
@@ -0,0 +1,372 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bitgoin/address"
+)
+
+//ErrChannelClosed is returned by MicroPayee.ReceivePayment when payer closes the channel.
+var ErrChannelClosed = errors.New("channel is closed")
+
+//Conn sends and receives messages of micropayment protocol over io.ReadWriter.
+//Messages in each direction have sequence numbers from 0, and a message with
+//unexpected sequence number (e.g. replayed one) is rejected.
+type Conn struct {
+	rw   io.ReadWriter
+	seq  uint32
+	rseq uint32
+}
+
+//NewConn returns Conn over rw.
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{
+		rw: rw,
+	}
+}
+
+//Send sends m to peer.
+func (c *Conn) Send(m Message) error {
+	b, err := EncodeMessage(m, c.seq)
+	if err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(b); err != nil {
+		return err
+	}
+	c.seq++
+	return nil
+}
+
+//Receive receives a message from peer.
+//If peer sends MsgError, it is returned as error.
+func (c *Conn) Receive() (Message, error) {
+	m, seq, err := DecodeMessage(c.rw)
+	if err != nil {
+		return nil, err
+	}
+	if seq != c.rseq {
+		return nil, &MsgError{
+			Code:   ErrCodeSequence,
+			Reason: fmt.Sprintf("sequence %d is not expected %d", seq, c.rseq),
+		}
+	}
+	c.rseq++
+	if e, ok := m.(*MsgError); ok {
+		return nil, e
+	}
+	return m, nil
+}
+
+//decode decodes a message of type t from r, which must have the next sequence number.
+//Unlike Receive, the sequence number is not advanced, so the caller can advance it
+//only if the message is accepted.
+func (c *Conn) decode(r io.Reader, t MsgType) (Message, error) {
+	m, seq, err := DecodeMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	if seq != c.rseq {
+		return nil, &MsgError{
+			Code:   ErrCodeSequence,
+			Reason: fmt.Sprintf("sequence %d is not expected %d", seq, c.rseq),
+		}
+	}
+	if m.Type() != t {
+		return nil, &MsgError{
+			Code:   ErrCodeUnexpected,
+			Reason: fmt.Sprintf("unexpected message type %d", m.Type()),
+		}
+	}
+	return m, nil
+}
+
+//fail sends err to peer with code, and returns err.
+//If err is MsgError, its code is used.
+func (c *Conn) fail(code ErrCode, err error) error {
+	m, ok := err.(*MsgError)
+	if !ok {
+		m = &MsgError{
+			Code:   code,
+			Reason: err.Error(),
+		}
+	}
+	c.Send(m)
+	return err
+}
+
+//receive receives a message of type t.
+func (c *Conn) receive(t MsgType) (Message, error) {
+	m, err := c.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if m.Type() != t {
+		return nil, c.fail(ErrCodeUnexpected, fmt.Errorf("unexpected message type %d", m.Type()))
+	}
+	return m, nil
+}
+
+//OpenChannel creates bond and refund tx, gets the refund signed by payee over c,
+//and sends bond to payee. Bond must be broadcasted after that.
+func (m *MicroPayer) OpenChannel(c *Conn, locktime uint32, coins UTXOs, ref string) (*Tx, error) {
+	bond, refund, err := m.CreateBond(locktime, coins, ref)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Send(&MsgOpen{
+		PubKey:   m.priv.PublicKey.Serialize(),
+		Amount:   m.Amount,
+		Fee:      m.Fee,
+		Locktime: locktime,
+		Witness:  m.Witness,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Send(&MsgRefundSignRequest{Refund: refund}); err != nil {
+		return nil, err
+	}
+	msg, err := c.receive(MsgTypeRefundSignResponse)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.SignRefund(refund, msg.(*MsgRefundSignResponse).Sign); err != nil {
+		return nil, c.fail(ErrCodeInvalid, err)
+	}
+	if err = c.Send(&MsgBond{Bond: bond}); err != nil {
+		return nil, err
+	}
+	return bond, nil
+}
+
+//Pay sends the sign of incremented tx which pays amount to payee over c.
+func (m *MicroPayer) Pay(c *Conn, amount uint64) error {
+	sign, err := m.SignIncremented(amount)
+	if err != nil {
+		return err
+	}
+	return c.Send(&MsgPayment{
+		Amount: amount,
+		Sign:   sign,
+	})
+}
+
+//Close tells payee to close the channel over c.
+func (m *MicroPayer) Close(c *Conn) error {
+	msg, err := m.closeRequest(m.amount, c.seq)
+	if err != nil {
+		return err
+	}
+	return c.Send(msg)
+}
+
+//closeRequestHash returns hash which payer signs to request payee to close
+//the channel with amount by the message of seq.
+func closeRequestHash(p *PubInfo, amount uint64, seq uint32) ([]byte, error) {
+	id, err := p.ChannelID()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("micropayment close ")
+	buf.WriteString(id)
+	binary.Write(&buf, binary.LittleEndian, amount)
+	binary.Write(&buf, binary.LittleEndian, seq)
+	return hash(buf.Bytes()), nil
+}
+
+//statusRequestHash returns hash which payer signs to get the status of
+//the channel whose pending message is of seq.
+func statusRequestHash(p *PubInfo, seq uint32) ([]byte, error) {
+	id, err := p.ChannelID()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("micropayment status ")
+	buf.WriteString(id)
+	binary.Write(&buf, binary.LittleEndian, seq)
+	return hash(buf.Bytes()), nil
+}
+
+//statusRequest returns the sign of payer to get the status when the message of seq is pending.
+func (m *MicroPayer) statusRequest(seq uint32) ([]byte, error) {
+	h, err := statusRequestHash(m.PubInfo, seq)
+	if err != nil {
+		return nil, err
+	}
+	return signHash(m.priv, h)
+}
+
+//checkStatusRequest returns an error if sign is not of payer for the status request of seq.
+func (m *MicroPayee) checkStatusRequest(sign []byte, seq uint32) error {
+	h, err := statusRequestHash(m.PubInfo, seq)
+	if err != nil {
+		return err
+	}
+	if err = checkSig(sign); err != nil {
+		return err
+	}
+	if err = m.Pubs[0].Verify(sign, h); err != nil {
+		return fmt.Errorf("status request is not signed by payer: %s", err)
+	}
+	return nil
+}
+
+//closeRequest returns MsgClose with the paid amount signed by payer, which is sent as
+//the message of seq.
+func (m *MicroPayer) closeRequest(amount uint64, seq uint32) (*MsgClose, error) {
+	h, err := closeRequestHash(m.PubInfo, amount, seq)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := signHash(m.priv, h)
+	if err != nil {
+		return nil, err
+	}
+	return &MsgClose{
+		Amount: amount,
+		Sign:   sign,
+	}, nil
+}
+
+//checkCloseRequest returns an error if msg, which is sent as the message of seq,
+//is not signed by payer or its amount is not the latest paid amount.
+func (m *MicroPayee) checkCloseRequest(msg *MsgClose, seq uint32) error {
+	if msg.Amount != m.amount {
+		return fmt.Errorf("amount %d is not the paid amount %d", msg.Amount, m.amount)
+	}
+	h, err := closeRequestHash(m.PubInfo, msg.Amount, seq)
+	if err != nil {
+		return err
+	}
+	if err = checkSig(msg.Sign); err != nil {
+		return err
+	}
+	if err = m.Pubs[0].Verify(msg.Sign, h); err != nil {
+		return fmt.Errorf("close is not signed by payer: %s", err)
+	}
+	return nil
+}
+
+//AcceptChannel accepts a channel opened by payer over c and returns MicroPayee.
+//accept is called with the open message, and can reject the channel by returning an error.
+func AcceptChannel(c *Conn, payee *address.PrivateKey, accept func(*MsgOpen) error) (*MicroPayee, error) {
+	return AcceptChannelNet(c, payee, nil, accept)
+}
+
+//AcceptChannelNet is same as AcceptChannel, but the channel is for net.
+func AcceptChannelNet(c *Conn, payee *address.PrivateKey, net *Network, accept func(*MsgOpen) error) (*MicroPayee, error) {
+	msg, err := c.receive(MsgTypeOpen)
+	if err != nil {
+		return nil, err
+	}
+	open := msg.(*MsgOpen)
+	if msg, err = c.receive(MsgTypeRefundSignRequest); err != nil {
+		return nil, err
+	}
+	refund := msg.(*MsgRefundSignRequest).Refund
+	m, sign, err := acceptOpen(payee, net, open, refund, accept)
+	if err != nil {
+		return nil, c.fail(ErrCodeInvalid, err)
+	}
+	if err = c.Send(&MsgRefundSignResponse{Sign: sign}); err != nil {
+		return nil, err
+	}
+	if msg, err = c.receive(MsgTypeBond); err != nil {
+		return nil, err
+	}
+	if err = m.CheckBond(refund, msg.(*MsgBond).Bond); err != nil {
+		return nil, c.fail(ErrCodeInvalid, err)
+	}
+	return m, nil
+}
+
+//acceptOpen returns MicroPayee for open in net if accept allows it, and signs refund.
+func acceptOpen(payee *address.PrivateKey, net *Network, open *MsgOpen, refund *Tx,
+	accept func(*MsgOpen) error) (*MicroPayee, []byte, error) {
+	if accept != nil {
+		if err := accept(open); err != nil {
+			return nil, nil, &MsgError{
+				Code:   ErrCodeRejected,
+				Reason: err.Error(),
+			}
+		}
+	}
+	id, _, err := base58CheckDecode(payee.PublicKey.Address())
+	if err != nil {
+		return nil, nil, err
+	}
+	param, err := keyParams(net, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := address.NewPublicKey(open.PubKey, param)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := NewMicroPayee(pub, payee, open.Amount, open.Fee)
+	m.Witness = open.Witness
+	m.Net = net
+	sign, err := m.SignRefund(refund, open.Locktime)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, sign, nil
+}
+
+//ReceivePayment receives a payment from payer over c and returns the incremented tx.
+//It returns ErrChannelClosed if payer closes the channel.
+func (m *MicroPayee) ReceivePayment(c *Conn) (*Tx, error) {
+	msg, err := c.Receive()
+	if err != nil {
+		return nil, err
+	}
+	switch msg := msg.(type) {
+	case *MsgPayment:
+		tx, err := m.IncrementedTx(msg.Amount, msg.Sign)
+		if err != nil {
+			return nil, c.fail(ErrCodeInvalid, err)
+		}
+		return tx, nil
+	case *MsgClose:
+		if err := m.checkCloseRequest(msg, c.rseq-1); err != nil {
+			return nil, c.fail(ErrCodeInvalid, err)
+		}
+		return nil, ErrChannelClosed
+	}
+	return nil, c.fail(ErrCodeUnexpected, fmt.Errorf("unexpected message type %d", msg.Type()))
+}
@@ -37,23 +37,23 @@ const (
 	// opFALSE               = byte(0)
 	// opNA                  = byte(1)
 	opPUSHDATA1 = byte(76)
-	// opPUSHDATA2           = byte(77)
-	// opPUSHDATA4           = byte(78)
-	// op1NEGATE             = byte(79)
+	opPUSHDATA2 = byte(77)
+	opPUSHDATA4 = byte(78)
+	op1NEGATE   = byte(79)
 	// opTRUE                = byte(81)
 	// opNOP                 = byte(97)
-	// opIF                  = byte(99)
+	opIF = byte(99)
 	// opNOTIF               = byte(100)
-	// opELSE                = byte(103)
-	// opENDIF               = byte(104)
+	opELSE  = byte(103)
+	opENDIF = byte(104)
 	// opVERIFY              = byte(105)
 	opRETURN = byte(106)
 	// opTOALTSTACK          = byte(107)
 	// opFROMALTSTACK        = byte(108)
 	// opIFDUP               = byte(115)
 	// opDEPTH               = byte(116)
-	// opDROP                = byte(117)
-	opDUP = byte(118)
+	opDROP = byte(117)
+	opDUP  = byte(118)
 	// opNIP                 = byte(119)
 	// opOVER                = byte(120)
 	// opPICK                = byte(121)
@@ -71,7 +71,7 @@ const (
 	// opSUBSTR              = byte(127)
 	// opLEFT                = byte(128)
 	// opRIGHT               = byte(129)
-	// opSIZE                = byte(130)
+	opSIZE = byte(130)
 	// opINVERT              = byte(131)
 	// opAND                 = byte(132)
 	// opOR                  = byte(133)
@@ -107,7 +107,7 @@ const (
 	// opWITHIN              = byte(165)
 	// opRIPEMD160           = byte(166)
 	// opSHA1                = byte(167)
-	// opSHA256              = byte(168)
+	opSHA256  = byte(168)
 	opHASH160 = byte(169)
 	// opHASH256             = byte(170)
 	// opCODESEPARATOR       = byte(171)
@@ -119,15 +119,15 @@ const (
 	// opPUBKEYHASH          = byte(253)
 	// opPUBKEY              = byte(254)
 	// opINVALIDOPCODE       = byte(255)
-	// opRESERVED            = byte(80)
+	opRESERVED = byte(80)
 	// opVER                 = byte(98)
 	// opVERIF               = byte(101)
 	// opVERNOTIF            = byte(102)
 	// opRESERVED1           = byte(137)
 	// opRESERVED2           = byte(138)
 	// opNOP1                = byte(176)
-	// opNOP2                = byte(177)
-	// opNOP3                = byte(178)
+	opCHECKLOCKTIMEVERIFY = byte(177) //OP_NOP2
+	opCHECKSEQUENCEVERIFY = byte(178) //OP_NOP3
 	// opNOP4                = byte(179)
 	// opNOP5                = byte(180)
 	// opNOP6                = byte(181)
@@ -137,19 +137,24 @@ const (
 	// opNOP10               = byte(185)
 	op1 = byte(81)
 
-// op2                   = byte(82)
-// op3                   = byte(83)
-// op4                   = byte(84)
-// op5                   = byte(85)
-// op6                   = byte(86)
-// op7                   = byte(87)
-// op8                   = byte(88)
-// op9                   = byte(89)
-// op10                  = byte(90)
-// op11                  = byte(91)
-// op12                  = byte(92)
-// op13                  = byte(93)
-// op14                  = byte(94)
-// op15                  = byte(95)
-// op16                  = byte(96)
+	// op2                   = byte(82)
+	// op3                   = byte(83)
+	// op4                   = byte(84)
+	// op5                   = byte(85)
+	// op6                   = byte(86)
+	// op7                   = byte(87)
+	// op8                   = byte(88)
+	// op9                   = byte(89)
+	// op10                  = byte(90)
+	// op11                  = byte(91)
+	// op12                  = byte(92)
+	// op13                  = byte(93)
+	// op14                  = byte(94)
+	// op15                  = byte(95)
+	op16 = byte(96)
+
+	sigHashAll          = byte(0x01)
+	sigHashNone         = byte(0x02)
+	sigHashSingle       = byte(0x03)
+	sigHashAnyOneCanPay = byte(0x80)
 )
@@ -0,0 +1,605 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/bitgoin/address"
+)
+
+//ErrNotRevoked is returned by Penalty when tx is not a revoked commitment tx of remote.
+var ErrNotRevoked = errors.New("tx is not revoked commitment")
+
+//Duplex is one side of bidirectional payment channel.
+//Each side has its own commitment tx, whose output to itself can be spent after
+//Delay blocks, or by the other side with the revocation secret once the state is revoked.
+//Pubs[0] is the funder, who pays Fee of commitment txs.
+//If Net is set, updates whose commitment txs have dust outputs are rejected.
+type Duplex struct {
+	*PubInfo
+	//Delay is the relative locktime in blocks of outputs to owners of commitment txs.
+	Delay uint16
+	priv  *address.PrivateKey
+	local int
+	seed  []byte
+	//n is the number of current state.
+	n        uint64
+	balances [2]uint64
+	commit   *Tx
+	//theirHash is the revocation hash of remote's current state, and
+	//theirNext is that of next state.
+	theirHash []byte
+	theirNext []byte
+	//theirPrev is the revocation hash of remote's state to be revoked.
+	theirPrev []byte
+	//theirSecrets are revocation secrets of remote's revoked states.
+	theirSecrets [][]byte
+	//pending is the update sent to remote.
+	pending *DuplexUpdate
+}
+
+//DuplexOpen is exchanged to open duplex channel.
+type DuplexOpen struct {
+	Hash     []byte
+	NextHash []byte
+	Delay    uint16
+}
+
+//DuplexUpdate is sent by payer to update the balances to state N.
+//Sign is the sign of receiver's new commitment tx.
+type DuplexUpdate struct {
+	N        uint64
+	Balances [2]uint64
+	Sign     []byte
+}
+
+//DuplexRevocation revokes state N by revealing the revocation secret, and
+//tells the revocation hash of the next state.
+//Receiver of DuplexUpdate sends it with Sign of payer's new commitment tx,
+//and payer replies it without Sign.
+type DuplexRevocation struct {
+	N        uint64
+	Secret   []byte
+	NextHash []byte
+	Sign     []byte
+}
+
+//NewDuplex returns one side of duplex channel with remote. Funder puts amount
+//in the bond, whose balance is all of it except fee at first.
+func NewDuplex(priv *address.PrivateKey, remote *address.PublicKey, funder bool,
+	amount, fee uint64, delay uint16) (*Duplex, error) {
+	if fee >= amount {
+		return nil, errors.New("fee must be less than amount")
+	}
+	d := &Duplex{
+		PubInfo: &PubInfo{
+			Pubs:   []*address.PublicKey{priv.PublicKey, remote},
+			Amount: amount,
+			Fee:    fee,
+			M:      2,
+		},
+		Delay: delay,
+		priv:  priv,
+		seed:  make([]byte, 32),
+	}
+	if !funder {
+		d.Pubs[0], d.Pubs[1] = remote, priv.PublicKey
+		d.local = 1
+	}
+	d.balances[0] = amount - fee
+	if _, err := rand.Read(d.seed); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+//secret returns own revocation secret of state n.
+func (d *Duplex) secret(n uint64) []byte {
+	b := make([]byte, len(d.seed)+8)
+	copy(b, d.seed)
+	binary.BigEndian.PutUint64(b[len(d.seed):], n)
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+//revocationHash returns own revocation hash of state n.
+func (d *Duplex) revocationHash(n uint64) []byte {
+	return address.AddressBytes(d.secret(n))
+}
+
+//revocableScript returns redeem script of output to local, which local can spend
+//after delay blocks, or remote can spend with the secret whose hash160 is rhash.
+func revocableScript(local, remote *address.PublicKey, rhash []byte, delay uint16) []byte {
+	s := []byte{opIF, opHASH160}
+	s = pushData(s, rhash)
+	s = append(s, opEQUALVERIFY)
+	s = pushData(s, remote.Serialize())
+	s = append(s, opELSE)
+	s = pushData(s, scriptNumBytes(int64(delay)))
+	s = append(s, opCHECKSEQUENCEVERIFY, opDROP)
+	s = pushData(s, local.Serialize())
+	return append(s, opENDIF, opCHECKSIG)
+}
+
+//commitment returns commitment tx of i-th key with balances, whose output to i
+//is revocable with rhash. Outputs must not be dust in Net.
+func (d *Duplex) commitment(i int, balances [2]uint64, rhash []byte) (*Tx, error) {
+	prev, err := d.Outpoint()
+	if err != nil {
+		return nil, err
+	}
+	tx := &Tx{
+		Version: 2,
+		TxIn: []*TxIn{
+			&TxIn{
+				Hash:   prev.Hash,
+				Index:  prev.Index,
+				Script: []byte{},
+				Seq:    math.MaxUint32,
+			},
+		},
+	}
+	if balances[i] > 0 {
+		redeem := revocableScript(d.Pubs[i], d.Pubs[1-i], rhash, d.Delay)
+		tx.TxOut = append(tx.TxOut, &TxOut{
+			Value:  balances[i],
+			Script: p2shScript(address.AddressBytes(redeem)),
+		})
+	}
+	if balances[1-i] > 0 {
+		tx.TxOut = append(tx.TxOut, &TxOut{
+			Value:  balances[1-i],
+			Script: p2pkhScript(d.Pubs[1-i].AddressBytes()),
+		})
+	}
+	for _, out := range tx.TxOut {
+		if err := d.Net.checkDust(out); err != nil {
+			return nil, fmt.Errorf("commitment: %s", err)
+		}
+	}
+	return tx, nil
+}
+
+//signCommitment returns own sign of commitment tx.
+func (d *Duplex) signCommitment(tx *Tx) ([]byte, error) {
+	h, err := tx.sigHash(0, d.redeemScript())
+	if err != nil {
+		return nil, err
+	}
+	return signHash(d.priv, h)
+}
+
+//fillCommitment embeds own sign and sign of remote to own commitment tx.
+func (d *Duplex) fillCommitment(tx *Tx, sign []byte) error {
+	mysign, err := d.signCommitment(tx)
+	if err != nil {
+		return err
+	}
+	sigs := make([][]byte, 2)
+	sigs[d.local] = mysign
+	sigs[1-d.local] = sign
+	return d.embedSigns(tx, 0, sigs)
+}
+
+//Open returns the message to be sent to remote to open the channel.
+func (d *Duplex) Open() *DuplexOpen {
+	return &DuplexOpen{
+		Hash:     d.revocationHash(0),
+		NextHash: d.revocationHash(1),
+		Delay:    d.Delay,
+	}
+}
+
+//SetOpen sets the message from remote to open the channel.
+func (d *Duplex) SetOpen(o *DuplexOpen) error {
+	if o.Delay != d.Delay {
+		return fmt.Errorf("delay %d is not %d", o.Delay, d.Delay)
+	}
+	if len(o.Hash) != 20 || len(o.NextHash) != 20 {
+		return errors.New("illegal revocation hash")
+	}
+	d.theirHash = o.Hash
+	d.theirNext = o.NextHash
+	return nil
+}
+
+//SetBond sets bond made by funder with BondTx, which must spend only segwit coins.
+func (d *Duplex) SetBond(bond *Tx) error {
+	if err := checkMalleability(bond); err != nil {
+		return fmt.Errorf("illegal bond: %s", err)
+	}
+	d.bond = bond
+	d.prev = nil
+	index, err := d.searchTxout()
+	if err != nil {
+		d.bond = nil
+		return errors.New("bond doesn't pay to the channel")
+	}
+	if bond.TxOut[index].Value != d.Amount {
+		d.bond = nil
+		return errors.New("illegal amount of bond")
+	}
+	return nil
+}
+
+//SignCommitment signs the first commitment tx of remote.
+//Bond must not be broadcasted before both first commitment txs are signed.
+func (d *Duplex) SignCommitment() ([]byte, error) {
+	if d.theirHash == nil {
+		return nil, errors.New("remote is not opened")
+	}
+	if d.bond != nil {
+		if err := checkMalleability(d.bond); err != nil {
+			return nil, fmt.Errorf("illegal bond: %s", err)
+		}
+	}
+	tx, err := d.commitment(1-d.local, d.balances, d.theirHash)
+	if err != nil {
+		return nil, err
+	}
+	return d.signCommitment(tx)
+}
+
+//SetCommitmentSign sets the sign of own first commitment tx by remote.
+func (d *Duplex) SetCommitmentSign(sign []byte) error {
+	tx, err := d.commitment(d.local, d.balances, d.revocationHash(d.n))
+	if err != nil {
+		return err
+	}
+	if err := d.fillCommitment(tx, sign); err != nil {
+		return err
+	}
+	d.commit = tx
+	return nil
+}
+
+//Balance returns own and remote's balances.
+func (d *Duplex) Balance() (uint64, uint64) {
+	return d.balances[d.local], d.balances[1-d.local]
+}
+
+//Commitment returns own latest commitment tx signed by both, which closes
+//the channel unilaterally.
+func (d *Duplex) Commitment() *Tx {
+	return d.commit
+}
+
+//ready returns an error if an update is in progress.
+func (d *Duplex) ready() error {
+	switch {
+	case d.commit == nil:
+		return errors.New("channel is not opened")
+	case d.pending != nil || d.theirNext == nil:
+		return errors.New("update is in progress")
+	}
+	return nil
+}
+
+//Pay returns the update which pays amount to remote.
+func (d *Duplex) Pay(amount uint64) (*DuplexUpdate, error) {
+	if err := d.ready(); err != nil {
+		return nil, err
+	}
+	if amount == 0 || amount > d.balances[d.local] {
+		return nil, fmt.Errorf("illegal amount %d", amount)
+	}
+	b := d.balances
+	b[d.local] -= amount
+	b[1-d.local] += amount
+	tx, err := d.commitment(1-d.local, b, d.theirNext)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := d.signCommitment(tx)
+	if err != nil {
+		return nil, err
+	}
+	d.pending = &DuplexUpdate{
+		N:        d.n + 1,
+		Balances: b,
+		Sign:     sign,
+	}
+	return d.pending, nil
+}
+
+//ReceiveUpdate accepts the update which pays to own, and returns the revocation
+//of own current state with the sign of remote's new commitment tx.
+func (d *Duplex) ReceiveUpdate(u *DuplexUpdate) (*DuplexRevocation, error) {
+	if err := d.ready(); err != nil {
+		return nil, err
+	}
+	if u.N != d.n+1 {
+		return nil, fmt.Errorf("state %d is not %d", u.N, d.n+1)
+	}
+	if u.Balances[0]+u.Balances[1] != d.balances[0]+d.balances[1] ||
+		u.Balances[d.local] <= d.balances[d.local] {
+		return nil, errors.New("illegal balances")
+	}
+	tx, err := d.commitment(d.local, u.Balances, d.revocationHash(u.N))
+	if err != nil {
+		return nil, err
+	}
+	if err = d.fillCommitment(tx, u.Sign); err != nil {
+		return nil, err
+	}
+	rtx, err := d.commitment(1-d.local, u.Balances, d.theirNext)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := d.signCommitment(rtx)
+	if err != nil {
+		return nil, err
+	}
+	r := &DuplexRevocation{
+		N:        d.n,
+		Secret:   d.secret(d.n),
+		NextHash: d.revocationHash(u.N + 1),
+		Sign:     sign,
+	}
+	d.n = u.N
+	d.balances = u.Balances
+	d.commit = tx
+	d.theirPrev = d.theirHash
+	d.theirHash = d.theirNext
+	d.theirNext = nil
+	return r, nil
+}
+
+//ReceiveRevocation accepts the revocation from remote.
+//Payer gets the revocation of own previous state to be sent to remote, and
+//receiver of the update gets nil.
+func (d *Duplex) ReceiveRevocation(r *DuplexRevocation) (*DuplexRevocation, error) {
+	if d.pending == nil {
+		//receiver of the update.
+		if d.theirPrev == nil || d.theirNext != nil {
+			return nil, errors.New("no revocation is expected")
+		}
+		if err := d.revoke(r, d.theirPrev); err != nil {
+			return nil, err
+		}
+		d.theirPrev = nil
+		d.theirNext = r.NextHash
+		return nil, nil
+	}
+	u := d.pending
+	tx, err := d.commitment(d.local, u.Balances, d.revocationHash(u.N))
+	if err != nil {
+		return nil, err
+	}
+	if err = d.fillCommitment(tx, r.Sign); err != nil {
+		return nil, err
+	}
+	if err = d.revoke(r, d.theirHash); err != nil {
+		return nil, err
+	}
+	rr := &DuplexRevocation{
+		N:        d.n,
+		Secret:   d.secret(d.n),
+		NextHash: d.revocationHash(u.N + 1),
+	}
+	d.n = u.N
+	d.balances = u.Balances
+	d.commit = tx
+	d.theirHash = d.theirNext
+	d.theirNext = r.NextHash
+	d.pending = nil
+	return rr, nil
+}
+
+//revoke checks and stores the secret in r, whose hash must be rhash.
+func (d *Duplex) revoke(r *DuplexRevocation, rhash []byte) error {
+	if r.N != uint64(len(d.theirSecrets)) {
+		return fmt.Errorf("revoked state %d is not %d", r.N, len(d.theirSecrets))
+	}
+	if !bytes.Equal(address.AddressBytes(r.Secret), rhash) {
+		return errors.New("illegal revocation secret")
+	}
+	if len(r.NextHash) != 20 {
+		return errors.New("illegal revocation hash")
+	}
+	d.theirSecrets = append(d.theirSecrets, r.Secret)
+	return nil
+}
+
+//Sweep returns tx which spends own output of own commitment tx to addr with fee
+//after Delay blocks from its confirmation.
+func (d *Duplex) Sweep(addr string, fee uint64) (*Tx, error) {
+	if d.commit == nil {
+		return nil, errors.New("channel is not opened")
+	}
+	redeem := revocableScript(d.Pubs[d.local], d.Pubs[1-d.local], d.revocationHash(d.n), d.Delay)
+	script := p2shScript(address.AddressBytes(redeem))
+	out := d.commit.TxOut[0]
+	if !bytes.Equal(out.Script, script) {
+		return nil, errors.New("no output to own")
+	}
+	tx, err := spendOutputs(d.Net, d.commit, []uint32{0}, addr, out.Value, fee)
+	if err != nil {
+		return nil, err
+	}
+	tx.TxIn[0].Seq = uint32(d.Delay)
+	sign, err := signTxin(d.priv, tx, 0, redeem)
+	if err != nil {
+		return nil, err
+	}
+	s := pushData(nil, append(sign, sigHashAll))
+	s = append(s, op0)
+	tx.TxIn[0].Script = pushData(s, redeem)
+	return tx, nil
+}
+
+//Penalty returns tx which spends all outputs of remote's revoked commitment tx
+//to addr with fee, or ErrNotRevoked if tx is not revoked one.
+func (d *Duplex) Penalty(tx *Tx, addr string, fee uint64) (*Tx, error) {
+	return d.revocations().penalty(tx, addr, fee)
+}
+
+//Revocations is the revocation data of a duplex channel, which is enough to punish
+//remote for broadcasting a revoked commitment tx without the channel itself.
+//Key is the private key of own side, which signs the penalty tx.
+type Revocations struct {
+	ID      string
+	Bond    *Outpoint
+	Key     *address.PrivateKey
+	Remote  *address.PublicKey
+	Delay   uint16
+	Net     *Network
+	Secrets [][]byte
+}
+
+//Revocations returns a copy of the current revocation data of the opened channel.
+//Get it again after each update to watch newly revoked states.
+func (d *Duplex) Revocations() (*Revocations, error) {
+	if d.commit == nil {
+		return nil, errors.New("channel is not opened")
+	}
+	prev, err := d.Outpoint()
+	if err != nil {
+		return nil, err
+	}
+	id, err := d.ChannelID()
+	if err != nil {
+		return nil, err
+	}
+	r := d.revocations()
+	r.ID = id
+	r.Bond = prev
+	return r, nil
+}
+
+//revocations returns revocation data without ID and Bond.
+func (d *Duplex) revocations() *Revocations {
+	return &Revocations{
+		Key:     d.priv,
+		Remote:  d.Pubs[1-d.local],
+		Delay:   d.Delay,
+		Net:     d.Net,
+		Secrets: append([][]byte(nil), d.theirSecrets...),
+	}
+}
+
+//penalty returns tx which spends all outputs of remote's revoked commitment tx
+//to addr with fee, or ErrNotRevoked if tx is not revoked one.
+func (r *Revocations) penalty(tx *Tx, addr string, fee uint64) (*Tx, error) {
+	var redeem, secret []byte
+	index := -1
+	for _, s := range r.Secrets {
+		rs := revocableScript(r.Remote, r.Key.PublicKey, address.AddressBytes(s), r.Delay)
+		script := p2shScript(address.AddressBytes(rs))
+		for i, out := range tx.TxOut {
+			if bytes.Equal(out.Script, script) {
+				redeem, secret, index = rs, s, i
+			}
+		}
+		if index >= 0 {
+			break
+		}
+	}
+	if index < 0 {
+		return nil, ErrNotRevoked
+	}
+	indices := []uint32{uint32(index)}
+	amount := tx.TxOut[index].Value
+	p2pkh := p2pkhScript(r.Key.PublicKey.AddressBytes())
+	for i, out := range tx.TxOut {
+		if bytes.Equal(out.Script, p2pkh) {
+			indices = append(indices, uint32(i))
+			amount += out.Value
+		}
+	}
+	ptx, err := spendOutputs(r.Net, tx, indices, addr, amount, fee)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := signTxin(r.Key, ptx, 0, redeem)
+	if err != nil {
+		return nil, err
+	}
+	s := pushData(nil, append(sign, sigHashAll))
+	s = pushData(s, secret)
+	s = append(s, op1)
+	scripts := [][]byte{pushData(s, redeem)}
+	for i := 1; i < len(indices); i++ {
+		sign, err := signTxin(r.Key, ptx, i, p2pkh)
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, p2pkSigScript(sign, r.Key.PublicKey))
+	}
+	for i, s := range scripts {
+		ptx.TxIn[i].Script = s
+	}
+	return ptx, nil
+}
+
+//spendOutputs returns tx without signs which spends outputs at indices of tx to addr.
+func spendOutputs(net *Network, tx *Tx, indices []uint32, addr string, amount, fee uint64) (*Tx, error) {
+	if fee >= amount {
+		return nil, fmt.Errorf("fee %d must be less than amount %d", fee, amount)
+	}
+	script, err := addressScript(net, addr)
+	if err != nil {
+		return nil, err
+	}
+	stx := &Tx{
+		Version: 2,
+		TxOut: []*TxOut{
+			&TxOut{
+				Value:  amount - fee,
+				Script: script,
+			},
+		},
+	}
+	h := tx.Hash()
+	for _, i := range indices {
+		stx.TxIn = append(stx.TxIn, &TxIn{
+			Hash:   h,
+			Index:  i,
+			Script: []byte{},
+			Seq:    math.MaxUint32,
+		})
+	}
+	return stx, nil
+}
+
+//signTxin returns sign by priv of i-th txin of tx, whose previous script is prev.
+func signTxin(priv *address.PrivateKey, tx *Tx, i int, prev []byte) ([]byte, error) {
+	h, err := tx.sigHash(i, prev)
+	if err != nil {
+		return nil, err
+	}
+	return signHash(priv, h)
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bitgoin/address"
+)
+
+//testDuplex opens a duplex channel funded by keys[0] with Unit.
+func testDuplex(t *testing.T, keys []*address.PrivateKey) (*Duplex, *Duplex) {
+	alice, err := NewDuplex(keys[0], keys[1].PublicKey, true, Unit, 0.001*Unit, 144)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewDuplex(keys[1], keys[0].PublicKey, false, Unit, 0.001*Unit, 144)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = alice.SetOpen(bob.Open()); err != nil {
+		t.Fatal(err)
+	}
+	if err = bob.SetOpen(alice.Open()); err != nil {
+		t.Fatal(err)
+	}
+	bond, err := alice.BondTx(testSegwitCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bob.SetBond(bond); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range [][2]*Duplex{{alice, bob}, {bob, alice}} {
+		sign, err := d[0].SignCommitment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = d[1].SetCommitmentSign(sign); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return alice, bob
+}
+
+//testDuplexPay updates the channel so that from pays amount to to.
+func testDuplexPay(t *testing.T, from, to *Duplex, amount uint64) {
+	u, err := from.Pay(amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = from.Pay(amount); err == nil {
+		t.Error("must be error while updating")
+	}
+	r, err := to.ReceiveUpdate(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := from.ReceiveRevocation(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = to.ReceiveRevocation(rr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDuplex(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	alice, bob := testDuplex(t, keys)
+	revoked := alice.Commitment()
+	if d := disasm(revoked.TxIn[0].Script, true); strings.Count(d, "[ALL]") != 2 {
+		t.Error("illegal sigscript of commitment", d)
+	}
+
+	testDuplexPay(t, alice, bob, 0.3*Unit)
+	testDuplexPay(t, bob, alice, 0.1*Unit)
+	testDuplexPay(t, alice, bob, 0.2*Unit)
+	if l, r := alice.Balance(); l != 0.599*Unit || r != 0.4*Unit {
+		t.Error("illegal balance of alice", l, r)
+	}
+	if l, r := bob.Balance(); l != 0.4*Unit || r != 0.599*Unit {
+		t.Error("illegal balance of bob", l, r)
+	}
+	if _, err := alice.Pay(Unit); err == nil {
+		t.Error("must be error for insufficient balance")
+	}
+	u, err := bob.Pay(0.1 * Unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Balances[1] += Unit
+	if _, err = alice.ReceiveUpdate(u); err == nil {
+		t.Error("must be error for illegal balances")
+	}
+
+	c := bob.Commitment()
+	if len(c.TxOut) != 2 || c.TxOut[0].Value != 0.4*Unit || c.TxOut[1].Value != 0.599*Unit {
+		t.Error("illegal commitment of bob")
+	}
+	sweep, err := bob.Sweep(keys[1].PublicKey.Address(), 0.001*Unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sweep.Version != 2 || sweep.TxIn[0].Seq != 144 || sweep.TxOut[0].Value != 0.399*Unit {
+		t.Error("illegal sweep tx")
+	}
+	if !bytes.Equal(sweep.TxIn[0].Hash, c.Hash()) {
+		t.Error("sweep doesn't spend commitment")
+	}
+
+	if _, err = bob.Penalty(alice.Commitment(), keys[1].PublicKey.Address(), 0.001*Unit); err == nil {
+		t.Error("must be error for current commitment")
+	}
+	p, err := bob.Penalty(revoked, keys[1].PublicKey.Address(), 0.001*Unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.TxIn) != 1 || p.TxOut[0].Value != 0.998*Unit {
+		t.Error("illegal penalty tx")
+	}
+	redeem := revocableScript(keys[0].PublicKey, keys[1].PublicKey, address.AddressBytes(bob.theirSecrets[0]), 144)
+	if !bytes.HasSuffix(p.TxIn[0].Script, redeem) {
+		t.Error("illegal sigscript of penalty", disasm(p.TxIn[0].Script, true))
+	}
+	if d := disasm(redeem, false); !strings.Contains(d, "OP_CHECKSEQUENCEVERIFY") {
+		t.Error("illegal revocable script", d)
+	}
+}
+
+func TestDuplexDust(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	alice, bob := testDuplex(t, keys)
+	alice.Net = TestNet3
+	bob.Net = TestNet3
+	if _, err := alice.Pay(100); err == nil {
+		t.Error("must be error for dust output to remote")
+	}
+	if _, err := alice.Pay(0.999*Unit - 100); err == nil {
+		t.Error("must be error for dust output to own")
+	}
+	u := &DuplexUpdate{
+		N:        1,
+		Balances: [2]uint64{0.999*Unit - 100, 100},
+	}
+	if _, err := bob.ReceiveUpdate(u); err == nil {
+		t.Error("must be error for dust update")
+	}
+	testDuplexPay(t, alice, bob, 0.999*Unit)
+	if c := bob.Commitment(); len(c.TxOut) != 1 || c.TxOut[0].Value != 0.999*Unit {
+		t.Error("illegal commitment of bob")
+	}
+}
@@ -0,0 +1,319 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/bitgoin/address"
+)
+
+//HTLC is a hash time-locked contract, which pays to Recipient with the preimage
+//of Hash, or back to Sender after Timeout.
+type HTLC struct {
+	//Hash is SHA256 of the preimage.
+	Hash      []byte
+	Recipient *address.PublicKey
+	Sender    *address.PublicKey
+	//Timeout is the locktime checked by OP_CHECKLOCKTIMEVERIFY, or
+	//the relative locktime checked by OP_CHECKSEQUENCEVERIFY if Relative.
+	Timeout  uint32
+	Relative bool
+	//Witness is true if the output is P2WSH, otherwise P2SH.
+	Witness bool
+	//Sized requires the preimage to be 32 bytes, against secret size attack in
+	//cross-chain swaps. Swap always sets it.
+	Sized bool
+	Net   *Network
+}
+
+//NewHTLC returns HTLC whose hash is SHA256 of preimage.
+func NewHTLC(preimage []byte, recipient, sender *address.PublicKey, timeout uint32) *HTLC {
+	h := sha256.Sum256(preimage)
+	return &HTLC{
+		Hash:      h[:],
+		Recipient: recipient,
+		Sender:    sender,
+		Timeout:   timeout,
+	}
+}
+
+//ParseHTLC parses the script of HTLC, and returns HTLC with its keys, hash and timeout.
+//Keys are for net, or for MainNet if net is nil. Witness is not set.
+func ParseHTLC(script []byte, net *Network) (*HTLC, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil, err
+	}
+	sized := len(ops) == 15 && ops[1].code == opSIZE
+	//o is the offset of ops after the size check.
+	o := 0
+	if sized {
+		o = 3
+	}
+	if len(ops) != 12+o || ops[0].code != opIF || ops[1+o].code != opSHA256 {
+		return nil, errors.New("script is not HTLC")
+	}
+	param := MainNet.Params
+	if net != nil {
+		param = net.Params
+	}
+	h := &HTLC{
+		Hash:     ops[2+o].data,
+		Timeout:  uint32(scriptNum(ops[6+o].pushedData())),
+		Relative: ops[7+o].code == opCHECKSEQUENCEVERIFY,
+		Sized:    sized,
+		Net:      net,
+	}
+	if h.Recipient, err = address.NewPublicKey(ops[4+o].data, param); err != nil {
+		return nil, fmt.Errorf("illegal recipient key: %s", err)
+	}
+	if h.Sender, err = address.NewPublicKey(ops[9+o].data, param); err != nil {
+		return nil, fmt.Errorf("illegal sender key: %s", err)
+	}
+	s, err := h.Script()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(s, script) {
+		return nil, errors.New("script is not in standard form")
+	}
+	return h, nil
+}
+
+func (h *HTLC) check() error {
+	if len(h.Hash) != sha256.Size {
+		return errors.New("length of hash must be 32")
+	}
+	if h.Recipient == nil || h.Sender == nil {
+		return errors.New("keys must be set")
+	}
+	if h.Timeout == 0 {
+		return errors.New("timeout must not be 0")
+	}
+	if h.Relative && h.Timeout&(1<<31) != 0 {
+		return errors.New("disable flag must not be set in relative timeout")
+	}
+	if err := h.Net.checkKey(h.Recipient); err != nil {
+		return err
+	}
+	return h.Net.checkKey(h.Sender)
+}
+
+//Script returns the redeem script, or the witness script if Witness.
+func (h *HTLC) Script() ([]byte, error) {
+	if err := h.check(); err != nil {
+		return nil, err
+	}
+	s := []byte{opIF}
+	if h.Sized {
+		s = append(s, opSIZE)
+		s = pushData(s, scriptNumBytes(sha256.Size))
+		s = append(s, opEQUALVERIFY)
+	}
+	s = append(s, opSHA256)
+	s = pushData(s, h.Hash)
+	s = append(s, opEQUALVERIFY)
+	s = pushData(s, h.Recipient.Serialize())
+	s = append(s, opELSE)
+	s = pushData(s, scriptNumBytes(int64(h.Timeout)))
+	if h.Relative {
+		s = append(s, opCHECKSEQUENCEVERIFY)
+	} else {
+		s = append(s, opCHECKLOCKTIMEVERIFY)
+	}
+	s = append(s, opDROP)
+	s = pushData(s, h.Sender.Serialize())
+	return append(s, opENDIF, opCHECKSIG), nil
+}
+
+//ScriptPubKey returns the script of the output which pays to the HTLC.
+func (h *HTLC) ScriptPubKey() ([]byte, error) {
+	s, err := h.Script()
+	if err != nil {
+		return nil, err
+	}
+	if h.Witness {
+		sh := sha256.Sum256(s)
+		return witnessScript(0, sh[:]), nil
+	}
+	if len(s) > MaxRedeemScriptSize {
+		return nil, fmt.Errorf("length of redeem script %d exceeds %d", len(s), MaxRedeemScriptSize)
+	}
+	return p2shScript(address.AddressBytes(s)), nil
+}
+
+//Address returns the address of the HTLC in Net.
+func (h *HTLC) Address() (string, error) {
+	s, err := h.ScriptPubKey()
+	if err != nil {
+		return "", err
+	}
+	net := h.Net
+	if net == nil {
+		net = DefaultNet
+	}
+	return net.ScriptAddress(s), nil
+}
+
+//Claim returns tx which spends coin paid to the HTLC to addr with preimage.
+//Key of coin must be of Recipient.
+func (h *HTLC) Claim(coin *UTXO, preimage []byte, addr string, fee uint64) (*Tx, error) {
+	if h.Sized && len(preimage) != sha256.Size {
+		return nil, fmt.Errorf("length of preimage must be %d", sha256.Size)
+	}
+	if hash := sha256.Sum256(preimage); !bytes.Equal(hash[:], h.Hash) {
+		return nil, errors.New("illegal preimage")
+	}
+	if !bytes.Equal(coin.Key.PublicKey.Serialize(), h.Recipient.Serialize()) {
+		return nil, errors.New("key is not of recipient")
+	}
+	tx, err := h.spend(coin, addr, fee)
+	if err != nil {
+		return nil, err
+	}
+	return tx, h.sign(tx, coin, preimage, []byte{1})
+}
+
+//Refund returns tx which spends coin paid to the HTLC to addr after Timeout.
+//Key of coin must be of Sender.
+func (h *HTLC) Refund(coin *UTXO, addr string, fee uint64) (*Tx, error) {
+	if !bytes.Equal(coin.Key.PublicKey.Serialize(), h.Sender.Serialize()) {
+		return nil, errors.New("key is not of sender")
+	}
+	tx, err := h.spend(coin, addr, fee)
+	if err != nil {
+		return nil, err
+	}
+	if h.Relative {
+		tx.TxIn[0].Seq = h.Timeout
+	} else {
+		tx.Locktime = h.Timeout
+		tx.TxIn[0].Seq = math.MaxUint32 - 1
+	}
+	return tx, h.sign(tx, coin, nil, []byte{})
+}
+
+//spend returns tx without signs which spends coin to addr.
+func (h *HTLC) spend(coin *UTXO, addr string, fee uint64) (*Tx, error) {
+	script, err := h.ScriptPubKey()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(coin.Script, script) {
+		return nil, errors.New("coin is not paid to the HTLC")
+	}
+	return scriptSpend(h.Net, coin, addr, fee)
+}
+
+//sign embeds the sign with preimage and selector of the branch into tx.
+func (h *HTLC) sign(tx *Tx, coin *UTXO, preimage, branch []byte) error {
+	script, err := h.Script()
+	if err != nil {
+		return err
+	}
+	sign, err := scriptSign(tx, 0, coin.Key, script, coin.Value, h.Witness)
+	if err != nil {
+		return err
+	}
+	items := [][]byte{sign}
+	if preimage != nil {
+		items = append(items, preimage)
+	}
+	setScriptItems(tx.TxIn[0], append(items, branch, script), h.Witness)
+	return nil
+}
+
+//scriptSpend returns tx without signs which spends coin to addr with fee.
+func scriptSpend(net *Network, coin *UTXO, addr string, fee uint64) (*Tx, error) {
+	if fee >= coin.Value {
+		return nil, fmt.Errorf("fee %d must be less than amount %d", fee, coin.Value)
+	}
+	out, err := addressScript(net, addr)
+	if err != nil {
+		return nil, err
+	}
+	tx := &Tx{
+		Version: 2,
+		TxIn: []*TxIn{
+			&TxIn{
+				Hash:   coin.TxHash,
+				Index:  coin.TxIndex,
+				Script: []byte{},
+				Seq:    math.MaxUint32,
+			},
+		},
+		TxOut: []*TxOut{
+			&TxOut{
+				Value:  coin.Value - fee,
+				Script: out,
+			},
+		},
+	}
+	return tx, net.checkDust(tx.TxOut[0])
+}
+
+//scriptSigHash returns hash for signing i-th txin of tx, which spends
+//P2SH output, or P2WSH output of amount if witness, with script.
+func scriptSigHash(tx *Tx, i int, script []byte, amount uint64, witness bool) ([]byte, error) {
+	if witness {
+		return tx.witnessSigHash(i, script, amount)
+	}
+	return tx.sigHash(i, script)
+}
+
+//scriptSign returns the sign with hash type of i-th txin of tx, which spends
+//P2SH output, or P2WSH output of amount if witness, with script.
+func scriptSign(tx *Tx, i int, key *address.PrivateKey, script []byte, amount uint64, witness bool) ([]byte, error) {
+	hash, err := scriptSigHash(tx, i, script, amount, witness)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := signHash(key, hash)
+	if err != nil {
+		return nil, err
+	}
+	return append(sign, sigHashAll), nil
+}
+
+//setScriptItems sets items to witness of in if witness, otherwise pushes them to scriptSig.
+func setScriptItems(in *TxIn, items [][]byte, witness bool) {
+	if witness {
+		in.Witness = items
+		return
+	}
+	in.Script = []byte{}
+	for _, item := range items {
+		in.Script = pushData(in.Script, item)
+	}
+}
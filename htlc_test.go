@@ -0,0 +1,234 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestWitnessSigHash(t *testing.T) {
+	//native P2WPKH example in BIP143.
+	dat, err := hex.DecodeString("0100000002fff7f7881a8099afa6940d42d1e7f6362bec38171ea3edf433541db4e4ad969f0000000000eeffffffef51e1b804cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90ec68a0100000000ffffffff02202cb206000000001976a9148280b37df378db99f66f85c95a783a76ac7a6d5988ac9093510d000000001976a9143bde42dbee7e4dbe6a21b2d50ce2f0167faa815988ac11000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := ParseTX(dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := hex.DecodeString("76a9141d0f172a0ecb48aee1be1f2687d2963ae33f71a188ac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := tx.witnessSigHash(1, code, 600000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := hex.EncodeToString(h); s != "c37af31116d1b27caf68aae9e3ac82f1477929014d5b917657d0eb49478cb670" {
+		t.Error("illegal sighash", s)
+	}
+}
+
+func TestHTLC(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	preimage := []byte("some secret preimage")
+	for _, c := range []struct {
+		witness  bool
+		relative bool
+		timeout  uint32
+	}{
+		{false, false, 500000},
+		{true, false, 1500000000},
+		{false, true, 144},
+		{true, true, 16},
+	} {
+		h := NewHTLC(preimage, keys[1].PublicKey, keys[0].PublicKey, c.timeout)
+		h.Witness = c.witness
+		h.Relative = c.relative
+		script, err := h.Script()
+		if err != nil {
+			t.Fatal(err)
+		}
+		op := "OP_CHECKLOCKTIMEVERIFY"
+		if c.relative {
+			op = "OP_CHECKSEQUENCEVERIFY"
+		}
+		if d := disasm(script, false); !strings.HasPrefix(d, "OP_IF OP_SHA256") || !strings.Contains(d, op) {
+			t.Error("illegal script", d)
+		}
+		p, err := ParseHTLC(script, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p.Hash, h.Hash) || p.Timeout != c.timeout || p.Relative != c.relative ||
+			!bytes.Equal(p.Recipient.Serialize(), keys[1].PublicKey.Serialize()) {
+			t.Error("illegal parsed HTLC")
+		}
+		spk, err := h.ScriptPubKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		typ := ScriptScriptHash
+		if c.witness {
+			typ = ScriptWitnessV0ScriptHash
+		}
+		if ScriptType(spk) != typ {
+			t.Error("illegal script type", ScriptType(spk))
+		}
+		coin := &UTXO{
+			Key:     keys[1],
+			TxHash:  hash([]byte("htlc")),
+			Value:   Unit,
+			Script:  spk,
+			TxIndex: 1,
+		}
+		if _, err = h.Claim(coin, []byte("wrong"), keys[1].PublicKey.Address(), 0.001*Unit); err == nil {
+			t.Error("must be error for wrong preimage")
+		}
+		claim, err := h.Claim(coin, preimage, keys[1].PublicKey.Address(), 0.001*Unit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = h.Refund(coin, keys[0].PublicKey.Address(), 0.001*Unit); err == nil {
+			t.Error("must be error for key of recipient")
+		}
+		coin.Key = keys[0]
+		refund, err := h.Refund(coin, keys[0].PublicKey.Address(), 0.001*Unit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case c.relative && (refund.TxIn[0].Seq != c.timeout || refund.Locktime != 0):
+			t.Error("illegal sequence of refund")
+		case !c.relative && (refund.TxIn[0].Seq == 0xffffffff || refund.Locktime != c.timeout):
+			t.Error("illegal locktime of refund")
+		}
+		if claim.TxIn[0].Seq != 0xffffffff || claim.Locktime != 0 || claim.TxOut[0].Value != 0.999*Unit {
+			t.Error("illegal claim tx")
+		}
+
+		for i, tx := range []*Tx{claim, refund} {
+			items := tx.TxIn[0].Witness
+			if !c.witness {
+				if len(items) != 0 {
+					t.Error("P2SH spend must not have witness")
+				}
+				ops, err := parseScript(tx.TxIn[0].Script)
+				if err != nil {
+					t.Fatal(err)
+				}
+				items = nil
+				for _, o := range ops {
+					items = append(items, o.pushedData())
+				}
+			}
+			branch := []byte{}
+			pub := keys[0].PublicKey
+			if i == 0 {
+				if len(items) != 4 || !bytes.Equal(items[1], preimage) {
+					t.Fatal("illegal claim items")
+				}
+				items = append(items[:1], items[2:]...)
+				branch = []byte{1}
+				pub = keys[1].PublicKey
+			}
+			if len(items) != 3 || !bytes.Equal(items[1], branch) || !bytes.Equal(items[2], script) {
+				t.Fatal("illegal spending items", i)
+			}
+			var sh []byte
+			if c.witness {
+				sh, err = tx.witnessSigHash(0, script, Unit)
+			} else {
+				sh, err = tx.sigHash(0, script)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig := items[0]
+			if sig[len(sig)-1] != sigHashAll {
+				t.Error("illegal hash type")
+			}
+			if err = pub.Verify(sig[:len(sig)-1], sh); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func TestSizedHTLC(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	preimage := bytes.Repeat([]byte{1}, 32)
+	h := NewHTLC(preimage, keys[1].PublicKey, keys[0].PublicKey, 500000)
+	h.Sized = true
+	script, err := h.Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := disasm(script, false); !strings.HasPrefix(d, "OP_IF OP_SIZE") {
+		t.Error("illegal script", d)
+	}
+	p, err := ParseHTLC(script, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Sized || !bytes.Equal(p.Hash, h.Hash) || p.Timeout != 500000 ||
+		!bytes.Equal(p.Sender.Serialize(), keys[0].PublicKey.Serialize()) {
+		t.Error("illegal parsed HTLC")
+	}
+	spk, err := h.ScriptPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coin := &UTXO{
+		Key:    keys[1],
+		TxHash: hash([]byte("htlc")),
+		Value:  Unit,
+		Script: spk,
+	}
+	if _, err = h.Claim(coin, preimage, keys[1].PublicKey.Address(), 0.001*Unit); err != nil {
+		t.Fatal(err)
+	}
+	short := []byte("short")
+	s := NewHTLC(short, keys[1].PublicKey, keys[0].PublicKey, 500000)
+	s.Sized = true
+	if _, err = s.Claim(coin, short, keys[1].PublicKey.Address(), 0.001*Unit); err == nil {
+		t.Error("must be error for short preimage")
+	}
+	s.Sized = false
+	script, err = s.Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err = ParseHTLC(script, nil); err != nil || p.Sized {
+		t.Error("unsized HTLC must be parsed as unsized", err)
+	}
+}
@@ -0,0 +1,680 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitgoin/address"
+)
+
+//Paths and headers of micropayment over HTTP.
+const (
+	PathOpen  = "/micropayment/open"
+	PathBond  = "/micropayment/bond"
+	PathClose = "/micropayment/close"
+	//PathStatus is for GET to get the paid amount and the next sequence number of payments,
+	//with HeaderSequence and HeaderSign of payer.
+	PathStatus = "/micropayment/status"
+
+	//HeaderChannel is the ID of channel.
+	HeaderChannel = "X-Micropayment-Channel"
+	//HeaderPayment is MsgPayment in hex.
+	HeaderPayment = "X-Micropayment-Payment"
+	//HeaderError is the ErrCode, with the reason in body.
+	HeaderError = "X-Micropayment-Error"
+	//HeaderPaid is the amount paid in the channel.
+	HeaderPaid = "X-Micropayment-Paid"
+	//HeaderSequence is the sequence number of the next message from payer in responses,
+	//and that of the pending message in status requests.
+	HeaderSequence = "X-Micropayment-Sequence"
+	//HeaderSign is the sign of payer for the status request in hex.
+	HeaderSign = "X-Micropayment-Sign"
+)
+
+//Defaults of channels whose bonds are not received yet.
+const (
+	DefaultMaxPending          = 64
+	DefaultMaxPendingPerClient = 4
+	DefaultPendingTimeout      = 10 * time.Minute
+)
+
+//rw is io.ReadWriter of http request and response.
+type rw struct {
+	io.Reader
+	io.Writer
+}
+
+type payeeChannel struct {
+	mutex  sync.Mutex
+	payee  *MicroPayee
+	conn   *Conn
+	refund *Tx
+	bonded bool
+	opened time.Time
+	//client is the host which opened the channel.
+	client string
+}
+
+//PayeeServer is http.Handler which runs payee side of micropayment channels,
+//and serves Handler for requests paid by Price.
+//Zero values of MaxPending, MaxPendingPerClient and PendingTimeout mean the defaults.
+type PayeeServer struct {
+	Key *address.PrivateKey
+	//Net is the network of channels. No checks if nil.
+	Net *Network
+	//Price is the amount to be paid per request.
+	Price uint64
+	//Handler serves paid requests.
+	Handler http.Handler
+	//Accept checks the channel to be opened if not nil.
+	Accept func(*MsgOpen) error
+	//Store persists channels if not nil.
+	Store ChannelStore
+	//OnClose is called with the latest incremented tx when a channel is closed,
+	//if not nil. tx is nil if nothing is paid.
+	OnClose func(id string, tx *Tx)
+	//MaxPending is the maximum number of channels whose bonds are not received.
+	MaxPending int
+	//MaxPendingPerClient is MaxPending for each host of clients.
+	MaxPendingPerClient int
+	//PendingTimeout is the time after which channels without bonds are removed.
+	PendingTimeout time.Duration
+
+	mutex    sync.Mutex
+	channels map[string]*payeeChannel
+}
+
+//NewPayeeServer returns PayeeServer which serves handler for price per request.
+func NewPayeeServer(key *address.PrivateKey, price uint64, handler http.Handler) *PayeeServer {
+	return &PayeeServer{
+		Key:                 key,
+		Price:               price,
+		Handler:             handler,
+		MaxPending:          DefaultMaxPending,
+		MaxPendingPerClient: DefaultMaxPendingPerClient,
+		PendingTimeout:      DefaultPendingTimeout,
+		channels:            make(map[string]*payeeChannel),
+	}
+}
+
+//limits returns MaxPending, MaxPendingPerClient and PendingTimeout,
+//or the defaults if they are zero.
+func (s *PayeeServer) limits() (int, int, time.Duration) {
+	max, perClient, timeout := s.MaxPending, s.MaxPendingPerClient, s.PendingTimeout
+	if max == 0 {
+		max = DefaultMaxPending
+	}
+	if perClient == 0 {
+		perClient = DefaultMaxPendingPerClient
+	}
+	if timeout == 0 {
+		timeout = DefaultPendingTimeout
+	}
+	return max, perClient, timeout
+}
+
+//clientHost returns the host of the client of r.
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//httpError writes err with code and status.
+func httpError(w http.ResponseWriter, status int, err error) {
+	code := ErrCodeInvalid
+	if e, ok := err.(*MsgError); ok {
+		code = e.Code
+		err = errors.New(e.Reason)
+	}
+	w.Header().Set(HeaderError, strconv.Itoa(int(code)))
+	http.Error(w, err.Error(), status)
+}
+
+//responseError returns MsgError in resp, or nil if no error.
+func responseError(resp *http.Response) error {
+	code := resp.Header.Get(HeaderError)
+	if code == "" {
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("status %s", resp.Status)
+		}
+		return nil
+	}
+	c, err := strconv.Atoi(code)
+	if err != nil {
+		return fmt.Errorf("illegal error code %s", code)
+	}
+	reason, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxMessageSize))
+	if err != nil {
+		return err
+	}
+	return &MsgError{
+		Code:   ErrCode(c),
+		Reason: strings.TrimSpace(string(reason)),
+	}
+}
+
+//ServeHTTP handles messages of channels, and requests with payments.
+func (s *PayeeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case PathOpen, PathBond, PathClose:
+		if r.Method != http.MethodPost {
+			httpError(w, http.StatusMethodNotAllowed, errors.New("method must be POST"))
+			return
+		}
+	case PathStatus:
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, errors.New("method must be GET"))
+			return
+		}
+		s.status(w, r)
+		return
+	}
+	body := io.LimitReader(r.Body, 2*MaxMessageSize)
+	switch r.URL.Path {
+	case PathOpen:
+		s.open(w, clientHost(r), body)
+	case PathBond:
+		s.bond(w, r.Header.Get(HeaderChannel), body)
+	case PathClose:
+		s.close(w, r.Header.Get(HeaderChannel), body)
+	default:
+		s.serve(w, r)
+	}
+}
+
+//channel returns the channel of id.
+func (s *PayeeServer) channel(id string) (*payeeChannel, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ch, ok := s.channels[id]
+	if !ok {
+		return nil, ErrChannelNotFound
+	}
+	return ch, nil
+}
+
+func (s *PayeeServer) open(w http.ResponseWriter, client string, body io.Reader) {
+	c := NewConn(rw{body, nil})
+	msg, err := c.receive(MsgTypeOpen)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	open := msg.(*MsgOpen)
+	if msg, err = c.receive(MsgTypeRefundSignRequest); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	refund := msg.(*MsgRefundSignRequest).Refund
+	payee, sign, err := acceptOpen(s.Key, s.Net, open, refund, s.Accept)
+	if err != nil {
+		httpError(w, http.StatusForbidden, err)
+		return
+	}
+	id := fmt.Sprintf("%s:0", hex.EncodeToString(Reverse(refund.TxIn[0].Hash)))
+	c.rw = rw{nil, w}
+	ch := &payeeChannel{
+		payee:  payee,
+		conn:   c,
+		refund: refund,
+		opened: time.Now(),
+		client: client,
+	}
+	//the channel is locked until the response is sent.
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	s.mutex.Lock()
+	if _, ok := s.channels[id]; ok {
+		s.mutex.Unlock()
+		httpError(w, http.StatusConflict, fmt.Errorf("channel %s already exists", id))
+		return
+	}
+	max, perClient, _ := s.limits()
+	if n, nc := s.pending(client); n >= max || nc >= perClient {
+		s.mutex.Unlock()
+		httpError(w, http.StatusServiceUnavailable, errors.New("too many channels without bonds"))
+		return
+	}
+	if s.channels == nil {
+		s.channels = make(map[string]*payeeChannel)
+	}
+	s.channels[id] = ch
+	s.mutex.Unlock()
+	w.Header().Set(HeaderChannel, id)
+	if err = c.Send(&MsgRefundSignResponse{Sign: sign}); err != nil {
+		//payer can't get the sign, so free the slot.
+		s.mutex.Lock()
+		delete(s.channels, id)
+		s.mutex.Unlock()
+	}
+}
+
+//pending removes expired channels without bonds, and returns the number of the rest
+//and that of them opened by client. s.mutex must be locked.
+func (s *PayeeServer) pending(client string) (int, int) {
+	_, _, timeout := s.limits()
+	n, nc := 0, 0
+	for id, ch := range s.channels {
+		if ch.opened.IsZero() {
+			continue
+		}
+		if time.Since(ch.opened) > timeout {
+			delete(s.channels, id)
+			continue
+		}
+		n++
+		if ch.client == client {
+			nc++
+		}
+	}
+	return n, nc
+}
+
+func (s *PayeeServer) bond(w http.ResponseWriter, id string, body io.Reader) {
+	ch, err := s.channel(id)
+	if err != nil {
+		httpError(w, http.StatusNotFound, err)
+		return
+	}
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.bonded {
+		httpError(w, http.StatusConflict, errors.New("bond is already received"))
+		return
+	}
+	ch.conn.rw = rw{body, nil}
+	msg, err := ch.conn.receive(MsgTypeBond)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err = ch.payee.CheckBond(ch.refund, msg.(*MsgBond).Bond); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	if cid, err := ch.payee.ChannelID(); err != nil || cid != id {
+		httpError(w, http.StatusBadRequest, errors.New("bond is not for the channel"))
+		return
+	}
+	if s.Store != nil {
+		if err = ch.payee.SetStore(s.Store); err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	ch.bonded = true
+	s.mutex.Lock()
+	ch.opened = time.Time{}
+	s.mutex.Unlock()
+}
+
+//pay receives MsgPayment in r, which must pay more than Price.
+func (s *PayeeServer) pay(r *http.Request) (int, error) {
+	ch, err := s.channel(r.Header.Get(HeaderChannel))
+	if err != nil {
+		return http.StatusPaymentRequired, err
+	}
+	b, err := hex.DecodeString(r.Header.Get(HeaderPayment))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if !ch.bonded {
+		return http.StatusPaymentRequired, errors.New("bond is not received")
+	}
+	//sequence is advanced only if the payment is accepted.
+	msg, err := ch.conn.decode(bytes.NewReader(b), MsgTypePayment)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	p := msg.(*MsgPayment)
+	if p.Amount < ch.payee.amount+s.Price {
+		return http.StatusPaymentRequired, &MsgError{
+			Code:   ErrCodeInvalid,
+			Reason: fmt.Sprintf("amount %d must be at least %d", p.Amount, ch.payee.amount+s.Price),
+		}
+	}
+	if _, err = ch.payee.IncrementedTx(p.Amount, p.Sign); err != nil {
+		return http.StatusPaymentRequired, err
+	}
+	ch.conn.rseq++
+	return http.StatusOK, nil
+}
+
+func (s *PayeeServer) serve(w http.ResponseWriter, r *http.Request) {
+	if status, err := s.pay(r); err != nil {
+		httpError(w, status, err)
+		return
+	}
+	if s.Handler != nil {
+		s.Handler.ServeHTTP(w, r)
+	}
+}
+
+func (s *PayeeServer) close(w http.ResponseWriter, id string, body io.Reader) {
+	ch, err := s.channel(id)
+	if err != nil {
+		httpError(w, http.StatusNotFound, err)
+		return
+	}
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	//sequence is advanced only if payer signs the close.
+	msg, err := ch.conn.decode(body, MsgTypeClose)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err = ch.payee.checkCloseRequest(msg.(*MsgClose), ch.conn.rseq); err != nil {
+		httpError(w, http.StatusForbidden, err)
+		return
+	}
+	ch.conn.rseq++
+	s.mutex.Lock()
+	delete(s.channels, id)
+	s.mutex.Unlock()
+	tx := ch.payee.closed
+	if tx == nil && ch.payee.sign != nil {
+		tx, _ = ch.payee.LastIncrementedTx()
+	}
+	if s.OnClose != nil {
+		s.OnClose(id, tx)
+	}
+}
+
+//status responds the paid amount and the next sequence number of the channel,
+//so that payer can resync after the result of a payment is lost.
+//The request must be signed by payer for the pending message, which is
+//the next one or the last accepted one.
+func (s *PayeeServer) status(w http.ResponseWriter, r *http.Request) {
+	ch, err := s.channel(r.Header.Get(HeaderChannel))
+	if err != nil {
+		httpError(w, http.StatusNotFound, err)
+		return
+	}
+	seq, err := strconv.ParseUint(r.Header.Get(HeaderSequence), 10, 32)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("illegal sequence: %s", err))
+		return
+	}
+	sign, err := hex.DecodeString(r.Header.Get(HeaderSign))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if !ch.bonded {
+		httpError(w, http.StatusNotFound, errors.New("bond is not received"))
+		return
+	}
+	if uint32(seq) != ch.conn.rseq && uint32(seq)+1 != ch.conn.rseq {
+		httpError(w, http.StatusForbidden, fmt.Errorf("sequence %d is not pending", seq))
+		return
+	}
+	if err = ch.payee.checkStatusRequest(sign, uint32(seq)); err != nil {
+		httpError(w, http.StatusForbidden, err)
+		return
+	}
+	w.Header().Set(HeaderPaid, strconv.FormatUint(ch.payee.amount, 10))
+	w.Header().Set(HeaderSequence, strconv.FormatUint(uint64(ch.conn.rseq), 10))
+}
+
+//Do calls f with MicroPayee of channel id exclusively.
+func (s *PayeeServer) Do(id string, f func(*MicroPayee) error) error {
+	ch, err := s.channel(id)
+	if err != nil {
+		return err
+	}
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	return f(ch.payee)
+}
+
+//PayerClient is HTTP client for payer of micropayment channel to PayeeServer.
+type PayerClient struct {
+	URL    string
+	Client *http.Client
+	payer  *MicroPayer
+	conn   *Conn
+	id     string
+	paid   uint64
+	//pending is the amount of the payment whose result is unknown, or 0.
+	pending uint64
+}
+
+//NewPayerClient returns PayerClient for the server at url.
+//http.DefaultClient is used if client is nil.
+func NewPayerClient(url string, payer *MicroPayer, client *http.Client) *PayerClient {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &PayerClient{
+		URL:    strings.TrimSuffix(url, "/"),
+		Client: client,
+		payer:  payer,
+	}
+}
+
+//post posts messages to path of the server.
+func (p *PayerClient) post(path string, msgs ...Message) (*http.Response, error) {
+	var buf bytes.Buffer
+	p.conn.rw = rw{nil, &buf}
+	for _, m := range msgs {
+		if err := p.conn.Send(m); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, p.URL+path, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if p.id != "" {
+		req.Header.Set(HeaderChannel, p.id)
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := responseError(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+//Open opens a channel with the server, and returns bond tx to be broadcasted.
+func (p *PayerClient) Open(locktime uint32, coins UTXOs, ref string) (*Tx, error) {
+	if p.conn != nil {
+		return nil, errors.New("channel is already opened")
+	}
+	p.conn = NewConn(nil)
+	bond, refund, err := p.payer.CreateBond(locktime, coins, ref)
+	if err != nil {
+		return nil, err
+	}
+	open := &MsgOpen{
+		PubKey:   p.payer.priv.PublicKey.Serialize(),
+		Amount:   p.payer.Amount,
+		Fee:      p.payer.Fee,
+		Locktime: locktime,
+		Witness:  p.payer.Witness,
+	}
+	resp, err := p.post(PathOpen, open, &MsgRefundSignRequest{Refund: refund})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	p.conn.rw = rw{resp.Body, nil}
+	msg, err := p.conn.receive(MsgTypeRefundSignResponse)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.payer.SignRefund(refund, msg.(*MsgRefundSignResponse).Sign); err != nil {
+		return nil, err
+	}
+	p.id = resp.Header.Get(HeaderChannel)
+	resp, err = p.post(PathBond, &MsgBond{Bond: bond})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return bond, nil
+}
+
+//Do sends req with the payment of amount in addition to the paid amount.
+//If the server rejects the payment, MsgError is returned.
+func (p *PayerClient) Do(req *http.Request, amount uint64) (*http.Response, error) {
+	if p.id == "" {
+		return nil, errors.New("channel is not opened")
+	}
+	if p.pending != 0 {
+		if err := p.sync(); err != nil {
+			return nil, err
+		}
+	}
+	sign, err := p.payer.SignIncremented(p.paid + amount)
+	if err != nil {
+		return nil, err
+	}
+	b, err := EncodeMessage(&MsgPayment{Amount: p.paid + amount, Sign: sign}, p.conn.seq)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(HeaderChannel, p.id)
+	req.Header.Set(HeaderPayment, hex.EncodeToString(b))
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		//the server may have accepted the payment.
+		p.pending = p.paid + amount
+		if serr := p.sync(); serr != nil {
+			return nil, fmt.Errorf("%s, and failed to sync: %s", err, serr)
+		}
+		return nil, err
+	}
+	if resp.Header.Get(HeaderError) != "" {
+		err = responseError(resp)
+		resp.Body.Close()
+		p.payer.amount = p.paid
+		return nil, err
+	}
+	p.conn.seq++
+	p.paid += amount
+	return resp, nil
+}
+
+//sync gets the state of the channel from the server after the result of
+//the pending payment is lost, and follows it.
+func (p *PayerClient) sync() error {
+	req, err := http.NewRequest(http.MethodGet, p.URL+PathStatus, nil)
+	if err != nil {
+		return err
+	}
+	sign, err := p.payer.statusRequest(p.conn.seq)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(HeaderChannel, p.id)
+	req.Header.Set(HeaderSequence, strconv.FormatUint(uint64(p.conn.seq), 10))
+	req.Header.Set(HeaderSign, hex.EncodeToString(sign))
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = responseError(resp); err != nil {
+		return err
+	}
+	paid, err := strconv.ParseUint(resp.Header.Get(HeaderPaid), 10, 64)
+	if err != nil {
+		return fmt.Errorf("illegal paid amount: %s", err)
+	}
+	seq, err := strconv.ParseUint(resp.Header.Get(HeaderSequence), 10, 32)
+	if err != nil {
+		return fmt.Errorf("illegal sequence: %s", err)
+	}
+	switch {
+	case paid == p.pending && uint32(seq) == p.conn.seq+1:
+		//accepted.
+		p.conn.seq++
+		p.paid = paid
+	case paid == p.paid && uint32(seq) == p.conn.seq:
+		//not received.
+		p.payer.amount = p.paid
+	default:
+		return fmt.Errorf("paid amount %d and sequence %d of the server don't match", paid, seq)
+	}
+	p.pending = 0
+	return nil
+}
+
+//Paid returns the amount paid to the server.
+func (p *PayerClient) Paid() uint64 {
+	return p.paid
+}
+
+//Close closes the channel.
+func (p *PayerClient) Close() error {
+	if p.id == "" {
+		return errors.New("channel is not opened")
+	}
+	if p.pending != 0 {
+		if err := p.sync(); err != nil {
+			return err
+		}
+	}
+	msg, err := p.payer.closeRequest(p.paid, p.conn.seq)
+	if err != nil {
+		return err
+	}
+	resp, err := p.post(PathClose, msg)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	p.id = ""
+	return nil
+}
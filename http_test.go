@@ -0,0 +1,336 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitgoin/address"
+)
+
+func TestHTTPChannel(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	const price = 10000
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	server := NewPayeeServer(keys[1], price, api)
+	server.Accept = func(m *MsgOpen) error {
+		if m.Locktime < 100 {
+			t.Error("illegal locktime", m.Locktime)
+		}
+		return nil
+	}
+	var closed *Tx
+	server.OnClose = func(id string, tx *Tx) {
+		closed = tx
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	payer := NewMicroPayer(keys[0], keys[1].PublicKey, Unit, 0.001*Unit)
+	client := NewPayerClient(ts.URL, payer, ts.Client())
+	get := func(amount uint64) (string, error) {
+		req, err := http.NewRequest("GET", ts.URL+"/api", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req, amount)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), err
+	}
+	if _, err := get(price); err == nil {
+		t.Error("must be error before opening")
+	}
+	if _, err := client.Open(100, testSegwitCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address()); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ts.Client().Get(ts.URL + "/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPaymentRequired {
+		t.Error("must be 402 without payment", resp.StatusCode)
+	}
+
+	for i := 0; i < 3; i++ {
+		body, err := get(price)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "hello" {
+			t.Error("illegal body", body)
+		}
+	}
+	_, err = get(price - 1)
+	if e, ok := err.(*MsgError); !ok || e.Code != ErrCodeInvalid {
+		t.Error("must be MsgError for short payment", err)
+	}
+	if client.Paid() != 3*price {
+		t.Error("illegal paid amount", client.Paid())
+	}
+	if _, err = get(price); err != nil {
+		t.Fatal(err)
+	}
+
+	//replay the last request.
+	req, err := http.NewRequest("GET", ts.URL+"/api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(HeaderChannel, client.id)
+	sign, err := payer.SignIncremented(5 * price)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := EncodeMessage(&MsgPayment{Amount: 5 * price, Sign: sign}, client.conn.seq-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(HeaderPayment, hex.EncodeToString(b))
+	resp, err = ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || resp.Header.Get(HeaderError) == "" {
+		t.Error("must be error for replayed sequence", resp.StatusCode)
+	}
+
+	if err = client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if closed == nil || closed.TxOut[1].Value != 4*price {
+		t.Error("illegal incremented tx at close")
+	}
+}
+
+type dropTransport struct {
+	drop bool
+}
+
+//RoundTrip sends req, and drops the response once if t.drop is set.
+func (t *dropTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil || !t.drop || req.URL.Path != "/api" {
+		return resp, err
+	}
+	t.drop = false
+	resp.Body.Close()
+	return nil, errors.New("connection reset")
+}
+
+func TestHTTPChannelClose(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	const price = 10000
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	server := NewPayeeServer(keys[1], price, api)
+	closed := false
+	server.OnClose = func(id string, tx *Tx) {
+		closed = true
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	//a channel without bond blocks others.
+	server.MaxPending = 1
+	server.channels["pending"] = &payeeChannel{opened: time.Now(), client: "192.0.2.1"}
+	tr := &dropTransport{}
+	payer := NewMicroPayer(keys[0], keys[1].PublicKey, Unit, 0.001*Unit)
+	client := NewPayerClient(ts.URL, payer, &http.Client{Transport: tr})
+	coins := testSegwitCoins(t, keys[0], 2*Unit)
+	_, err := client.Open(100, coins, keys[0].PublicKey.Address())
+	if err == nil {
+		t.Fatal("must be error if too many channels are pending")
+	}
+	//zero means the default.
+	server.MaxPending = 0
+	server.MaxPendingPerClient = 1
+	server.channels["pending"].client = "127.0.0.1"
+	client = NewPayerClient(ts.URL, payer, &http.Client{Transport: tr})
+	if _, err = client.Open(100, coins, keys[0].PublicKey.Address()); err == nil {
+		t.Fatal("must be error if too many channels are pending for the client")
+	}
+	server.channels["pending"].opened = time.Now().Add(-2 * server.PendingTimeout)
+	client = NewPayerClient(ts.URL, payer, &http.Client{Transport: tr})
+	if _, err = client.Open(100, coins, keys[0].PublicKey.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.channels["pending"]; ok {
+		t.Error("expired channel must be removed")
+	}
+
+	get := func() error {
+		req, err := http.NewRequest("GET", ts.URL+"/api", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req, price)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	if err = get(); err != nil {
+		t.Fatal(err)
+	}
+	//the server accepts the payment but the response is lost.
+	tr.drop = true
+	if err = get(); err == nil {
+		t.Fatal("must be error if response is lost")
+	}
+	if client.Paid() != 2*price {
+		t.Error("must follow the accepted payment", client.Paid())
+	}
+	if err = get(); err != nil {
+		t.Fatal(err)
+	}
+	if client.Paid() != 3*price {
+		t.Error("illegal paid amount", client.Paid())
+	}
+	err = server.Do(client.id, func(m *MicroPayee) error {
+		if m.amount != 3*price {
+			t.Error("illegal paid amount of payee", m.amount)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getStatus := func(signer *address.PrivateKey) int {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+PathStatus, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(HeaderChannel, client.id)
+		req.Header.Set(HeaderSequence, strconv.FormatUint(uint64(client.conn.seq), 10))
+		if signer != nil {
+			p := &MicroPayer{PubInfo: payer.PubInfo, priv: signer}
+			sign, err := p.statusRequest(client.conn.seq)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set(HeaderSign, hex.EncodeToString(sign))
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && resp.Header.Get(HeaderPaid) == "" {
+			t.Error("paid amount must be returned")
+		}
+		return resp.StatusCode
+	}
+	if status := getStatus(nil); status == http.StatusOK {
+		t.Error("status must not be returned without sign")
+	}
+	if status := getStatus(keys[1]); status != http.StatusForbidden {
+		t.Error("status must not be returned for sign of other than payer", status)
+	}
+	if status := getStatus(keys[0]); status != http.StatusOK {
+		t.Error("status must be returned for payer", status)
+	}
+
+	postClose := func(msg *MsgClose) *http.Response {
+		b, err := EncodeMessage(msg, client.conn.seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodPost, ts.URL+PathClose, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(HeaderChannel, client.id)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	forger := &MicroPayer{PubInfo: payer.PubInfo, priv: keys[1]}
+	forged, err := forger.closeRequest(3*price, client.conn.seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := postClose(forged); resp.StatusCode != http.StatusForbidden {
+		t.Error("must be rejected for close not signed by payer", resp.StatusCode)
+	}
+	if resp := postClose(&MsgClose{Amount: 3 * price}); resp.StatusCode != http.StatusForbidden {
+		t.Error("must be rejected for unsigned close", resp.StatusCode)
+	}
+	wrong, err := payer.closeRequest(2*price, client.conn.seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := postClose(wrong); resp.StatusCode != http.StatusForbidden {
+		t.Error("must be rejected for close with wrong amount", resp.StatusCode)
+	}
+	if closed {
+		t.Fatal("must not be closed by rejected requests")
+	}
+	if err = get(); err != nil {
+		t.Fatal("sequence must not be advanced by rejected requests", err)
+	}
+	if err = client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !closed {
+		t.Error("must be closed")
+	}
+}
+
+func TestPayeeServerZero(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	server := &PayeeServer{Key: keys[1], Price: 10000}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	payer := NewMicroPayer(keys[0], keys[1].PublicKey, Unit, 0.001*Unit)
+	client := NewPayerClient(ts.URL, payer, nil)
+	if _, err := client.Open(100, testSegwitCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address()); err != nil {
+		t.Fatal(err)
+	}
+}
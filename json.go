@@ -0,0 +1,298 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//amount is satoshi which is shown in BTC like 0.00100000 in JSON.
+type amount uint64
+
+//MarshalJSON returns amount in BTC with 8 decimals.
+func (a amount) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d.%08d", a/Unit, a%Unit)), nil
+}
+
+//UnmarshalJSON parses amount in BTC without rounding.
+func (a *amount) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if strings.ContainsAny(s, "eE-+") {
+		return fmt.Errorf("invalid amount %s", s)
+	}
+	ints := s
+	var fracs string
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		ints, fracs = s[:i], s[i+1:]
+	}
+	if len(fracs) > 8 {
+		return fmt.Errorf("amount %s has more than 8 decimals", s)
+	}
+	fracs += strings.Repeat("0", 8-len(fracs))
+	in, err := strconv.ParseUint(ints, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid amount %s", s)
+	}
+	frac, err := strconv.ParseUint(fracs, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid amount %s", s)
+	}
+	if in > (math.MaxUint64-frac)/Unit {
+		return fmt.Errorf("amount %s overflows", s)
+	}
+	*a = amount(in*Unit + frac)
+	return nil
+}
+
+type jsonScript struct {
+	Asm     string `json:"asm"`
+	Hex     string `json:"hex"`
+	Type    string `json:"type,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+type jsonTxIn struct {
+	Coinbase  string      `json:"coinbase,omitempty"`
+	TxID      string      `json:"txid,omitempty"`
+	Vout      *uint32     `json:"vout,omitempty"`
+	ScriptSig *jsonScript `json:"scriptSig,omitempty"`
+	Witness   []string    `json:"txinwitness,omitempty"`
+	Sequence  uint32      `json:"sequence"`
+}
+
+type jsonTxOut struct {
+	Value        amount     `json:"value"`
+	N            *uint32    `json:"n,omitempty"`
+	ScriptPubKey jsonScript `json:"scriptPubKey"`
+}
+
+type jsonTx struct {
+	TxID     string       `json:"txid"`
+	Hash     string       `json:"hash"`
+	Version  uint32       `json:"version"`
+	Size     int          `json:"size"`
+	VSize    int          `json:"vsize"`
+	Weight   int          `json:"weight"`
+	Locktime uint32       `json:"locktime"`
+	Vin      []*TxIn      `json:"vin"`
+	Vout     []*jsonTxOut `json:"vout"`
+}
+
+//isCoinbase returns true if the txin spends nothing, i.e. is coinbase.
+func (in *TxIn) isCoinbase() bool {
+	return in.Index == math.MaxUint32 && bytes.Equal(in.Hash, make([]byte, 32))
+}
+
+func decodeHexes(strs []string) ([][]byte, error) {
+	if len(strs) == 0 {
+		return nil, nil
+	}
+	bs := make([][]byte, len(strs))
+	for i, s := range strs {
+		var err error
+		if bs[i], err = hex.DecodeString(s); err != nil {
+			return nil, err
+		}
+	}
+	return bs, nil
+}
+
+//MarshalJSON returns txin in the same format as vin of bitcoind's decoderawtransaction.
+func (in *TxIn) MarshalJSON() ([]byte, error) {
+	j := jsonTxIn{
+		Sequence: in.Seq,
+	}
+	if in.isCoinbase() {
+		j.Coinbase = hex.EncodeToString(in.Script)
+	} else {
+		index := in.Index
+		j.TxID = hex.EncodeToString(Reverse(in.Hash))
+		j.Vout = &index
+		j.ScriptSig = &jsonScript{
+			Asm: disasm(in.Script, true),
+			Hex: hex.EncodeToString(in.Script),
+		}
+	}
+	for _, w := range in.Witness {
+		j.Witness = append(j.Witness, hex.EncodeToString(w))
+	}
+	return json.Marshal(&j)
+}
+
+//UnmarshalJSON parses txin in the same format as vin of bitcoind's decoderawtransaction.
+func (in *TxIn) UnmarshalJSON(b []byte) error {
+	var j jsonTxIn
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	var err error
+	if in.Witness, err = decodeHexes(j.Witness); err != nil {
+		return err
+	}
+	in.Seq = j.Sequence
+	if j.TxID == "" {
+		in.Hash = make([]byte, 32)
+		in.Index = math.MaxUint32
+		in.Script, err = hex.DecodeString(j.Coinbase)
+		return err
+	}
+	h, err := hex.DecodeString(j.TxID)
+	if err != nil {
+		return err
+	}
+	if len(h) != 32 {
+		return errors.New("length of txid must be 32 bytes")
+	}
+	if j.Vout == nil {
+		return errors.New("vout must be filled")
+	}
+	in.Hash = Reverse(h)
+	in.Index = *j.Vout
+	in.Script = []byte{}
+	if j.ScriptSig != nil {
+		in.Script, err = hex.DecodeString(j.ScriptSig.Hex)
+	}
+	return err
+}
+
+func (out *TxOut) toJSON() *jsonTxOut {
+	return &jsonTxOut{
+		Value: amount(out.Value),
+		ScriptPubKey: jsonScript{
+			Asm:     disasm(out.Script, false),
+			Hex:     hex.EncodeToString(out.Script),
+			Type:    ScriptType(out.Script),
+			Address: DefaultNet.ScriptAddress(out.Script),
+		},
+	}
+}
+
+func (j *jsonTxOut) toTxOut() (*TxOut, error) {
+	script, err := hex.DecodeString(j.ScriptPubKey.Hex)
+	if err != nil {
+		return nil, err
+	}
+	return &TxOut{
+		Value:  uint64(j.Value),
+		Script: script,
+	}, nil
+}
+
+//MarshalJSON returns txout in the same format as vout of bitcoind's decoderawtransaction
+//without "n".
+func (out *TxOut) MarshalJSON() ([]byte, error) {
+	return json.Marshal(out.toJSON())
+}
+
+//UnmarshalJSON parses txout in the same format as vout of bitcoind's decoderawtransaction.
+func (out *TxOut) UnmarshalJSON(b []byte) error {
+	var j jsonTxOut
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	o, err := j.toTxOut()
+	if err != nil {
+		return err
+	}
+	*out = *o
+	return nil
+}
+
+//MarshalJSON returns tx in the same format as bitcoind's decoderawtransaction.
+//Addresses in vout are shown in DefaultNet.
+func (t *Tx) MarshalJSON() ([]byte, error) {
+	txid := t.Hash()
+	if txid == nil {
+		return nil, errors.New("failed to pack tx")
+	}
+	j := jsonTx{
+		TxID:     hex.EncodeToString(Reverse(txid)),
+		Hash:     hex.EncodeToString(Reverse(t.WitnessHash())),
+		Version:  t.Version,
+		Size:     t.Size(),
+		VSize:    t.VSize(),
+		Weight:   t.Weight(),
+		Locktime: t.Locktime,
+		Vin:      t.TxIn,
+		Vout:     make([]*jsonTxOut, len(t.TxOut)),
+	}
+	if j.Vin == nil {
+		j.Vin = []*TxIn{}
+	}
+	for i, out := range t.TxOut {
+		n := uint32(i)
+		j.Vout[i] = out.toJSON()
+		j.Vout[i].N = &n
+	}
+	return json.Marshal(&j)
+}
+
+//UnmarshalJSON parses tx in the same format as bitcoind's decoderawtransaction.
+//Derived fields like size are ignored, except that txid must match if filled.
+func (t *Tx) UnmarshalJSON(b []byte) error {
+	var j jsonTx
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	tx := Tx{
+		Version:  j.Version,
+		TxIn:     j.Vin,
+		TxOut:    make([]*TxOut, len(j.Vout)),
+		Locktime: j.Locktime,
+	}
+	for i, in := range j.Vin {
+		if in == nil {
+			return fmt.Errorf("vin %d is null", i)
+		}
+	}
+	for i, jo := range j.Vout {
+		if jo == nil {
+			return fmt.Errorf("vout %d is null", i)
+		}
+		if jo.N != nil && *jo.N != uint32(i) {
+			return fmt.Errorf("n of vout %d unmatches", i)
+		}
+		var err error
+		if tx.TxOut[i], err = jo.toTxOut(); err != nil {
+			return err
+		}
+	}
+	if j.TxID != "" && j.TxID != hex.EncodeToString(Reverse(tx.Hash())) {
+		return errors.New("txid unmatches")
+	}
+	*t = tx
+	return nil
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+//signed tx of native P2WPKH example in BIP143.
+const segwitTx = "01000000000102fff7f7881a8099afa6940d42d1e7f6362bec38171ea3edf433541db4e4ad969f00000000494830450221008b9d1dc26ba6a9cb62127b02742fa9d754cd3bebf337f7a55d114c8e5cdd30be022040529b194ba3f9281a99f2b1c0a19c0489bc22ede944ccf4ecbab4cc618ef3ed01eeffffffef51e1b804cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90ec68a0100000000ffffffff02202cb206000000001976a9148280b37df378db99f66f85c95a783a76ac7a6d5988ac9093510d000000001976a9143bde42dbee7e4dbe6a21b2d50ce2f0167faa815988ac000247304402203609e17b84f6a7d30c80bfa610b5b4542f32a8a0d5447a12fb1366d7f01cc44a0220573a954c4518331561406f90300e8f3358f51928d43c212a8caed02de67eebee0121025476c2e83188368da1ff3e292e7acafcdb3566bb0ad253f62fc70f07aeee635711000000"
+
+func TestTxJSON(t *testing.T) {
+	raw, err := hex.DecodeString(segwitTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := ParseTX(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var j struct {
+		TxID   string
+		Hash   string
+		Size   int
+		VSize  int
+		Weight int
+		Vin    []struct {
+			ScriptSig   jsonScript
+			TxInWitness []string
+		}
+		Vout []struct {
+			Value        json.Number
+			N            int
+			ScriptPubKey jsonScript
+		}
+	}
+	if err = json.Unmarshal(b, &j); err != nil {
+		t.Fatal(err)
+	}
+	if j.TxID == j.Hash {
+		t.Error("txid must differ from hash in segwit tx")
+	}
+	stripped := Tx{
+		Version:  tx.Version,
+		TxOut:    tx.TxOut,
+		Locktime: tx.Locktime,
+	}
+	for _, in := range tx.TxIn {
+		stripped.TxIn = append(stripped.TxIn, &TxIn{
+			Hash:   in.Hash,
+			Index:  in.Index,
+			Script: in.Script,
+			Seq:    in.Seq,
+		})
+	}
+	base := stripped.Size()
+	if j.Size != len(raw) || j.Weight != base*3+len(raw) || j.VSize != (j.Weight+3)/4 {
+		t.Error("illegal size", j.Size, j.VSize, j.Weight)
+	}
+	if !strings.HasSuffix(j.Vin[0].ScriptSig.Asm, "[ALL]") || len(j.Vin[0].TxInWitness) != 0 {
+		t.Error("illegal vin 0", j.Vin[0])
+	}
+	if len(j.Vin[1].TxInWitness) != 2 || j.Vin[1].ScriptSig.Hex != "" {
+		t.Error("illegal vin 1", j.Vin[1])
+	}
+	out := j.Vout[0]
+	if out.Value != "1.12340000" || out.N != 0 ||
+		out.ScriptPubKey.Type != ScriptPubKeyHash ||
+		out.ScriptPubKey.Address != "1Cu32FVupVCgHkMMRJdYJugxwo2Aprgk7H" ||
+		out.ScriptPubKey.Asm != "OP_DUP OP_HASH160 8280b37df378db99f66f85c95a783a76ac7a6d59 OP_EQUALVERIFY OP_CHECKSIG" {
+		t.Error("illegal vout", out)
+	}
+
+	tx2 := Tx{}
+	if err = json.Unmarshal(b, &tx2); err != nil {
+		t.Fatal(err)
+	}
+	raw2, err := tx2.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, raw2) {
+		t.Error("tx unmatches after unmarshaling", hex.EncodeToString(raw2))
+	}
+	for _, s := range []string{`{"vin":[null]}`, `{"vout":[null]}`} {
+		if err = json.Unmarshal([]byte(s), &tx2); err == nil {
+			t.Error("must be error for null element", s)
+		}
+	}
+	b = bytes.Replace(b, []byte(j.TxID), []byte(j.Hash), 1)
+	if err = json.Unmarshal(b, &tx2); err == nil {
+		t.Error("must be error for wrong txid")
+	}
+}
+
+func TestScriptAddress(t *testing.T) {
+	addrs := map[string]string{
+		"0014751e76e8199196d454941c45d1b3a323f1433bd6":                                   "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+		"512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798":           "bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0",
+		"a914748284390f9e263a4b766a75d0633c50426eb87587":                                 "3CK4fEwbMP7heJarmU4eqA3sMbVJyEnU3V",
+		"6a0b68656c6c6f20776f726c64":                                                     "",
+		"5221000000000000000000000000000000000000000000000000000000000000000000000052ae": "",
+	}
+	for s, adr := range addrs {
+		script, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := MainNet.ScriptAddress(script); a != adr {
+			t.Error("illegal address", s, a)
+		}
+	}
+}
+
+func TestAmountJSON(t *testing.T) {
+	ok := map[string]uint64{
+		"0":            0,
+		"0.001":        0.001 * Unit,
+		"21000000.0":   21000000 * Unit,
+		"1.00000001":   Unit + 1,
+		"0.12345678":   12345678,
+		"92233720368.": 92233720368 * Unit,
+	}
+	for s, v := range ok {
+		var a amount
+		if err := a.UnmarshalJSON([]byte(s)); err != nil {
+			t.Error(s, err)
+		}
+		if uint64(a) != v {
+			t.Error("illegal amount", s, a)
+		}
+	}
+	for _, s := range []string{"1e-3", "-1", "0.000000001", "abc", "999999999999999"} {
+		var a amount
+		if err := a.UnmarshalJSON([]byte(s)); err == nil {
+			t.Error("must be error", s)
+		}
+	}
+	if b, _ := amount(Unit + 1).MarshalJSON(); string(b) != "1.00000001" {
+		t.Error("illegal json of amount", string(b))
+	}
+}
+
+func TestParseLargeCount(t *testing.T) {
+	for _, p := range []string{
+		//4000000 txins.
+		"01000000fe00093d00",
+		//a txin whose scriptSig is 4000000 bytes.
+		"0100000001" + strings.Repeat("00", 36) + "fe00093d00",
+		//a txin and 4000000 txouts.
+		"0100000001" + strings.Repeat("00", 36) + "00ffffffff" + "fe00093d00",
+	} {
+		b, err := hex.DecodeString(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err = ParseTX(b); err == nil {
+			t.Error("must be error for truncated tx", p)
+		}
+		runtime.ReadMemStats(&after)
+		if a := after.TotalAlloc - before.TotalAlloc; a > 1<<20 {
+			t.Error("too large allocation for short input", a, p)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/bitgoin/address"
+)
+
+type managedChannel struct {
+	mutex   sync.Mutex
+	payee   *MicroPayee
+	closing bool
+}
+
+//PayeeManager manages channels of payee by channel ID and payer key.
+//It is safe for concurrent use, and updates of each channel are serialized.
+//Channels must not be used directly after adding to PayeeManager.
+type PayeeManager struct {
+	mutex    sync.RWMutex
+	channels map[string]*managedChannel
+	payers   map[string][]string
+}
+
+//NewPayeeManager returns an empty PayeeManager.
+func NewPayeeManager() *PayeeManager {
+	return &PayeeManager{
+		channels: make(map[string]*managedChannel),
+		payers:   make(map[string][]string),
+	}
+}
+
+func payerID(pub *address.PublicKey) string {
+	return hex.EncodeToString(pub.Serialize())
+}
+
+//Add adds payee, whose bond must be checked, and returns its channel ID.
+func (pm *PayeeManager) Add(payee *MicroPayee) (string, error) {
+	id, err := payee.ChannelID()
+	if err != nil {
+		return "", err
+	}
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	if _, ok := pm.channels[id]; ok {
+		return "", fmt.Errorf("channel %s already exists", id)
+	}
+	pm.channels[id] = &managedChannel{
+		payee: payee,
+	}
+	p := payerID(payee.Pubs[0])
+	pm.payers[p] = append(pm.payers[p], id)
+	return id, nil
+}
+
+//channel returns the channel of id locked.
+func (pm *PayeeManager) channel(id string) (*managedChannel, error) {
+	pm.mutex.RLock()
+	ch, ok := pm.channels[id]
+	pm.mutex.RUnlock()
+	if !ok {
+		return nil, ErrChannelNotFound
+	}
+	ch.mutex.Lock()
+	return ch, nil
+}
+
+//Do calls f with payee of channel id exclusively.
+//f must not call methods of PayeeManager.
+func (pm *PayeeManager) Do(id string, f func(*MicroPayee) error) error {
+	ch, err := pm.channel(id)
+	if err != nil {
+		return err
+	}
+	defer ch.mutex.Unlock()
+	return f(ch.payee)
+}
+
+//IncrementedTx returns the incremented tx of channel id.
+//amount must be greater than the last one, and the channel must not be closing.
+func (pm *PayeeManager) IncrementedTx(id string, amount uint64, sign []byte) (*Tx, error) {
+	ch, err := pm.channel(id)
+	if err != nil {
+		return nil, err
+	}
+	defer ch.mutex.Unlock()
+	if ch.closing {
+		return nil, ErrChannelClosed
+	}
+	if amount <= ch.payee.amount {
+		return nil, fmt.Errorf("amount %d must be greater than %d", amount, ch.payee.amount)
+	}
+	return ch.payee.IncrementedTx(amount, sign)
+}
+
+//Channels returns IDs of channels opened by payer.
+func (pm *PayeeManager) Channels(payer *address.PublicKey) []string {
+	pm.mutex.RLock()
+	defer pm.mutex.RUnlock()
+	return append([]string{}, pm.payers[payerID(payer)]...)
+}
+
+//Balance returns the total amount paid in all channels.
+func (pm *PayeeManager) Balance() uint64 {
+	pm.mutex.RLock()
+	defer pm.mutex.RUnlock()
+	var total uint64
+	for _, ch := range pm.channels {
+		ch.mutex.Lock()
+		total += ch.payee.amount
+		ch.mutex.Unlock()
+	}
+	return total
+}
+
+//Close marks channel id as closing, and returns the cooperative close tx or
+//the latest incremented tx to be broadcasted, or nil if nothing is paid.
+//The channel stays open if the tx cannot be made.
+func (pm *PayeeManager) Close(id string) (*Tx, error) {
+	ch, err := pm.channel(id)
+	if err != nil {
+		return nil, err
+	}
+	defer ch.mutex.Unlock()
+	tx := ch.payee.closed
+	if tx == nil && ch.payee.sign != nil {
+		if tx, err = ch.payee.LastIncrementedTx(); err != nil {
+			return nil, err
+		}
+	}
+	ch.closing = true
+	return tx, nil
+}
+
+//OpenChannels returns sorted IDs of channels which are not closing.
+func (pm *PayeeManager) OpenChannels() []string {
+	return pm.list(false)
+}
+
+//PendingClose returns sorted IDs of closing channels.
+func (pm *PayeeManager) PendingClose() []string {
+	return pm.list(true)
+}
+
+//list returns sorted IDs of channels whose closing is closing.
+func (pm *PayeeManager) list(closing bool) []string {
+	pm.mutex.RLock()
+	defer pm.mutex.RUnlock()
+	var ids []string
+	for id, ch := range pm.channels {
+		ch.mutex.Lock()
+		if ch.closing == closing {
+			ids = append(ids, id)
+		}
+		ch.mutex.Unlock()
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+//Remove removes closing channel id, e.g. after its tx is confirmed.
+func (pm *PayeeManager) Remove(id string) error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	ch, ok := pm.channels[id]
+	if !ok {
+		return ErrChannelNotFound
+	}
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if !ch.closing {
+		return errors.New("channel must be closed before removing")
+	}
+	delete(pm.channels, id)
+	p := payerID(ch.payee.Pubs[0])
+	ids := pm.payers[p]
+	for i, cid := range ids {
+		if cid == id {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(pm.payers, p)
+	} else {
+		pm.payers[p] = ids
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/bitgoin/address"
+)
+
+//testChannel opens a channel whose bond is made from coin of value.
+func testChannel(t *testing.T, payerKey, payeeKey *address.PrivateKey, value uint64, locktime uint32) (*MicroPayer, *MicroPayee) {
+	payer := NewMicroPayer(payerKey, payeeKey.PublicKey, Unit, 0.001*Unit)
+	payee := NewMicroPayee(payerKey.PublicKey, payeeKey, Unit, 0.001*Unit)
+	bond, refund, err := payer.CreateBond(locktime, testSegwitCoins(t, payerKey, value), payerKey.PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign, err := payee.SignRefund(refund, locktime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = payer.SignRefund(refund, sign); err != nil {
+		t.Fatal(err)
+	}
+	if err = payee.CheckBond(refund, bond); err != nil {
+		t.Fatal(err)
+	}
+	return payer, payee
+}
+
+func TestPayeeManager(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:3])
+	pm := NewPayeeManager()
+	payers := make([]*MicroPayer, 3)
+	ids := make([]string, 3)
+	for i := range payers {
+		//two channels from keys[0], one from keys[1].
+		var payee *MicroPayee
+		payers[i], payee = testChannel(t, keys[i/2], keys[2], uint64(2+i)*Unit, 100)
+		var err error
+		if ids[i], err = pm.Add(payee); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = pm.Add(payee); err == nil {
+			t.Error("must be error for duplicated channel")
+		}
+	}
+	if chs := pm.Channels(keys[0].PublicKey); len(chs) != 2 || chs[0] != ids[0] || chs[1] != ids[1] {
+		t.Error("illegal channels of payer", chs)
+	}
+
+	//pay concurrently, so that each payment is signed before sent.
+	var wg sync.WaitGroup
+	for i := range payers {
+		signs := make([][]byte, 10)
+		for j := range signs {
+			var err error
+			if signs[j], err = payers[i].SignIncremented(uint64(j+1) * 10000); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j, s := range signs {
+				if _, err := pm.IncrementedTx(ids[i], uint64(j+1)*10000, s); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if b := pm.Balance(); b != 3*100000 {
+		t.Error("illegal balance", b)
+	}
+	sign, err := payers[0].SignIncremented(100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pm.IncrementedTx(ids[0], 100000, sign); err == nil {
+		t.Error("must be error for same amount")
+	}
+
+	if err = pm.Remove(ids[1]); err == nil {
+		t.Error("must be error for removing open channel")
+	}
+	tx, err := pm.Close(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.TxOut[1].Value != 100000 {
+		t.Error("illegal tx at close")
+	}
+	if p := pm.PendingClose(); len(p) != 1 || p[0] != ids[1] {
+		t.Error("illegal pending close", p)
+	}
+	sign, err = payers[1].SignIncremented(110000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pm.IncrementedTx(ids[1], 110000, sign); err != ErrChannelClosed {
+		t.Error("must be error for closing channel", err)
+	}
+	if err = pm.Remove(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if chs := pm.Channels(keys[0].PublicKey); len(chs) != 1 || chs[0] != ids[0] {
+		t.Error("illegal channels of payer after remove", chs)
+	}
+	if b := pm.Balance(); b != 2*100000 {
+		t.Error("illegal balance after remove", b)
+	}
+}
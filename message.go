@@ -0,0 +1,387 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//ProtocolVersion is the version of messages in micropayment protocol.
+const ProtocolVersion = 1
+
+//MaxMessageSize is the max size of a message in bytes.
+const MaxMessageSize = 1 << 20
+
+//MsgType is the type of message in micropayment protocol.
+type MsgType byte
+
+//Message types.
+const (
+	MsgTypeOpen MsgType = iota + 1
+	MsgTypeRefundSignRequest
+	MsgTypeRefundSignResponse
+	MsgTypeBond
+	MsgTypePayment
+	MsgTypeClose
+	MsgTypeError
+	MsgTypeCloseSign
+)
+
+//ErrCode is the code of MsgError.
+type ErrCode uint16
+
+//Error codes.
+const (
+	ErrCodeUnknown ErrCode = iota
+	//ErrCodeVersion is for unsupported protocol version.
+	ErrCodeVersion
+	//ErrCodeSequence is for message with unexpected sequence number, e.g. replayed one.
+	ErrCodeSequence
+	//ErrCodeUnexpected is for message of unexpected type.
+	ErrCodeUnexpected
+	//ErrCodeMalformed is for message which cannot be decoded.
+	ErrCodeMalformed
+	//ErrCodeInvalid is for message whose content is invalid, e.g. illegal sign.
+	ErrCodeInvalid
+	//ErrCodeRejected is for channel which is rejected by payee.
+	ErrCodeRejected
+)
+
+//Message is a message in micropayment protocol.
+type Message interface {
+	Type() MsgType
+	encode(w io.Writer) error
+	decode(r io.Reader) error
+}
+
+//MsgOpen is sent by payer to open a channel.
+type MsgOpen struct {
+	PubKey   []byte
+	Amount   uint64
+	Fee      uint64
+	Locktime uint32
+	//Witness is true if the bond is P2WSH.
+	Witness bool
+}
+
+//MsgRefundSignRequest is sent by payer to request the sign of refund tx.
+type MsgRefundSignRequest struct {
+	Refund *Tx
+}
+
+//MsgRefundSignResponse is sent by payee with the sign of refund tx.
+type MsgRefundSignResponse struct {
+	Sign []byte
+}
+
+//MsgBond is sent by payer with bond tx.
+type MsgBond struct {
+	Bond *Tx
+}
+
+//MsgPayment is sent by payer with the sign of incremented tx which pays Amount.
+type MsgPayment struct {
+	Amount uint64
+	Sign   []byte
+}
+
+//MsgClose is sent by payer to close the channel. Amount is the latest paid amount,
+//and Sign is the sign of payer's key over the channel, Amount and the sequence number.
+type MsgClose struct {
+	Amount uint64
+	Sign   []byte
+}
+
+//MsgCloseSign is sent by both to negotiate cooperative close which pays Amount
+//to payee with Fee. The receiver accepts it by replying the same Amount and Fee
+//with its sign, or proposes another Fee.
+type MsgCloseSign struct {
+	Amount uint64
+	Fee    uint64
+	Sign   []byte
+}
+
+//MsgError is sent when an error occurs. It is also returned as error
+//by Conn.Receive if peer sends it.
+type MsgError struct {
+	Code   ErrCode
+	Reason string
+}
+
+//Type returns MsgTypeOpen.
+func (m *MsgOpen) Type() MsgType { return MsgTypeOpen }
+
+//Type returns MsgTypeRefundSignRequest.
+func (m *MsgRefundSignRequest) Type() MsgType { return MsgTypeRefundSignRequest }
+
+//Type returns MsgTypeRefundSignResponse.
+func (m *MsgRefundSignResponse) Type() MsgType { return MsgTypeRefundSignResponse }
+
+//Type returns MsgTypeBond.
+func (m *MsgBond) Type() MsgType { return MsgTypeBond }
+
+//Type returns MsgTypePayment.
+func (m *MsgPayment) Type() MsgType { return MsgTypePayment }
+
+//Type returns MsgTypeClose.
+func (m *MsgClose) Type() MsgType { return MsgTypeClose }
+
+//Type returns MsgTypeCloseSign.
+func (m *MsgCloseSign) Type() MsgType { return MsgTypeCloseSign }
+
+//Type returns MsgTypeError.
+func (m *MsgError) Type() MsgType { return MsgTypeError }
+
+//Error returns the reason with the code.
+func (m *MsgError) Error() string {
+	return fmt.Sprintf("peer error %d: %s", m.Code, m.Reason)
+}
+
+func writeTx(w io.Writer, t *Tx) error {
+	if t == nil {
+		return errors.New("tx is nil")
+	}
+	b, err := t.Pack()
+	if err != nil {
+		return err
+	}
+	return writeVarBytes(w, b)
+}
+
+func readTx(r io.Reader) (*Tx, error) {
+	b, err := readVarBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTX(b)
+}
+
+func (m *MsgOpen) encode(w io.Writer) error {
+	if err := writeVarBytes(w, m.PubKey); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, []uint64{m.Amount, m.Fee, uint64(m.Locktime)}); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, m.Witness)
+}
+
+func (m *MsgOpen) decode(r io.Reader) error {
+	var err error
+	if m.PubKey, err = readVarBytes(r); err != nil {
+		return err
+	}
+	v := make([]uint64, 3)
+	if err = binary.Read(r, binary.LittleEndian, v); err != nil {
+		return err
+	}
+	if v[2] > 0xffffffff {
+		return errors.New("illegal locktime")
+	}
+	m.Amount, m.Fee, m.Locktime = v[0], v[1], uint32(v[2])
+	return binary.Read(r, binary.LittleEndian, &m.Witness)
+}
+
+func (m *MsgRefundSignRequest) encode(w io.Writer) error {
+	return writeTx(w, m.Refund)
+}
+
+func (m *MsgRefundSignRequest) decode(r io.Reader) error {
+	var err error
+	m.Refund, err = readTx(r)
+	return err
+}
+
+func (m *MsgRefundSignResponse) encode(w io.Writer) error {
+	return writeVarBytes(w, m.Sign)
+}
+
+func (m *MsgRefundSignResponse) decode(r io.Reader) error {
+	var err error
+	m.Sign, err = readVarBytes(r)
+	return err
+}
+
+func (m *MsgBond) encode(w io.Writer) error {
+	return writeTx(w, m.Bond)
+}
+
+func (m *MsgBond) decode(r io.Reader) error {
+	var err error
+	m.Bond, err = readTx(r)
+	return err
+}
+
+func (m *MsgPayment) encode(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, m.Amount); err != nil {
+		return err
+	}
+	return writeVarBytes(w, m.Sign)
+}
+
+func (m *MsgPayment) decode(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &m.Amount); err != nil {
+		return err
+	}
+	var err error
+	m.Sign, err = readVarBytes(r)
+	return err
+}
+
+func (m *MsgClose) encode(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, m.Amount); err != nil {
+		return err
+	}
+	return writeVarBytes(w, m.Sign)
+}
+
+func (m *MsgClose) decode(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &m.Amount); err != nil {
+		return err
+	}
+	var err error
+	m.Sign, err = readVarBytes(r)
+	return err
+}
+
+func (m *MsgCloseSign) encode(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, []uint64{m.Amount, m.Fee}); err != nil {
+		return err
+	}
+	return writeVarBytes(w, m.Sign)
+}
+
+func (m *MsgCloseSign) decode(r io.Reader) error {
+	v := make([]uint64, 2)
+	if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+		return err
+	}
+	m.Amount, m.Fee = v[0], v[1]
+	var err error
+	m.Sign, err = readVarBytes(r)
+	return err
+}
+
+func (m *MsgError) encode(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, m.Code); err != nil {
+		return err
+	}
+	return writeVarBytes(w, []byte(m.Reason))
+}
+
+func (m *MsgError) decode(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &m.Code); err != nil {
+		return err
+	}
+	b, err := readVarBytes(r)
+	m.Reason = string(b)
+	return err
+}
+
+//newMessage returns an empty message of type t.
+func newMessage(t MsgType) (Message, error) {
+	switch t {
+	case MsgTypeOpen:
+		return &MsgOpen{}, nil
+	case MsgTypeRefundSignRequest:
+		return &MsgRefundSignRequest{}, nil
+	case MsgTypeRefundSignResponse:
+		return &MsgRefundSignResponse{}, nil
+	case MsgTypeBond:
+		return &MsgBond{}, nil
+	case MsgTypePayment:
+		return &MsgPayment{}, nil
+	case MsgTypeClose:
+		return &MsgClose{}, nil
+	case MsgTypeError:
+		return &MsgError{}, nil
+	case MsgTypeCloseSign:
+		return &MsgCloseSign{}, nil
+	}
+	return nil, fmt.Errorf("unknown message type %d", t)
+}
+
+//EncodeMessage returns m with the sequence number seq in the wire format,
+//which is length(4 bytes), version(1), type(1), seq(4) and payload.
+//Integers are in little endian.
+func EncodeMessage(m Message, seq uint32) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	buf.WriteByte(ProtocolVersion)
+	buf.WriteByte(byte(m.Type()))
+	if err := binary.Write(&buf, binary.LittleEndian, seq); err != nil {
+		return nil, err
+	}
+	if err := m.encode(&buf); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	if len(b)-4 > MaxMessageSize {
+		return nil, fmt.Errorf("size of message %d exceeds %d", len(b)-4, MaxMessageSize)
+	}
+	binary.LittleEndian.PutUint32(b, uint32(len(b)-4))
+	return b, nil
+}
+
+//DecodeMessage reads a message in the wire format from r and returns it
+//with its sequence number.
+//Returned error is MsgError if the message is malformed.
+func DecodeMessage(r io.Reader) (Message, uint32, error) {
+	var l uint32
+	if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+		return nil, 0, err
+	}
+	if l < 6 || l > MaxMessageSize {
+		return nil, 0, &MsgError{ErrCodeMalformed, fmt.Sprintf("illegal size of message %d", l)}
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, 0, err
+	}
+	if b[0] != ProtocolVersion {
+		return nil, 0, &MsgError{ErrCodeVersion, fmt.Sprintf("unsupported version %d", b[0])}
+	}
+	m, err := newMessage(MsgType(b[1]))
+	if err != nil {
+		return nil, 0, &MsgError{ErrCodeMalformed, err.Error()}
+	}
+	seq := binary.LittleEndian.Uint32(b[2:6])
+	pr := bytes.NewReader(b[6:])
+	if err := m.decode(pr); err != nil {
+		return nil, 0, &MsgError{ErrCodeMalformed, err.Error()}
+	}
+	if pr.Len() != 0 {
+		return nil, 0, &MsgError{ErrCodeMalformed, "extra bytes in message"}
+	}
+	return m, seq, nil
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMessages(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:1])
+	coins := testCoins(t, keys[0], Unit)
+	tx, err := NewP2PK(0.001*Unit, coins, 0, &Send{Addr: keys[0].PublicKey.Address()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := []Message{
+		&MsgOpen{PubKey: keys[0].PublicKey.Serialize(), Amount: Unit, Fee: 1000, Locktime: 500000, Witness: true},
+		&MsgRefundSignRequest{Refund: tx},
+		&MsgRefundSignResponse{Sign: []byte{1, 2, 3}},
+		&MsgBond{Bond: tx},
+		&MsgPayment{Amount: 12345, Sign: []byte{4, 5}},
+		&MsgClose{Amount: 12345, Sign: []byte{5}},
+		&MsgError{Code: ErrCodeInvalid, Reason: "illegal sign"},
+		&MsgCloseSign{Amount: 12345, Fee: 1000, Sign: []byte{6}},
+	}
+	for i, m := range msgs {
+		b, err := EncodeMessage(m, uint32(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m2, seq, err := DecodeMessage(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != uint32(i) || m2.Type() != m.Type() {
+			t.Error("illegal seq or type", i)
+		}
+		b2, err := EncodeMessage(m2, seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, b2) {
+			t.Error("messages must be same", i)
+		}
+	}
+	if !reflect.DeepEqual(msgs[0], &MsgOpen{PubKey: keys[0].PublicKey.Serialize(), Amount: Unit, Fee: 1000, Locktime: 500000, Witness: true}) {
+		t.Error("message must not be changed")
+	}
+
+	b, err := EncodeMessage(msgs[4], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ill := map[string]func([]byte) []byte{
+		"version": func(b []byte) []byte { b[4] = 2; return b },
+		"type":    func(b []byte) []byte { b[5] = 100; return b },
+		"size":    func(b []byte) []byte { b[3] = 0xff; return b },
+		"extra":   func(b []byte) []byte { b[0]++; return append(b, 0) },
+		"short":   func(b []byte) []byte { b[0]--; return b[:len(b)-1] },
+	}
+	for name, f := range ill {
+		bb := f(append([]byte{}, b...))
+		_, _, err := DecodeMessage(bytes.NewReader(bb))
+		if _, ok := err.(*MsgError); !ok {
+			t.Error("must be MsgError for illegal", name, err)
+		}
+	}
+}
+
+func TestConnReplay(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewConn(&buf)
+	if err := c.Send(&MsgClose{Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	replay := append([]byte{}, buf.Bytes()...)
+	if _, err := c.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(replay)
+	_, err := c.Receive()
+	if e, ok := err.(*MsgError); !ok || e.Code != ErrCodeSequence {
+		t.Error("must be error for replayed message", err)
+	}
+	if err = c.Send(&MsgError{Code: ErrCodeRejected, Reason: "no"}); err != nil {
+		t.Fatal(err)
+	}
+	c.rseq = 1
+	_, err = c.Receive()
+	if e, ok := err.(*MsgError); !ok || e.Code != ErrCodeRejected {
+		t.Error("must be error sent by peer", err)
+	}
+}
+
+func TestChannelProtocol(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	payer := NewMicroPayer(keys[0], keys[1].PublicKey, Unit, 0.001*Unit)
+	errc := make(chan error, 1)
+	go func() {
+		c := NewConn(p1)
+		_, err := payer.OpenChannel(c, 100, testSegwitCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address())
+		if err == nil {
+			err = payer.Pay(c, 0.01*Unit)
+		}
+		if err == nil {
+			err = payer.Pay(c, 0.02*Unit)
+		}
+		if err == nil {
+			err = payer.Close(c)
+		}
+		errc <- err
+	}()
+
+	c := NewConn(p2)
+	var open *MsgOpen
+	payee, err := AcceptChannel(c, keys[1], func(m *MsgOpen) error {
+		open = m
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open.Amount != Unit || open.Locktime != 100 {
+		t.Error("illegal open message")
+	}
+	var tx *Tx
+	for {
+		tx2, err := payee.ReceivePayment(c)
+		if err == ErrChannelClosed {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx = tx2
+	}
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.TxOut) != 2 || tx.TxOut[1].Value != 0.02*Unit {
+		t.Error("illegal incremented tx")
+	}
+	if !bytes.Equal(payer.Refund().TxIn[0].Hash, tx.TxIn[0].Hash) {
+		t.Error("refund and incremented tx must spend same bond")
+	}
+}
@@ -30,6 +30,8 @@ package tx
 
 import (
 	"errors"
+	"fmt"
+	"math"
 
 	"bytes"
 
@@ -39,6 +41,24 @@ import (
 type mpay struct {
 	*PubInfo
 	priv *address.PrivateKey
+	//refund is the refund tx, which is signed by both for payer.
+	refund *Tx
+	//signed is the refund signed by payee before its bond is checked.
+	signed *Tx
+	//amount is the latest incremented amount.
+	amount uint64
+	//sign is the sign of payer for the latest incremented tx, only for payee.
+	sign []byte
+	//store is where the state is persisted, only for payee.
+	store ChannelStore
+	//saved is the state in store.
+	saved []byte
+	//closed is the cooperative close tx.
+	closed *Tx
+	//aborted is true if the splice is aborted before any payment, only for payee.
+	aborted bool
+	//splice is the splice in progress.
+	splice *splice
 }
 
 //MicroPayer is struct for payer of micropayment.
@@ -106,47 +126,112 @@ func (m *PubInfo) sendstruct(amount uint64) ([]*Send, error) {
 	return sends, nil
 }
 
-//SignRefund sings refund tx.
+//SignRefund sings refund tx after checking it spends the first output of a bond and
+//returns the bond except fee to payer after locktime.
+//The bond must be checked by CheckBond after that.
 func (m *MicroPayee) SignRefund(refund *Tx, locktime uint32) ([]byte, error) {
-	if refund.Locktime != locktime {
-		return nil, errors.New("locktime in refund tx is illegal ")
+	if err := m.checkRefund(refund, locktime); err != nil {
+		return nil, err
+	}
+	h, err := m.PubInfo.sigHash(refund, 0)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := signHash(m.priv, h)
+	if err != nil {
+		return nil, err
+	}
+	m.signed = refund
+	return sign, nil
+}
+
+//checkRefund checks the shape of refund tx.
+func (m *MicroPayee) checkRefund(refund *Tx, locktime uint32) error {
+	if refund.Locktime != locktime || locktime == 0 {
+		return errors.New("locktime in refund tx is illegal ")
 	}
 	if len(refund.TxIn) != 1 {
-		return nil, errors.New("illegal txin number")
+		return errors.New("illegal txin number")
+	}
+	in := refund.TxIn[0]
+	if len(in.Hash) != 32 || in.Index != 0 {
+		return errors.New("illegal txin index")
 	}
-	if refund.TxIn[0].Index != 0 {
-		return nil, errors.New("illegal txin index")
+	if in.Seq == math.MaxUint32 {
+		return errors.New("sequence of refund tx disables locktime")
 	}
-	refund.TxIn[0].Script = m.PubInfo.redeemHash()
-	prev := &UTXO{
-		Key:    m.priv,
-		Script: m.PubInfo.redeemHash(),
+	if m.Fee >= m.Amount {
+		return fmt.Errorf("fee %d must be less than bond %d", m.Fee, m.Amount)
 	}
-	signs, err := signTx(refund, []*UTXO{prev})
+	sends, err := m.sendstruct(0)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	txouts, _, _, _, err := p2pkTxouts(m.Net, m.Fee, sends...)
+	if err != nil {
+		return err
+	}
+	if len(refund.TxOut) != len(txouts) {
+		return errors.New("illegal txout number")
+	}
+	for i, out := range txouts {
+		if refund.TxOut[i].Value != out.Value || !bytes.Equal(refund.TxOut[i].Script, out.Script) {
+			return errors.New("refund tx doesn't pay to payer")
+		}
 	}
-	return signs[0], nil
+	return nil
 }
 
-//CheckBond checks and sets bond tx.
+//CheckBond checks and sets bond tx, which must be spent by refund signed by SignRefund.
+//Bond must spend only segwit coins, otherwise the refund can be voided by malleating its txid.
+//Payee must reject bonds of known channels, e.g. by PayeeManager.
 func (m *MicroPayee) CheckBond(refund, bond *Tx) error {
-	if !bytes.Equal(bond.TxOut[0].Script, m.PubInfo.redeemHash()) {
+	if m.signed == nil || !sameSkeleton(m.signed, refund) {
+		return errors.New("refund is not signed")
+	}
+	if err := checkMalleability(bond); err != nil {
+		return fmt.Errorf("illegal bond: %s", err)
+	}
+	if len(bond.TxOut) == 0 || !bytes.Equal(bond.TxOut[0].Script, m.PubInfo.redeemHash()) {
 		return errors.New("illegal script in bond")
 	}
+	if bond.TxOut[0].Value != m.Amount {
+		return fmt.Errorf("amount of bond %d is not %d", bond.TxOut[0].Value, m.Amount)
+	}
 	if !bytes.Equal(refund.TxIn[0].Hash, bond.Hash()) {
 		return errors.New("illegal txin hash in refund")
 	}
 	m.PubInfo.bond = bond
+	m.PubInfo.prev = nil
+	m.refund = refund
+	m.signed = nil
 	return nil
 }
 
 //CreateBond returns bond and refund tx for sign.
+//coins must be P2WPKH, so that txid of bond cannot be malleated before it is confirmed.
+//The bond is not changed on error.
 func (m *MicroPayer) CreateBond(locktime uint32, coins UTXOs, ref string) (*Tx, *Tx, error) {
+	if err := checkWitnessCoins(coins); err != nil {
+		return nil, nil, fmt.Errorf("illegal bond: %s", err)
+	}
+	obond, oprev := m.bond, m.prev
+	bond, refund, err := m.createBond(locktime, coins, ref)
+	if err != nil {
+		m.bond, m.prev = obond, oprev
+		return nil, nil, err
+	}
+	return bond, refund, nil
+}
+
+func (m *MicroPayer) createBond(locktime uint32, coins UTXOs, ref string) (*Tx, *Tx, error) {
 	bond, err := m.BondTx(coins, ref, locktime)
 	if err != nil {
 		return nil, nil, err
 	}
+	if err = checkMalleability(bond); err != nil {
+		return nil, nil, fmt.Errorf("illegal bond: %s", err)
+	}
 	sends, err := m.sendstruct(0)
 	if err != nil {
 		return nil, nil, err
@@ -156,19 +241,35 @@ func (m *MicroPayer) CreateBond(locktime uint32, coins UTXOs, ref string) (*Tx,
 }
 
 //SignRefund signs refund..
+//sign of payee must be strict DER with low S.
 func (m *MicroPayer) SignRefund(refund *Tx, sign []byte) error {
-	signs := make([][]byte, 2)
-	prev := &UTXO{
-		Key:    m.priv,
-		Script: m.PubInfo.redeemHash(),
+	if err := checkSig(sign); err != nil {
+		return fmt.Errorf("illegal sign of payee: %s", err)
 	}
-	mysign, err := signTx(refund, []*UTXO{prev})
+	signs := make([][]byte, 2)
+	h, err := m.PubInfo.sigHash(refund, 0)
 	if err != nil {
 		return err
 	}
-	signs[0] = mysign[0]
+	if signs[0], err = signHash(m.priv, h); err != nil {
+		return err
+	}
 	signs[1] = sign
-	return m.PubInfo.embedSigns(refund, signs)
+	if err := m.PubInfo.embedSigns(refund, 0, signs); err != nil {
+		return err
+	}
+	m.refund = refund
+	return nil
+}
+
+//Refund returns the refund tx signed by SignRefund, or nil.
+//It is nil after the channel is closed cooperatively, because the refund
+//conflicts with the close tx.
+func (m *MicroPayer) Refund() *Tx {
+	if m.closed != nil {
+		return nil
+	}
+	return m.refund
 }
 
 //Filter returns redeem script and its hash, which payee should wait for..
@@ -179,15 +280,29 @@ func (m *MicroPayee) Filter() ([]byte, []byte) {
 
 //SignIncremented signs incremented tx..
 func (m *MicroPayer) SignIncremented(amount uint64) ([]byte, error) {
+	if m.closed != nil {
+		return nil, ErrChannelClosed
+	}
+	if m.splice != nil {
+		return nil, errSplicing
+	}
 	sends, err := m.sendstruct(amount)
 	if err != nil {
 		return nil, err
 	}
-	return m.SignMultisig(m.priv, 0, sends...)
+	sign, err := m.SignMultisig(m.priv, 0, sends...)
+	if err != nil {
+		return nil, err
+	}
+	m.amount = amount
+	return sign, nil
 }
 
 //IncrementedTx returns an incremented tx..
 func (m *MicroPayee) IncrementedTx(amount uint64, sign []byte) (*Tx, error) {
+	if (*mpay)(m).isClosed() {
+		return nil, ErrChannelClosed
+	}
 	sends, err := m.sendstruct(amount)
 	if err != nil {
 		return nil, err
@@ -196,5 +311,83 @@ func (m *MicroPayee) IncrementedTx(amount uint64, sign []byte) (*Tx, error) {
 	if err != nil {
 		return nil, err
 	}
-	return m.SpendBondTx(0, [][]byte{sign, mysign}, sends...)
+	tx, err := m.SpendBondTx(0, [][]byte{sign, mysign}, sends...)
+	if err != nil {
+		return nil, err
+	}
+	if m.sign != nil && amount <= m.amount {
+		//keep the best one.
+		return tx, nil
+	}
+	if m.splice != nil {
+		return nil, errSplicing
+	}
+	oamount, osign := m.amount, m.sign
+	m.amount = amount
+	m.sign = sign
+	if err := m.persist(); err != nil {
+		m.amount, m.sign = oamount, osign
+		return nil, err
+	}
+	return tx, nil
+}
+
+//persist saves the state to the store if exists.
+func (m *MicroPayee) persist() error {
+	if m.store == nil {
+		return nil
+	}
+	id, err := m.ChannelID()
+	if err != nil {
+		return err
+	}
+	state, err := m.Save()
+	if err != nil {
+		return err
+	}
+	if err := m.store.CompareAndSwap(id, m.saved, state); err != nil {
+		return err
+	}
+	m.saved = state
+	return nil
+}
+
+//SetStore saves the state to store, where IncrementedTx persists the best state
+//before returning. Bond must be checked by CheckBond, and the channel must not
+//be in store.
+func (m *MicroPayee) SetStore(store ChannelStore) error {
+	m.store = store
+	m.saved = nil
+	if err := m.persist(); err != nil {
+		m.store = nil
+		return err
+	}
+	return nil
+}
+
+//LoadMicroPayeeFrom loads MicroPayee of channel id from store, and
+//persists its state to store afterwards.
+func LoadMicroPayeeFrom(store ChannelStore, id string, payee *address.PrivateKey) (*MicroPayee, error) {
+	state, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	m, err := LoadMicroPayee(state, payee)
+	if err != nil {
+		return nil, err
+	}
+	if cid, err := m.ChannelID(); err != nil || cid != id {
+		return nil, fmt.Errorf("state is not for channel %s", id)
+	}
+	m.store = store
+	m.saved = state
+	return m, nil
+}
+
+//LastIncrementedTx returns the incremented tx with the latest sign of payer.
+func (m *MicroPayee) LastIncrementedTx() (*Tx, error) {
+	if m.sign == nil {
+		return nil, errors.New("no incremented tx")
+	}
+	return m.IncrementedTx(m.amount, m.sign)
 }
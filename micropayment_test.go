@@ -29,6 +29,7 @@
 package tx
 
 import (
+	"bytes"
 	"encoding/hex"
 	"log"
 	"testing"
@@ -58,10 +59,9 @@ func TestMicro(t *testing.T) {
 		"12c2f61d839b2b38146715e4dfc0fd988806253920480298816f108513e53e5c",
 	}
 	values := []uint64{100 * Unit, 150 * Unit}
-	script, err := hex.DecodeString("76a914d94987ba89c258372030bc9d610f89547757896488ac")
-	if err != nil {
-		t.Fatal(err)
-	}
+	//bond must spend P2WPKH coins, whose keys are compressed.
+	coinKey := testKeys(t, multisigWIFs[:1])[0]
+	script := witnessScript(0, coinKey.PublicKey.AddressBytes())
 
 	utxos := make(UTXOs, len(txhashes))
 	for i, h := range txhashes {
@@ -72,7 +72,7 @@ func TestMicro(t *testing.T) {
 		}
 		ha = Reverse(ha)
 		utxos[i] = &UTXO{
-			Key:     txKey,
+			Key:     coinKey,
 			TxHash:  ha,
 			Value:   values[i],
 			Script:  script,
@@ -125,3 +125,149 @@ func TestMicro(t *testing.T) {
 	log.Print("refund ", hex.EncodeToString(bref))
 	log.Print("incremented tx ", hex.EncodeToString(btx))
 }
+
+func TestSegwitBond(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	payer := NewMicroPayer(keys[0], keys[1].PublicKey, Unit, 0.001*Unit)
+	payee := NewMicroPayee(keys[0].PublicKey, keys[1], Unit, 0.001*Unit)
+	if _, _, err := payer.CreateBond(100, testCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address()); err == nil {
+		t.Error("must be error for legacy coins")
+	}
+	if _, err := payer.Outpoint(); err == nil {
+		t.Error("rejected bond must not be set")
+	}
+	bond, refund, err := payer.CreateBond(100, testSegwitCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := bond.TxIn[0]
+	if len(in.Script) != 0 || len(in.Witness) != 2 || !bytes.Equal(in.Witness[1], keys[0].PublicKey.Serialize()) {
+		t.Fatal("illegal witness of bond")
+	}
+	h, err := bond.witnessSigHash(0, p2pkhScript(keys[0].PublicKey.AddressBytes()), 2*Unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := in.Witness[0]
+	if err = keys[0].PublicKey.Verify(sig[:len(sig)-1], h); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = payee.SignRefund(refund, 100); err != nil {
+		t.Fatal(err)
+	}
+	//third party malleates the bond by moving the sign to scriptSig.
+	malleated := *bond
+	malleated.TxIn = []*TxIn{{Hash: in.Hash, Index: in.Index, Script: pushData(nil, sig), Seq: in.Seq}}
+	if err = payee.CheckBond(refund, &malleated); err == nil {
+		t.Error("must be error for malleable bond")
+	}
+	if err = payee.CheckBond(refund, bond); err != nil {
+		t.Error(err)
+	}
+
+	//uncompressed keys are not standard in P2WPKH.
+	key, err := address.FromWIF("928Qr9J5oAC6AYieWJ3fG3dZDjuC7BFVUqgu4GsvRVpoXiTaJJf", address.BitcoinTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = P2WPKHScript(key.PublicKey); err == nil {
+		t.Error("must be error for uncompressed key")
+	}
+	coins := testCoins(t, key, 2*Unit)
+	coins[0].Script = witnessScript(0, key.PublicKey.AddressBytes())
+	if _, _, err = NewMicroPayer(key, keys[1].PublicKey, Unit, 0.001*Unit).CreateBond(100, coins, key.PublicKey.Address()); err == nil {
+		t.Error("must be error for uncompressed key")
+	}
+}
+
+func TestRefundShape(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	payer := NewMicroPayer(keys[0], keys[1].PublicKey, Unit, 0.001*Unit)
+	bond, refund, err := payer.CreateBond(100, testSegwitCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := &MsgOpen{
+		PubKey:   keys[0].PublicKey.Serialize(),
+		Amount:   Unit,
+		Fee:      0.001 * Unit,
+		Locktime: 100,
+	}
+	payee, _, err := acceptOpen(keys[1], RegTest, open, refund, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payee.Net != RegTest {
+		t.Error("network of payee must be set", payee.Net)
+	}
+	ills := []func(r *Tx){
+		func(r *Tx) { r.TxIn[0].Index = 1 },
+		func(r *Tx) { r.TxIn[0].Seq = 0xffffffff },
+		func(r *Tx) { r.TxIn = append(r.TxIn, r.TxIn[0]) },
+		func(r *Tx) { r.TxOut[0].Value-- },
+		func(r *Tx) { r.TxOut[0].Script = p2pkhScript(keys[1].PublicKey.AddressBytes()) },
+		func(r *Tx) { r.TxOut = append(r.TxOut, &TxOut{Value: 1000, Script: r.TxOut[0].Script}) },
+	}
+	for i, ill := range ills {
+		r := *refund
+		in := *refund.TxIn[0]
+		out := *refund.TxOut[0]
+		r.TxIn = []*TxIn{&in}
+		r.TxOut = []*TxOut{&out}
+		ill(&r)
+		if _, err = payee.SignRefund(&r, 100); err == nil {
+			t.Error("must be error for illegal refund", i)
+		}
+	}
+	if _, _, err = acceptOpen(keys[1], RegTest, &MsgOpen{PubKey: open.PubKey, Amount: Unit, Fee: Unit, Locktime: 100}, refund, nil); err == nil {
+		t.Error("must be error for fee exceeding bond")
+	}
+
+	//refund is bound to the bond.
+	other, oref, err := payer.CreateBond(100, testSegwitCoins(t, keys[0], 3*Unit), keys[0].PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = payee.CheckBond(oref, other); err == nil {
+		t.Error("must be error for refund which is not signed")
+	}
+	if err = payee.CheckBond(refund, other); err == nil {
+		t.Error("must be error for bond which the refund doesn't spend")
+	}
+	if err = payee.CheckBond(refund, bond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefundSigHash(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	payer := NewMicroPayer(keys[0], keys[1].PublicKey, Unit, 0.001*Unit)
+	payee := NewMicroPayee(keys[0].PublicKey, keys[1], Unit, 0.001*Unit)
+	if err := payer.SetOutpoint(hash([]byte("bond")), 0, Unit); err != nil {
+		t.Fatal(err)
+	}
+	sends, err := payer.sendstruct(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refund, err := payer.txForSign(100, sends...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign, err := payee.SignRefund(refund, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//txin spending P2SH output is signed over the redeem script, not over the P2SH script.
+	h, err := refund.sigHash(0, payee.redeemScript())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = keys[1].PublicKey.Verify(sign, h); err != nil {
+		t.Error("refund must be signed over the redeem script", err)
+	}
+	if err = payer.SignRefund(refund, sign); err != nil {
+		t.Fatal(err)
+	}
+}
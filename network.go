@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/bitgoin/address"
+)
+
+//Network is parameters of a bitcoin network.
+type Network struct {
+	Name string
+	//Params is the params to be used in address package, e.g. for address.FromWIF.
+	Params *address.Params
+	//PubKeyHashID is the version byte of P2PKH addresses.
+	PubKeyHashID byte
+	//ScriptHashID is the version byte of P2SH addresses.
+	ScriptHashID byte
+	//HRP is the human readable part of bech32 addresses.
+	HRP string
+	//DustRelayFee is the fee rate (satoshi/kB) to calculate dust threshold.
+	DustRelayFee uint64
+	//Seq is the sequence of txins in txs whose locktime is 0.
+	Seq uint32
+	//LockSeq is the sequence of txins in txs whose locktime is not 0.
+	LockSeq uint32
+}
+
+//Networks.
+var (
+	MainNet = &Network{
+		Name:         "main",
+		Params:       address.BitcoinMain,
+		PubKeyHashID: 0x00,
+		ScriptHashID: 0x05,
+		HRP:          "bc",
+		DustRelayFee: 3000,
+		Seq:          math.MaxUint32,
+		LockSeq:      math.MaxUint32 - 1,
+	}
+	TestNet3 = &Network{
+		Name:         "test",
+		Params:       address.BitcoinTest,
+		PubKeyHashID: 0x6f,
+		ScriptHashID: 0xc4,
+		HRP:          "tb",
+		DustRelayFee: 3000,
+		Seq:          math.MaxUint32,
+		LockSeq:      math.MaxUint32 - 1,
+	}
+	SigNet = &Network{
+		Name:         "signet",
+		Params:       address.BitcoinTest,
+		PubKeyHashID: 0x6f,
+		ScriptHashID: 0xc4,
+		HRP:          "tb",
+		DustRelayFee: 3000,
+		Seq:          math.MaxUint32,
+		LockSeq:      math.MaxUint32 - 1,
+	}
+	RegTest = &Network{
+		Name:         "regtest",
+		Params:       address.BitcoinTest,
+		PubKeyHashID: 0x6f,
+		ScriptHashID: 0xc4,
+		HRP:          "bcrt",
+		DustRelayFee: 3000,
+		Seq:          math.MaxUint32,
+		LockSeq:      math.MaxUint32 - 1,
+	}
+)
+
+//DefaultNet is the network whose address format is used in JSON.
+var DefaultNet = MainNet
+
+//CheckAddress returns an error if addr doesn't belong to the network.
+func (n *Network) CheckAddress(addr string) error {
+	_, err := addressScript(n, addr)
+	return err
+}
+
+//AddressScript returns scriptPubKey which pays to addr, which must be
+//base58 P2PKH, P2SH or bech32(m) segwit address of the network.
+func (n *Network) AddressScript(addr string) ([]byte, error) {
+	return addressScript(n, addr)
+}
+
+//addressScript returns scriptPubKey which pays to addr.
+//If net is nil, addr can be any network's address, and base58 addresses are
+//regarded as P2PKH if the version is not P2SH one of known networks.
+func addressScript(net *Network, addr string) ([]byte, error) {
+	if hrp, version, program, err := decodeSegwitAddress(addr); err == nil {
+		if net != nil && hrp != net.HRP {
+			return nil, fmt.Errorf("address %s is not for %s network", addr, net.Name)
+		}
+		return witnessScript(version, program), nil
+	}
+	version, payload, err := base58CheckDecode(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %s", addr, err)
+	}
+	if len(payload) != 20 {
+		return nil, fmt.Errorf("invalid length of address %s", addr)
+	}
+	switch {
+	case net == nil && (version == MainNet.ScriptHashID || version == TestNet3.ScriptHashID):
+		return p2shScript(payload), nil
+	case net == nil:
+		return p2pkhScript(payload), nil
+	case version == net.ScriptHashID:
+		return p2shScript(payload), nil
+	case version == net.PubKeyHashID:
+		return p2pkhScript(payload), nil
+	}
+	return nil, fmt.Errorf("address %s is not for %s network", addr, net.Name)
+}
+
+//CheckKey returns an error if pub doesn't belong to the network.
+func (n *Network) CheckKey(pub *address.PublicKey) error {
+	version, _, err := base58CheckDecode(pub.Address())
+	if err != nil {
+		return err
+	}
+	if version != n.PubKeyHashID {
+		return fmt.Errorf("key for %s is not for %s network", pub.Address(), n.Name)
+	}
+	return nil
+}
+
+//DustThreshold returns the minimum value of out which is not dust.
+func (n *Network) DustThreshold(out *TxOut) uint64 {
+	if isUnspendable(out.Script) {
+		return 0
+	}
+	size := 8 + varIntSize(uint64(len(out.Script))) + len(out.Script)
+	if _, _, ok := witnessProgram(out.Script); ok {
+		//outpoint, script length, witness discounted by 4 and sequence.
+		size += 32 + 4 + 1 + 107/4 + 4
+	} else {
+		//outpoint, script length, scriptSig and sequence.
+		size += 32 + 4 + 1 + 107 + 4
+	}
+	return n.DustRelayFee * uint64(size) / 1000
+}
+
+//IsDust returns true if out is dust in the network.
+func (n *Network) IsDust(out *TxOut) bool {
+	return out.Value < n.DustThreshold(out)
+}
+
+//ScriptAddress returns the address of scriptPubKey in the network,
+//or "" if script has no address.
+func (n *Network) ScriptAddress(script []byte) string {
+	switch ScriptType(script) {
+	case ScriptPubKeyHash:
+		return base58CheckEncode(n.PubKeyHashID, script[3:23])
+	case ScriptScriptHash:
+		return base58CheckEncode(n.ScriptHashID, script[2:22])
+	case ScriptWitnessV0KeyHash, ScriptWitnessV0ScriptHash,
+		ScriptWitnessV1Taproot, ScriptWitnessUnknown:
+		v, prog, _ := witnessProgram(script)
+		adr, err := segwitAddress(n.HRP, v, prog)
+		if err != nil {
+			return ""
+		}
+		return adr
+	}
+	return ""
+}
+
+//Below are nil-safe helpers for builders. nil network means no checks
+//and the legacy sequence policy.
+
+func (n *Network) checkKey(pub *address.PublicKey) error {
+	if n == nil || pub == nil {
+		return nil
+	}
+	return n.CheckKey(pub)
+}
+
+func (n *Network) checkDust(out *TxOut) error {
+	if n == nil || !n.IsDust(out) {
+		return nil
+	}
+	return fmt.Errorf("amount %d is dust in %s network", out.Value, n.Name)
+}
+
+func (n *Network) sequence(locktime uint32) uint32 {
+	switch {
+	case n == nil && locktime == 0:
+		return math.MaxUint32
+	case n == nil:
+		return 0
+	case locktime == 0:
+		return n.Seq
+	}
+	return n.LockSeq
+}
+
+func varIntSize(n uint64) int {
+	switch {
+	case n < 0xfd:
+		return 1
+	case n <= 0xffff:
+		return 3
+	case n <= 0xffffffff:
+		return 5
+	}
+	return 9
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/bitgoin/address"
+)
+
+func TestNetworkAddress(t *testing.T) {
+	addrs := []struct {
+		addr string
+		nets []*Network
+	}{
+		{"1Cu32FVupVCgHkMMRJdYJugxwo2Aprgk7H", []*Network{MainNet}},
+		{"3CK4fEwbMP7heJarmU4eqA3sMbVJyEnU3V", []*Network{MainNet}},
+		{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", []*Network{MainNet}},
+		{"n2eMqTT929pb1RDNuqEnxdaLau1rxy3efi", []*Network{TestNet3, SigNet, RegTest}},
+		{"2N3sGiyscxqd3r6DQSbgXT738ZwhUpBqkej", []*Network{TestNet3, SigNet, RegTest}},
+		{"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", []*Network{TestNet3, SigNet}},
+		{"bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080", []*Network{RegTest}},
+		{"MTi4x2NtDpdyXSwEvwU3aZ1Uronz1JBNC3", nil},
+		{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t5", nil},
+	}
+	for _, a := range addrs {
+		for _, net := range []*Network{MainNet, TestNet3, SigNet, RegTest} {
+			ok := false
+			for _, n := range a.nets {
+				ok = ok || n == net
+			}
+			if err := net.CheckAddress(a.addr); (err == nil) != ok {
+				t.Error(a.addr, net.Name, err)
+			}
+		}
+	}
+}
+
+func TestNetworkKey(t *testing.T) {
+	key, err := address.FromWIF("928Qr9J5oAC6AYieWJ3fG3dZDjuC7BFVUqgu4GsvRVpoXiTaJJf", address.BitcoinTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = TestNet3.CheckKey(key.PublicKey); err != nil {
+		t.Error(err)
+	}
+	if err = MainNet.CheckKey(key.PublicKey); err == nil {
+		t.Error("must be error for testnet key in mainnet")
+	}
+	script, err := DefaultP2PKScript(key.PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	coins := UTXOs{
+		&UTXO{
+			Key:     key,
+			TxHash:  make([]byte, 32),
+			TxIndex: 1,
+			Script:  script,
+			Value:   Unit,
+		}}
+	to := func(addr string, amount uint64) []*Send {
+		return []*Send{
+			&Send{
+				Addr:   addr,
+				Amount: amount,
+			},
+			&Send{
+				Addr:   key.PublicKey.Address(),
+				Amount: 0,
+			},
+		}
+	}
+	if _, err = NewP2PKNet(TestNet3, 0.0001*Unit, coins, 0,
+		to("1Cu32FVupVCgHkMMRJdYJugxwo2Aprgk7H", 0.1*Unit)...); err == nil {
+		t.Error("must be error for mainnet address")
+	}
+	if _, err = NewP2PKNet(MainNet, 0.0001*Unit, coins, 0,
+		to("1Cu32FVupVCgHkMMRJdYJugxwo2Aprgk7H", 0.1*Unit)...); err == nil {
+		t.Error("must be error for testnet key")
+	}
+	if _, err = NewP2PKNet(TestNet3, 0.0001*Unit, coins, 0,
+		to("n2eMqTT929pb1RDNuqEnxdaLau1rxy3efi", 545)...); err == nil {
+		t.Error("must be error for dust")
+	}
+	if _, err = NewP2PKNet(TestNet3, 0.0001*Unit, coins, 1000,
+		to("n2eMqTT929pb1RDNuqEnxdaLau1rxy3efi", Unit-0.0001*Unit-500)...); err == nil {
+		t.Error("must be error for dust change")
+	}
+	tx, err := NewP2PKNet(TestNet3, 0.0001*Unit+500, coins, 1000,
+		to("n2eMqTT929pb1RDNuqEnxdaLau1rxy3efi", Unit-0.0001*Unit-500)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.TxOut) != 1 {
+		t.Error("illegal txouts", len(tx.TxOut))
+	}
+	if tx.TxIn[0].Seq != TestNet3.LockSeq {
+		t.Error("illegal sequence", tx.TxIn[0].Seq)
+	}
+}
+
+func TestDustThreshold(t *testing.T) {
+	scripts := map[string]uint64{
+		"76a914e7c1345fc8f87c68170b3aa798a956c2fe6a9eff88ac": 546,
+		"0014751e76e8199196d454941c45d1b3a323f1433bd6":       294,
+		"6a0b68656c6c6f20776f726c64":                         0,
+	}
+	for s, v := range scripts {
+		script, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := MainNet.DustThreshold(&TxOut{Script: script}); d != v {
+			t.Error("illegal dust threshold", s, d)
+		}
+	}
+}
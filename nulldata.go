@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"errors"
+	"fmt"
+)
+
+//MaxNullDataSize is the default max size of null data (OP_RETURN) scriptPubKey
+//which nodes relay, i.e. 80 bytes data with OP_RETURN and PUSHDATA1.
+const MaxNullDataSize = 83
+
+//NullData is info of null data (OP_RETURN) output.
+type NullData struct {
+	//Prefix is pushed first if not empty, e.g. protocol tag.
+	Prefix []byte
+	//Data are pushed after Prefix in order.
+	Data [][]byte
+	//Value is the amount of the output, which will be unspendable.
+	Value uint64
+	//MaxSize is max size of the script. MaxNullDataSize is used if 0,
+	//and no limit if negative.
+	MaxSize int
+}
+
+//Script returns null data scriptPubKey with minimal pushes.
+func (n *NullData) Script() ([]byte, error) {
+	script := []byte{opRETURN}
+	if len(n.Prefix) > 0 {
+		script = pushData(script, n.Prefix)
+	}
+	for _, d := range n.Data {
+		script = pushData(script, d)
+	}
+	max := n.MaxSize
+	if max == 0 {
+		max = MaxNullDataSize
+	}
+	if max > 0 && len(script) > max {
+		return nil, fmt.Errorf("size of null data script %d exceeds the limit %d", len(script), max)
+	}
+	return script, nil
+}
+
+//TxOut returns null data txout.
+func (n *NullData) TxOut() (*TxOut, error) {
+	script, err := n.Script()
+	if err != nil {
+		return nil, err
+	}
+	return &TxOut{
+		Value:  n.Value,
+		Script: script,
+	}, nil
+}
+
+//Send returns Send of null data, which can be passed to NewP2PK.
+func (n *NullData) Send() (*Send, error) {
+	script, err := n.Script()
+	if err != nil {
+		return nil, err
+	}
+	return &Send{
+		Script: script,
+		Amount: n.Value,
+	}, nil
+}
+
+//ParseNullData returns data pushed in null data scriptPubKey.
+func ParseNullData(script []byte) ([][]byte, error) {
+	if len(script) == 0 || script[0] != opRETURN {
+		return nil, errors.New("script is not null data")
+	}
+	ops, err := parseScript(script[1:])
+	if err != nil {
+		return nil, err
+	}
+	data := make([][]byte, 0, len(ops))
+	for _, o := range ops {
+		if !o.isPush() {
+			return nil, errors.New("null data must have only pushes")
+		}
+		data = append(data, o.pushedData())
+	}
+	return data, nil
+}
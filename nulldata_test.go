@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestNullData(t *testing.T) {
+	n := &NullData{
+		Data: [][]byte{bytes.Repeat([]byte{0xaa}, 80)},
+	}
+	script, err := n.Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(script) != MaxNullDataSize || !bytes.Equal(script[:3], []byte{opRETURN, opPUSHDATA1, 80}) {
+		t.Error("illegal script", hex.EncodeToString(script))
+	}
+	if ScriptType(script) != ScriptNullData {
+		t.Error("illegal script type", ScriptType(script))
+	}
+
+	n.Data[0] = append(n.Data[0], 0xaa)
+	if _, err = n.Script(); err == nil {
+		t.Error("must be error for exceeding the limit")
+	}
+	n.MaxSize = 84
+	if _, err = n.Script(); err != nil {
+		t.Error(err)
+	}
+
+	n.MaxSize = -1
+	n.Data[0] = bytes.Repeat([]byte{0xaa}, 300)
+	script, err = n.Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(script[:4], []byte{opRETURN, opPUSHDATA2, 0x2c, 0x01}) {
+		t.Error("illegal script", hex.EncodeToString(script[:4]))
+	}
+
+	n = &NullData{
+		Prefix: []byte("DOCPROOF"),
+		Data: [][]byte{
+			bytes.Repeat([]byte{0x11}, 32),
+			{0x05},
+			{},
+		},
+		Value: 1000,
+	}
+	send, err := n.Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if send.Amount != 1000 {
+		t.Error("illegal amount", send.Amount)
+	}
+	if hex.EncodeToString(send.Script) != "6a08444f4350524f4f4620"+
+		"1111111111111111111111111111111111111111111111111111111111111111"+"5500" {
+		t.Error("illegal script", hex.EncodeToString(send.Script))
+	}
+	data, err := ParseNullData(send.Script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4 || !bytes.Equal(data[0], n.Prefix) ||
+		!bytes.Equal(data[1], n.Data[0]) || !bytes.Equal(data[2], n.Data[1]) || len(data[3]) != 0 {
+		t.Error("illegal parsed data", data)
+	}
+	if _, err = ParseNullData([]byte{opRETURN, opDUP}); err == nil {
+		t.Error("must be error for non-push op")
+	}
+	if _, err = ParseNullData([]byte{opRETURN, opPUSHDATA1, 3, 0}); err == nil {
+		t.Error("must be error for short script")
+	}
+}
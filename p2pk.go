@@ -30,15 +30,13 @@ package tx
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"sort"
 
-	"math"
-
 	"github.com/bitgoin/address"
-	"github.com/bitgoin/packer"
+	"github.com/bitgoin/address/btcec"
 )
 
 //UTXO represents an available transaction.
@@ -58,9 +56,16 @@ func (c UTXOs) Less(i, j int) bool { return c[i].Value < c[j].Value }
 func (c UTXOs) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
 
 //Send is information about addrress and amount to send.
+//Addr can be base58 P2PKH, P2SH or bech32(m) segwit address.
 type Send struct {
 	Addr   string
 	Amount uint64
+	//Script is scriptPubKey to be paid instead of Addr if not nil.
+	//Output with Script is created even if Amount is 0.
+	Script []byte
+	//Change marks the send which receives the change.
+	//Its Amount must be 0, and the change output keeps its position in sends.
+	Change bool
 }
 
 //DefaultP2PKScript returns default p2pk script.
@@ -69,14 +74,33 @@ func DefaultP2PKScript(btcadr string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	script := make([]byte, 0, len(addr)+5)
-	script = append(script, opDUP, opHASH160, byte(len(addr)))
-	script = append(script, addr...)
-	return append(script, opEQUALVERIFY, opCHECKSIG), nil
+	return p2pkhScript(addr), nil
+}
+
+//P2WPKHScript returns P2WPKH script of pub, which must be compressed.
+func P2WPKHScript(pub *address.PublicKey) ([]byte, error) {
+	ser := pub.Serialize()
+	if len(ser) != btcec.PubKeyBytesLenCompressed {
+		return nil, errors.New("key of P2WPKH must be compressed")
+	}
+	return witnessScript(0, address.AddressBytes(ser)), nil
+}
+
+//AddressScript returns scriptPubKey which pays to btcadr, which can be
+//base58 P2PKH, P2SH or bech32(m) segwit address.
+//Use Network.AddressScript to reject addresses of other networks.
+func AddressScript(btcadr string) ([]byte, error) {
+	return addressScript(nil, btcadr)
 }
 
-func p2pkTtxout(send *Send) (*TxOut, error) {
-	script, err := DefaultP2PKScript(send.Addr)
+func p2pkTtxout(net *Network, send *Send) (*TxOut, error) {
+	if send.Script != nil {
+		return &TxOut{
+			Value:  send.Amount,
+			Script: send.Script,
+		}, nil
+	}
+	script, err := addressScript(net, send.Addr)
 	if err != nil {
 		return nil, err
 	}
@@ -86,109 +110,310 @@ func p2pkTtxout(send *Send) (*TxOut, error) {
 	}, nil
 }
 
-func p2pkTxouts(fee uint64, sends ...*Send) ([]*TxOut, uint64, error) {
+//changeIndex returns the index of change in sends.
+//If no send is marked as Change, the last one is regarded as change if its amount is 0
+//and it has no Script, or returns -1.
+func changeIndex(sends []*Send) (int, error) {
+	if len(sends) == 0 {
+		return 0, errors.New("sends are empty")
+	}
+	ci := -1
+	for i, send := range sends {
+		if !send.Change {
+			continue
+		}
+		if ci >= 0 {
+			return 0, errors.New("only one send can be change")
+		}
+		if send.Amount != 0 {
+			return 0, errors.New("amount of change must be 0")
+		}
+		if send.Script != nil && isUnspendable(send.Script) {
+			return 0, errors.New("change must not be paid to unspendable script")
+		}
+		ci = i
+	}
+	if last := sends[len(sends)-1]; ci < 0 && last.Amount == 0 && last.Script == nil {
+		ci = len(sends) - 1
+	}
+	return ci, nil
+}
+
+//p2pkTxouts returns txouts of sends except change, and total amount of them with fee.
+//It also returns the change and its index in txouts.
+func p2pkTxouts(net *Network, fee uint64, sends ...*Send) ([]*TxOut, uint64, *Send, int, error) {
+	ci, err := changeIndex(sends)
+	if err != nil {
+		return nil, 0, nil, 0, err
+	}
 	total := fee
 	txouts := make([]*TxOut, 0, len(sends))
-	for _, send := range sends {
-		if send.Amount == 0 {
+	var change *Send
+	pos := 0
+	for i, send := range sends {
+		if i == ci {
+			change = send
+			pos = len(txouts)
+			continue
+		}
+		if send.Amount == 0 && send.Script == nil {
 			continue
 		}
 		total += send.Amount
-		txout, err := p2pkTtxout(send)
+		txout, err := p2pkTtxout(net, send)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, nil, 0, err
+		}
+		if err := net.checkDust(txout); err != nil {
+			return nil, 0, nil, 0, err
 		}
 		txouts = append(txouts, txout)
 	}
-	return txouts, total, nil
+	return txouts, total, change, pos, nil
 }
 
-func newTxins(total uint64, coins UTXOs, refundAddress string, locktime uint32) ([]*TxIn, []*UTXO, *TxOut, error) {
-	var seq uint32 = math.MaxUint32
-	if locktime != 0 {
-		seq = 0
+//insertTxout inserts out at i in txouts if out is not nil.
+func insertTxout(txouts []*TxOut, i int, out *TxOut) []*TxOut {
+	if out == nil {
+		return txouts
 	}
-	var txins []*TxIn
+	txouts = append(txouts, nil)
+	copy(txouts[i+1:], txouts[i:])
+	txouts[i] = out
+	return txouts
+}
+
+func newTxins(net *Network, total uint64, coins UTXOs, change *Send, locktime uint32) ([]*TxIn, []*UTXO, *TxOut, error) {
 	var amount uint64
 	sort.Sort(coins)
 	var used []*UTXO
 	for i := 0; i < len(coins) && amount < total; i++ {
-		c := coins[i]
+		used = append(used, coins[i])
+		amount += coins[i].Value
+	}
+	if amount < total {
+		return nil, nil, nil, fmt.Errorf("shortage of coin %d < %d %d",
+			amount, total, len(coins))
+	}
+	txins, err := coinTxins(net, used, locktime)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	mto, err := changeTxout(net, change, amount-total)
+	return txins, used, mto, err
+}
+
+//coinTxins returns unsigned txins which spend all coins in order.
+func coinTxins(net *Network, coins []*UTXO, locktime uint32) ([]*TxIn, error) {
+	seq := net.sequence(locktime)
+	txins := make([]*TxIn, 0, len(coins))
+	for _, c := range coins {
+		if c.Key != nil {
+			if err := net.checkKey(c.Key.PublicKey); err != nil {
+				return nil, err
+			}
+		}
 		txins = append(txins, &TxIn{
 			Hash:   c.TxHash,
 			Index:  c.TxIndex,
 			Script: []byte{}, //pubscript to sign.
 			Seq:    seq,
 		})
-		used = append(used, c)
-		amount += c.Value
 	}
-	if amount < total {
-		return nil, nil, nil, fmt.Errorf("shortage of coin %d < %d %d",
-			amount, total, len(coins))
+	return txins, nil
+}
+
+//changeTxout returns txout which pays remain to change, or nil if remain is 0.
+//It returns an error if the change is dust in net.
+func changeTxout(net *Network, change *Send, remain uint64) (*TxOut, error) {
+	if remain == 0 {
+		return nil, nil
 	}
-	remain := amount - total
-	var mto *TxOut
-	var err error
-	if remain > 0 {
-		if refundAddress == "" {
-			return nil, nil, nil, errors.New("refund address is empty")
-		}
-		s := Send{
-			Addr:   refundAddress,
-			Amount: remain,
+	if change == nil || (change.Addr == "" && change.Script == nil) {
+		return nil, errors.New("refund address is empty")
+	}
+	s := Send{
+		Addr:   change.Addr,
+		Script: change.Script,
+		Amount: remain,
+	}
+	mto, err := p2pkTtxout(net, &s)
+	if err != nil {
+		return nil, err
+	}
+	if net != nil && net.IsDust(mto) {
+		return nil, fmt.Errorf("change %d is dust in %s network, add it to fee", remain, net.Name)
+	}
+	return mto, nil
+}
+
+//sigHash returns hash of the tx with SIGHASH_ALL for signing i-th txin,
+//whose previous script is prev.
+func (t *Tx) sigHash(i int, prev []byte) ([]byte, error) {
+	if i >= len(t.TxIn) {
+		return nil, fmt.Errorf("no txin at %d", i)
+	}
+	scripts := make([][]byte, len(t.TxIn))
+	for j, in := range t.TxIn {
+		scripts[j] = in.Script
+		in.Script = []byte{}
+	}
+	t.TxIn[i].Script = prev
+	var buf bytes.Buffer
+	err := t.serialize(&buf, false)
+	for j, in := range t.TxIn {
+		in.Script = scripts[j]
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf.Write([]byte{sigHashAll, 0, 0, 0}) //hash code type
+	return hash(buf.Bytes()), nil
+}
+
+//witnessSigHash returns hash of the tx with SIGHASH_ALL defined in BIP143 for signing
+//i-th txin, whose script code is script and previous amount is amount.
+func (t *Tx) witnessSigHash(i int, script []byte, amount uint64) ([]byte, error) {
+	if i >= len(t.TxIn) {
+		return nil, fmt.Errorf("no txin at %d", i)
+	}
+	var prevs, seqs, outs bytes.Buffer
+	for j, in := range t.TxIn {
+		if len(in.Hash) != 32 {
+			return nil, fmt.Errorf("length of hash in txin %d must be 32", j)
 		}
-		mto, err = p2pkTtxout(&s)
+		prevs.Write(in.Hash)
+		binary.Write(&prevs, binary.LittleEndian, in.Index)
+		binary.Write(&seqs, binary.LittleEndian, in.Seq)
 	}
-	return txins, used, mto, err
+	for _, out := range t.TxOut {
+		binary.Write(&outs, binary.LittleEndian, out.Value)
+		writeVarBytes(&outs, out.Script)
+	}
+	in := t.TxIn[i]
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, t.Version)
+	buf.Write(hash(prevs.Bytes()))
+	buf.Write(hash(seqs.Bytes()))
+	buf.Write(in.Hash)
+	binary.Write(&buf, binary.LittleEndian, in.Index)
+	writeVarBytes(&buf, script)
+	binary.Write(&buf, binary.LittleEndian, amount)
+	binary.Write(&buf, binary.LittleEndian, in.Seq)
+	buf.Write(hash(outs.Bytes()))
+	binary.Write(&buf, binary.LittleEndian, t.Locktime)
+	buf.Write([]byte{sigHashAll, 0, 0, 0}) //hash code type
+	return hash(buf.Bytes()), nil
+}
+
+//witnessKeyHash returns the key hash if script of the coin is P2WPKH.
+func (u *UTXO) witnessKeyHash() ([]byte, bool) {
+	if ScriptType(u.Script) != ScriptWitnessV0KeyHash {
+		return nil, false
+	}
+	_, prog, _ := witnessProgram(u.Script)
+	return prog, true
+}
+
+//sigHash returns hash for signing i-th txin of tx which spends the coin.
+//P2WPKH coins are signed as BIP143, which requires compressed keys.
+func (u *UTXO) sigHash(tx *Tx, i int) ([]byte, error) {
+	kh, ok := u.witnessKeyHash()
+	if !ok {
+		return tx.sigHash(i, u.Script)
+	}
+	pub := u.Key.PublicKey.Serialize()
+	if len(pub) != btcec.PubKeyBytesLenCompressed {
+		return nil, fmt.Errorf("key of P2WPKH coin at %d must be compressed", i)
+	}
+	if !bytes.Equal(address.AddressBytes(pub), kh) {
+		return nil, fmt.Errorf("key doesn't match P2WPKH coin at %d", i)
+	}
+	return tx.witnessSigHash(i, p2pkhScript(kh), u.Value)
 }
 
 func signTx(result *Tx, used []*UTXO) ([][]byte, error) {
 	sign := make([][]byte, len(used))
-	var err error
 	for i, p := range used {
-		var buf bytes.Buffer
-		backup := result.TxIn[i].Script
-		result.TxIn[i].Script = p.Script
-		if err = packer.Pack(&buf, *result); err != nil {
+		h, err := p.sigHash(result, i)
+		if err != nil {
 			return nil, err
 		}
-		beforeb := buf.Bytes()
-		beforeb = append(beforeb, 0x01, 0, 0, 0) //hash code type
-		h := sha256.Sum256(beforeb)
-		h = sha256.Sum256(h[:])
-		sign[i], err = p.Key.Sign(h[:])
+		sign[i], err = signHash(p.Key, h)
 		if err != nil {
 			return nil, err
 		}
-		result.TxIn[i].Script = backup
 	}
 	return sign, nil
 }
 
 //FillP2PKsign embeds sign script to result Tx.
+//Signs of P2WPKH coins are embedded in witnesses.
 func FillP2PKsign(result *Tx, used []*UTXO) error {
 	signs, err := signTx(result, used)
 	if err != nil {
 		return err
 	}
 	for i, s := range signs {
-		s = append(s, 0x1)
-		scr := result.TxIn[i].Script[:0]
-		scr = append(scr, byte(len(s)))
-		scr = append(scr, s...)
-		pub := used[i].Key.PublicKey.Serialize()
-		scr = append(scr, byte(len(pub)))
-		scr = append(scr, pub...)
-		result.TxIn[i].Script = scr
+		used[i].embedSign(result.TxIn[i], s)
 	}
 	return nil
 }
 
+//embedSign embeds sign of the coin to scriptSig, or to witness if the coin is P2WPKH.
+func (u *UTXO) embedSign(in *TxIn, sign []byte) {
+	pub := u.Key.PublicKey
+	if _, ok := u.witnessKeyHash(); ok {
+		in.Witness = [][]byte{append(sign, sigHashAll), pub.Serialize()}
+		return
+	}
+	in.Script = p2pkSigScript(sign, pub)
+}
+
+//checkMalleability returns an error if txid of tx can be changed by third parties,
+//i.e. some txins are not spent by witnesses.
+func checkMalleability(tx *Tx) error {
+	for i, in := range tx.TxIn {
+		if len(in.Script) != 0 || len(in.Witness) == 0 {
+			return fmt.Errorf("txin %d is not segwit, so txid can be malleated", i)
+		}
+	}
+	return nil
+}
+
+//checkWitnessCoins returns an error if some of coins are not P2WPKH,
+//so that txid of tx which spends them can be malleated.
+func checkWitnessCoins(coins UTXOs) error {
+	for i, c := range coins {
+		if _, ok := c.witnessKeyHash(); !ok {
+			return fmt.Errorf("coin %d is not P2WPKH, so txid can be malleated", i)
+		}
+	}
+	return nil
+}
+
+//p2pkSigScript returns scriptSig which spends P2PKH output.
+func p2pkSigScript(sign []byte, pub *address.PublicKey) []byte {
+	s := append(sign, sigHashAll)
+	scr := make([]byte, 0, len(s)+btcec.PubKeyBytesLenUncompressed+2)
+	scr = append(scr, byte(len(s)))
+	scr = append(scr, s...)
+	ser := pub.Serialize()
+	scr = append(scr, byte(len(ser)))
+	return append(scr, ser...)
+}
+
 //NewP2PK creates msg.Tx from send infos.
 //last index of sends must be refund address, and its amount must be 0..
+//Or mark a send as Change to put the change at its position.
 func NewP2PK(fee uint64, coins UTXOs, locktime uint32, sends ...*Send) (*Tx, error) {
-	result, used, err := NewP2PKunsign(fee, coins, locktime, sends...)
+	return NewP2PKNet(nil, fee, coins, locktime, sends...)
+}
+
+//NewP2PKNet is same as NewP2PK, but rejects addresses, keys, dust outputs
+//and dust change which don't fit net, and uses sequence policy of net.
+func NewP2PKNet(net *Network, fee uint64, coins UTXOs, locktime uint32, sends ...*Send) (*Tx, error) {
+	result, used, err := NewP2PKunsignNet(net, fee, coins, locktime, sends...)
 	if err != nil {
 		return nil, err
 	}
@@ -198,39 +423,39 @@ func NewP2PK(fee uint64, coins UTXOs, locktime uint32, sends ...*Send) (*Tx, err
 
 //NewP2PKunsign creates msg.Tx from send infos without signing tx..
 //last index of sends must be refund address, and its amount must be 0..
+//Or mark a send as Change to put the change at its position.
 func NewP2PKunsign(fee uint64, coins UTXOs, locktime uint32, sends ...*Send) (*Tx, []*UTXO, error) {
-	txouts, total, err := p2pkTxouts(fee, sends...)
+	return NewP2PKunsignNet(nil, fee, coins, locktime, sends...)
+}
+
+//NewP2PKunsignNet is same as NewP2PKunsign, but rejects addresses, keys, dust outputs
+//and dust change which don't fit net, and uses sequence policy of net.
+func NewP2PKunsignNet(net *Network, fee uint64, coins UTXOs, locktime uint32, sends ...*Send) (*Tx, []*UTXO, error) {
+	txouts, total, change, pos, err := p2pkTxouts(net, fee, sends...)
 	if err != nil {
 		return nil, nil, err
 	}
-	if sends[len(sends)-1].Amount != 0 {
+	if change == nil {
 		return nil, nil, errors.New("last index of sends must be refund address and amount must be 0")
 	}
 
-	txins, used, mto, err := newTxins(total, coins, sends[len(sends)-1].Addr, locktime)
+	txins, used, mto, err := newTxins(net, total, coins, change, locktime)
 	if err != nil {
 		return nil, nil, err
 	}
-	if mto != nil {
-		txouts = append(txouts, mto)
-	}
 	return &Tx{
 		Version:  1,
 		TxIn:     txins,
-		TxOut:    txouts,
+		TxOut:    insertTxout(txouts, pos, mto),
 		Locktime: locktime,
 	}, used, nil
 }
 
 //CustomTx returns OP_RETURN txout with the custome data.
+//It doesn't check the size of data. Use NullData to check it.
 func CustomTx(data []byte) *TxOut {
 	//Add custom data
-	script := make([]byte, 0, 1+1+len(data))
-	script = append(script, opRETURN)
-	script = append(script, byte(len(data)))
-	script = append(script, data...)
-
 	return &TxOut{
-		Script: script,
+		Script: pushData([]byte{opRETURN}, data),
 	}
 }
@@ -1,6 +1,7 @@
 package tx
 
 import (
+	"bytes"
 	"encoding/hex"
 	"log"
 	"testing"
@@ -80,3 +81,133 @@ func TestTX(t *testing.T) {
 	}
 	log.Print(hex.EncodeToString(rawtx))
 }
+
+func TestAddressScript(t *testing.T) {
+	addrs := map[string]string{
+		"1Cu32FVupVCgHkMMRJdYJugxwo2Aprgk7H":                             "76a9148280b37df378db99f66f85c95a783a76ac7a6d5988ac",
+		"n2eMqTT929pb1RDNuqEnxdaLau1rxy3efi":                             "76a914e7c1345fc8f87c68170b3aa798a956c2fe6a9eff88ac",
+		"MTi4x2NtDpdyXSwEvwU3aZ1Uronz1JBNC3":                             "76a914d94987ba89c258372030bc9d610f89547757896488ac",
+		"3CK4fEwbMP7heJarmU4eqA3sMbVJyEnU3V":                             "a914748284390f9e263a4b766a75d0633c50426eb87587",
+		"2N3sGiyscxqd3r6DQSbgXT738ZwhUpBqkej":                            "a914748284390f9e263a4b766a75d0633c50426eb87587",
+		"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4":                     "0014751e76e8199196d454941c45d1b3a323f1433bd6",
+		"bc1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3qccfmv3": "00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262",
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0": "512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		"bc1sw50qgdz25j": "6002751e",
+	}
+	for adr, s := range addrs {
+		script, err := AddressScript(adr)
+		if err != nil {
+			t.Error(adr, err)
+			continue
+		}
+		if hex.EncodeToString(script) != s {
+			t.Error("illegal script", adr, hex.EncodeToString(script))
+		}
+	}
+	for _, adr := range []string{
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh",
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd",
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t5",
+		"1Cu32FVupVCgHkMMRJdYJugxwo2Aprgk7J",
+	} {
+		if _, err := AddressScript(adr); err == nil {
+			t.Error("must be error", adr)
+		}
+	}
+	if _, err := TestNet3.AddressScript("bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"); err == nil {
+		t.Error("must be error for mainnet address in testnet")
+	}
+	script, err := TestNet3.AddressScript("2N3sGiyscxqd3r6DQSbgXT738ZwhUpBqkej")
+	if err != nil || ScriptType(script) != ScriptScriptHash {
+		t.Error("illegal script for P2SH address", err)
+	}
+}
+
+func TestScriptSend(t *testing.T) {
+	txKey, err := address.FromWIF("928Qr9J5oAC6AYieWJ3fG3dZDjuC7BFVUqgu4GsvRVpoXiTaJJf", address.BitcoinTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := DefaultP2PKScript(txKey.PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	coins := UTXOs{
+		&UTXO{
+			Key:     txKey,
+			TxHash:  make([]byte, 32),
+			TxIndex: 1,
+			Script:  script,
+			Value:   Unit,
+		}}
+	custom := []byte{opHASH160, opEQUAL}
+	changeScript := []byte{op1}
+	send := []*Send{
+		&Send{
+			Script: custom,
+			Amount: 0.3 * Unit,
+		},
+		&Send{
+			Script: changeScript,
+			Change: true,
+		},
+		&Send{
+			Script: CustomTx([]byte("some public data")).Script,
+		},
+		&Send{
+			Addr:   "n2eMqTT929pb1RDNuqEnxdaLau1rxy3efi",
+			Amount: 0.2 * Unit,
+		},
+	}
+	tx, err := NewP2PK(0.001*Unit, coins, 0, send...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []uint64{0.3 * Unit, 0.499 * Unit, 0, 0.2 * Unit}
+	scripts := [][]byte{custom, changeScript, send[2].Script, nil}
+	if len(tx.TxOut) != len(values) {
+		t.Fatal("illegal number of txouts", len(tx.TxOut))
+	}
+	for i, out := range tx.TxOut {
+		if out.Value != values[i] {
+			t.Error("illegal value", i, out.Value)
+		}
+		if scripts[i] != nil && !bytes.Equal(out.Script, scripts[i]) {
+			t.Error("illegal script", i, out.Script)
+		}
+	}
+
+	send[0].Amount = Unit - 0.2*Unit - 0.001*Unit
+	tx, err = NewP2PK(0.001*Unit, coins, 0, send...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.TxOut) != 3 || !bytes.Equal(tx.TxOut[1].Script, send[2].Script) {
+		t.Error("change must be omitted")
+	}
+
+	send[3].Change = true
+	if _, err = NewP2PK(0.001*Unit, coins, 0, send...); err == nil {
+		t.Error("must be error for two changes")
+	}
+
+	//null data at the last must not receive the change.
+	nd := &Send{Script: CustomTx([]byte("hello")).Script}
+	addr := &Send{Addr: "n2eMqTT929pb1RDNuqEnxdaLau1rxy3efi", Amount: 0.2 * Unit}
+	if _, err = NewP2PK(0.001*Unit, coins, 0, addr, nd); err == nil {
+		t.Error("must be error without change")
+	}
+	change := &Send{Addr: txKey.PublicKey.Address(), Change: true}
+	tx, err = NewP2PK(0.001*Unit, coins, 0, addr, change, nd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.TxOut) != 3 || tx.TxOut[1].Value != 0.799*Unit || tx.TxOut[2].Value != 0 {
+		t.Error("illegal txouts with change")
+	}
+	nd.Change = true
+	change.Change = false
+	if _, err = NewP2PK(0.001*Unit, coins, 0, addr, change, nd); err == nil {
+		t.Error("must be error for unspendable change")
+	}
+}
@@ -33,10 +33,20 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/bitgoin/address"
 	"github.com/bitgoin/address/btcec"
-	"github.com/bitgoin/packer"
+)
+
+//Limits of P2SH multisig.
+const (
+	//MaxMultisigKeys is max N of M of N multisig in P2SH.
+	MaxMultisigKeys = 15
+	//MaxRedeemScriptSize is max size of redeem script, i.e. max size of a pushed element.
+	MaxRedeemScriptSize = 520
+	//MaxScriptSigSize is max size of scriptSig which nodes relay.
+	MaxScriptSigSize = 1650
 )
 
 //PubInfo is infor of public key in M of N multisig.
@@ -46,46 +56,187 @@ type PubInfo struct {
 	bond   *Tx
 	Fee    uint64
 	M      byte
+	//Net is the network of keys and addresses. No checks if nil.
+	Net *Network
+	//Sorted sorts keys in redeem script lexicographically (BIP67).
+	//Pubs and sigs are still in the original order.
+	Sorted bool
+	//Witness is true if the bond is P2WSH, otherwise P2SH.
+	//txid of tx which spends P2WSH bond cannot be malleated.
+	Witness bool
+	//prev is the bond output set by SetOutpoint.
+	prev *Outpoint
+}
+
+//ParseRedeemScript parses M of N multisig redeem script and returns PubInfo with keys and M.
+//Keys are for net, or for MainNet if net is nil. Witness is not set.
+func ParseRedeemScript(redeem []byte, net *Network) (*PubInfo, error) {
+	ops, err := parseScript(redeem)
+	if err != nil {
+		return nil, err
+	}
+	if len(ops) < 4 || ops[len(ops)-1].code != opCHECKMULTISIG {
+		return nil, errors.New("redeem script is not multisig")
+	}
+	m := smallInt(ops[0].code)
+	n := smallInt(ops[len(ops)-2].code)
+	if m < 1 || n < m || n != len(ops)-3 {
+		return nil, errors.New("illegal M or N in redeem script")
+	}
+	param := MainNet.Params
+	if net != nil {
+		param = net.Params
+	}
+	p := &PubInfo{
+		Pubs: make([]*address.PublicKey, n),
+		M:    byte(m),
+		Net:  net,
+	}
+	for i, o := range ops[1 : len(ops)-2] {
+		if p.Pubs[i], err = address.NewPublicKey(o.data, param); err != nil {
+			return nil, fmt.Errorf("illegal key at %d: %s", i, err)
+		}
+	}
+	if !bytes.Equal(p.redeemScript(), redeem) {
+		return nil, errors.New("redeem script is not in standard form")
+	}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//RedeemScript returns the redeem script of multisig.
+func (p *PubInfo) RedeemScript() []byte {
+	return p.redeemScript()
+}
+
+//SetOutpoint sets bond to be spent, which is the output at index of tx whose hash is txHash
+//and its value is amount, instead of calling BondTx.
+//txHash must be in the same byte order as UTXO.TxHash.
+func (p *PubInfo) SetOutpoint(txHash []byte, index uint32, amount uint64) error {
+	if len(txHash) != 32 {
+		return errors.New("length of tx hash must be 32")
+	}
+	p.prev = &Outpoint{
+		Hash:  txHash,
+		Index: index,
+	}
+	p.Amount = amount
+	return nil
+}
+
+//Outpoint returns the bond output which is spent by multisig.
+func (p *PubInfo) Outpoint() (*Outpoint, error) {
+	if p.prev != nil {
+		return p.prev, nil
+	}
+	if p.bond == nil {
+		return nil, errors.New("must call BondTx or SetOutpoint first")
+	}
+	index, err := p.searchTxout()
+	if err != nil {
+		return nil, err
+	}
+	return &Outpoint{
+		Hash:  p.bond.Hash(),
+		Index: index,
+	}, nil
+}
+
+//pubOrder sorts indexes of keys by their serialized form.
+type pubOrder struct {
+	index []int
+	ser   [][]byte
+}
+
+func (o *pubOrder) Len() int { return len(o.index) }
+func (o *pubOrder) Less(i, j int) bool {
+	return bytes.Compare(o.ser[o.index[i]], o.ser[o.index[j]]) < 0
+}
+func (o *pubOrder) Swap(i, j int) { o.index[i], o.index[j] = o.index[j], o.index[i] }
+
+//keyOrder returns indexes of Pubs in the order of redeem script.
+func (p *PubInfo) keyOrder() []int {
+	o := pubOrder{
+		index: make([]int, len(p.Pubs)),
+		ser:   make([][]byte, len(p.Pubs)),
+	}
+	for i, pu := range p.Pubs {
+		o.index[i] = i
+		o.ser[i] = pu.Serialize()
+	}
+	if p.Sorted {
+		sort.Stable(&o)
+	}
+	return o.index
 }
 
 func (p *PubInfo) redeemScript() []byte {
 	scr := make([]byte, 0, 3+len(p.Pubs)*btcec.PubKeyBytesLenUncompressed)
 	scr = append(scr, op1+(p.M-1))
-	for _, pu := range p.Pubs {
-		ser := pu.Serialize()
-		scr = append(scr, byte(len(ser)))
-		scr = append(scr, ser...)
+	for _, i := range p.keyOrder() {
+		scr = pushData(scr, p.Pubs[i].Serialize())
 	}
 	scr = append(scr, op1+(byte(len(p.Pubs)-1)))
 	scr = append(scr, opCHECKMULTISIG)
 	return scr
 }
 
+//redeemHash returns scriptPubKey of the bond, which is P2WSH if Witness, otherwise P2SH.
 func (p *PubInfo) redeemHash() []byte {
 	redeem := p.redeemScript()
-	hash160 := address.AddressBytes(redeem)
-	script := make([]byte, 0, len(hash160)+3)
-	script = append(script, opHASH160, byte(len(hash160)))
-	script = append(script, hash160...)
-	script = append(script, opEQUAL)
-	return script
+	if p.Witness {
+		sh := sha256.Sum256(redeem)
+		return witnessScript(0, sh[:])
+	}
+	return p2shScript(address.AddressBytes(redeem))
 }
 
-//BondTx creates a bond transaction.
-func (p *PubInfo) BondTx(coins UTXOs, refund string, locktime uint32) (*Tx, error) {
+//sigHash returns hash for signing idx-th txin of mtx, which spends the bond.
+func (p *PubInfo) sigHash(mtx *Tx, idx int) ([]byte, error) {
+	return scriptSigHash(mtx, idx, p.redeemScript(), p.Amount, p.Witness)
+}
+
+//check checks M, N and size of redeem script.
+func (p *PubInfo) check() error {
 	n := len(p.Pubs)
-	if n == 0 || n > 7 {
-		return nil, errors.New("N must be 0~7")
+	if n == 0 || n > MaxMultisigKeys {
+		return fmt.Errorf("N must be 1~%d", MaxMultisigKeys)
 	}
 	if p.M == 0 || p.M > byte(n) {
-		return nil, errors.New("M must be 0~N")
+		return errors.New("M must be 1~N")
+	}
+	if p.Sorted {
+		for _, pu := range p.Pubs {
+			if len(pu.Serialize()) != btcec.PubKeyBytesLenCompressed {
+				return errors.New("keys must be compressed in BIP67")
+			}
+		}
+	}
+	if l := len(p.redeemScript()); l > MaxRedeemScriptSize {
+		return fmt.Errorf("size of redeem script %d exceeds %d, use compressed keys",
+			l, MaxRedeemScriptSize)
+	}
+	return nil
+}
+
+//BondTx creates a bond transaction.
+func (p *PubInfo) BondTx(coins UTXOs, refund string, locktime uint32) (*Tx, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	for _, pub := range p.Pubs {
+		if err := p.Net.checkKey(pub); err != nil {
+			return nil, err
+		}
 	}
 	txouts := make([]*TxOut, 1, 2)
 	txouts[0] = &TxOut{
 		Value:  p.Amount,
 		Script: p.redeemHash(),
 	}
-	txins, privs, mto, err := newTxins(p.Amount+p.Fee, coins, refund, locktime)
+	txins, privs, mto, err := newTxins(p.Net, p.Amount+p.Fee, coins, &Send{Addr: refund}, locktime)
 	if err != nil {
 		return nil, err
 	}
@@ -100,6 +251,7 @@ func (p *PubInfo) BondTx(coins UTXOs, refund string, locktime uint32) (*Tx, erro
 	}
 	err = FillP2PKsign(&result, privs)
 	p.bond = &result
+	p.prev = nil
 	return &result, err
 }
 
@@ -114,56 +266,53 @@ func (p *PubInfo) searchTxout() (uint32, error) {
 }
 
 func (p *PubInfo) txForSign(locktime uint32, sends ...*Send) (*Tx, error) {
-	if p.bond == nil {
-		return nil, errors.New("must call MultisigOut first")
+	prev, err := p.Outpoint()
+	if err != nil {
+		return nil, err
 	}
-	txouts, total, err := p2pkTxouts(p.Fee, sends...)
+	txouts, total, change, pos, err := p2pkTxouts(p.Net, p.Fee, sends...)
 	if err != nil {
 		return nil, err
 	}
 	if p.Amount < total {
 		return nil, errors.New("total coins of output must be less than one of input")
 	}
-	index, err := p.searchTxout()
-	if err != nil {
-		return nil, err
-	}
 	utxos := UTXOs{
 		&UTXO{
-			TxHash:  p.bond.Hash(),
-			TxIndex: index,
+			TxHash:  prev.Hash,
+			TxIndex: prev.Index,
 			Script:  p.redeemScript(),
 			Value:   p.Amount,
 		},
 	}
-	mtxin, _, txout, err := newTxins(total, utxos, sends[len(sends)-1].Addr, locktime)
+	mtxin, _, txout, err := newTxins(p.Net, total, utxos, change, locktime)
 	if err != nil {
 		return nil, err
 	}
-	mtxin[0].Script = p.redeemScript()
-	if txout != nil {
-		txouts = append(txouts, txout)
+	if !p.Witness {
+		mtxin[0].Script = p.redeemScript()
 	}
 	mtx := Tx{
 		Version:  1,
 		TxIn:     mtxin,
-		TxOut:    txouts,
+		TxOut:    insertTxout(txouts, pos, txout),
 		Locktime: locktime,
 	}
 
 	return &mtx, nil
 }
 
-func (p *PubInfo) verify(mtx *Tx, sign []byte, i int) error {
-	var buf bytes.Buffer
-	if err := packer.Pack(&buf, *mtx); err != nil {
+//verify verifies sign of i-th key for idx-th txin of mtx.
+//sign must be strict DER with low S.
+func (p *PubInfo) verify(mtx *Tx, idx int, sign []byte, i int) error {
+	if err := checkSig(sign); err != nil {
+		return err
+	}
+	h, err := p.sigHash(mtx, idx)
+	if err != nil {
 		return err
 	}
-	beforeb := buf.Bytes()
-	beforeb = append(beforeb, 0x01, 0, 0, 0) //hash code type
-	h := sha256.Sum256(beforeb)
-	h = sha256.Sum256(h[:])
-	return p.Pubs[i].Verify(sign, h[:])
+	return p.Pubs[i].Verify(sign, h)
 }
 
 //SignMultisig signs multisig transaction by priv.
@@ -173,27 +322,31 @@ func (p *PubInfo) SignMultisig(priv *address.PrivateKey,
 	if err != nil {
 		return nil, err
 	}
-	prev := &UTXO{
-		Key:    priv,
-		Script: p.redeemScript(),
-	}
-	signs, err := signTx(mtx, []*UTXO{prev})
+	h, err := p.sigHash(mtx, 0)
 	if err != nil {
 		return nil, err
 	}
-	return signs[0], nil
+	return signHash(priv, h)
 }
 
-func (p *PubInfo) embedSigns(mtx *Tx, sigs [][]byte) error {
+//embedSigns embeds sigs to scriptSig of idx-th txin of mtx, or to witness if Witness.
+func (p *PubInfo) embedSigns(mtx *Tx, idx int, sigs [][]byte) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	if len(sigs) > len(p.Pubs) {
+		return errors.New("number of sigs must not exceed N")
+	}
 	redeem := p.redeemScript()
-	script2 := make([]byte, 0, 74*len(sigs)+len(redeem)+3)
+	script2 := make([]byte, 0, 74*len(sigs)+len(redeem)+4)
 	script2 = append(script2, op0)
 	var nsig byte
-	for i, s := range sigs {
-		if s == nil {
+	for _, i := range p.keyOrder() {
+		if i >= len(sigs) || sigs[i] == nil {
 			continue
 		}
-		if err := p.verify(mtx, s, i); err != nil {
+		s := sigs[i]
+		if err := p.verify(mtx, idx, s, i); err != nil {
 			return fmt.Errorf("%s at %d", err, i)
 		}
 		script2 = append(script2, byte(len(s)+1))
@@ -204,29 +357,85 @@ func (p *PubInfo) embedSigns(mtx *Tx, sigs [][]byte) error {
 	if nsig != p.M {
 		return errors.New("signatures are not enough")
 	}
-	if len(redeem) > 255 {
-		return errors.New("len of redeem script must be less than 255")
+	if p.Witness {
+		items := [][]byte{nil}
+		for _, i := range p.keyOrder() {
+			if i < len(sigs) && sigs[i] != nil {
+				items = append(items, append(append([]byte{}, sigs[i]...), sigHashAll))
+			}
+		}
+		mtx.TxIn[idx].Script = []byte{}
+		mtx.TxIn[idx].Witness = append(items, redeem)
+		return nil
+	}
+	script2 = pushData(script2, redeem)
+	if len(script2) > MaxScriptSigSize {
+		return fmt.Errorf("size of scriptSig %d exceeds %d", len(script2), MaxScriptSigSize)
 	}
-	script2 = append(script2, opPUSHDATA1, byte(len(redeem)))
-	script2 = append(script2, redeem...)
-	mtx.TxIn[0].Script = script2
+	mtx.TxIn[idx].Script = script2
 
 	return nil
 }
 
+//matchSigs verifies each sig in sigs against keys and returns M of them
+//at the index of their keys in Pubs.
+//Sigs which match no key and sigs more than M are dropped.
+func (p *PubInfo) matchSigs(mtx *Tx, idx int, sigs [][]byte) ([][]byte, error) {
+	matched := make([][]byte, len(p.Pubs))
+	for _, s := range sigs {
+		if s == nil {
+			continue
+		}
+		for i := range p.Pubs {
+			if matched[i] == nil && p.verify(mtx, idx, s, i) == nil {
+				matched[i] = s
+				break
+			}
+		}
+	}
+	var nsig byte
+	for _, i := range p.keyOrder() {
+		if matched[i] == nil {
+			continue
+		}
+		if nsig == p.M {
+			matched[i] = nil
+			continue
+		}
+		nsig++
+	}
+	if nsig != p.M {
+		return nil, fmt.Errorf("only %d valid signatures for %d keys, need %d", nsig, len(p.Pubs), p.M)
+	}
+	return matched, nil
+}
+
+//SpendBondTxUnordered is same as SpendBondTx, but sigs can be in any order and
+//can be more than M. Each sig is verified and matched with its key.
+func (p *PubInfo) SpendBondTxUnordered(locktime uint32, sigs [][]byte, sends ...*Send) (*Tx, error) {
+	mtx, err := p.txForSign(locktime, sends...)
+	if err != nil {
+		return nil, err
+	}
+	matched, err := p.matchSigs(mtx, 0, sigs)
+	if err != nil {
+		return nil, err
+	}
+	err = p.embedSigns(mtx, 0, matched)
+	return mtx, err
+}
+
 //SpendBondTx creates tx which spends bond.
-//Bond field in PubInfo must be filled previously.
+//Bond must be set by BondTx or SetOutpoint previously.
+//sigs must be in the same order as Pubs, even if Sorted is true.
 func (p *PubInfo) SpendBondTx(locktime uint32, sigs [][]byte, sends ...*Send) (*Tx, error) {
 	if len(sigs) == 0 {
 		return nil, errors.New("must fill sigs")
 	}
-	if p.bond == nil {
-		return nil, errors.New("must fill prev in pubinfo")
-	}
 	mtx, err := p.txForSign(locktime, sends...)
 	if err != nil {
 		return nil, err
 	}
-	err = p.embedSigns(mtx, sigs)
+	err = p.embedSigns(mtx, 0, sigs)
 	return mtx, err
 }
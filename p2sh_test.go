@@ -193,3 +193,374 @@ func TestRedeemScript(t *testing.T) {
 		t.Error("illegal tx")
 	}
 }
+
+var multisigWIFs = []string{
+	"cUy1WgXoQQPBVY6SQBNArY5iNWLHUHMFU8JnXNJLqHk4yFd1fvig",
+	"cSrv6BPWKT5GYwnuGpNHE7DFGJA6zLgPsCNoHQSNNyM64wtDkhmT",
+	"cTgvgRwkgm1Unwrjg5RhqvT4auZgKH8drn6oAjxbcKuyKBXxswmR",
+	"cUmzFJWxygokxG3DS1Wzuvxeyb2WTHzVrpB7f7tBybWbGYp86Vhw",
+	"cRnUyQ3CRW5hUWkWwcUr9ymWYpSR2RdCSn96Q6jDwgcSqc4qvpJE",
+	"cNNCYQAerQxF9Z4hB4WWWrb9YtRqRGCTS6tYzEgiQQjddHTTnqgC",
+	"cQoEKwz3g1YcykBFpSVkcf9WkF34EWATwvhZVWro5n4kfsypn4oc",
+	"cNkoWq7vemdSwxmRWvthCze5BBcNVb8UGnZ6Nv7WEmcxjZ5T8SUA",
+	"cUScS6JhtfhApmw1K9YgAh4BRHc7WVb3Yj1wiBW6d45YBcpraVFm",
+	"cVWF2X3Etr4YgNingQhWe3mypReu32BNveJaSQiXbkAHM6qyECSu",
+	"cS2VA3zvjc81YSkpGiTM2hKG3KA2rQyKcUKppvHbswuVfs5ao7i4",
+	"cV35CgsAZ4enftWSiur4NQYv3e5KFsHYN33RDzhpMdRpQgVzynx2",
+	"cNEJH22C9R5rBVEUHnRqcoKP15FgCrSk1wAsfWFzigNmEC8x1Nrz",
+	"cVpCGgpN7kvTQMtDJtrUMgTaj22PixzPHZcKecA2TVnazEoyW4b6",
+	"cVXXEXjKofjXdmTTJkukH4gXvsJJDfkxuQxZmKtNNK2pTvNvyDbT",
+}
+
+var uncompressedWIFs = []string{
+	"93FxQ3AF92DjFd3bJVBEZX9miaP3Nb4gXce7EgGFv5ha5DXJMsm",
+	"92nJ1imyVCLzu6cmvRn9fKB2RJwAy3CC587JHQSETGwPuAezbo2",
+	"92yAtyrZZ7oKz5j5gfcWC5rrkUmZUFXjLSAvWPsfCdTW5BPyBmt",
+	"93DTZhDgRAve9ScPkjFxGAWNkBRp14rH48Ww576FiphEf29Zxy5",
+	"92Y9byso66gae3fQYrj79qCu1QtXNAf7DdxkpNgvgaShkELiwcp",
+	"91mE38WpzsHbUK962Ne3cK2r4bm9FZShszyYGEXJ5rLB7TnHRFc",
+	"92KBGd29JuEWSzpBcDaFQwQgN8Fy1o2h6CG5eGpz7X9Z6h1oTUz",
+	"91rM48jMK5DnkidoLUASskRFzb87EGtY6qqWK79GgpigMyDfHYA",
+}
+
+func testKeys(t *testing.T, wifs []string) []*address.PrivateKey {
+	keys := make([]*address.PrivateKey, len(wifs))
+	for i, wif := range wifs {
+		var err error
+		keys[i], err = address.FromWIF(wif, address.BitcoinTest)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+func testCoins(t *testing.T, key *address.PrivateKey, values ...uint64) UTXOs {
+	script, err := DefaultP2PKScript(key.PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	coins := make(UTXOs, len(values))
+	for i, v := range values {
+		coins[i] = &UTXO{
+			Key:     key,
+			TxHash:  bytes.Repeat([]byte{byte(i + 1)}, 32),
+			TxIndex: uint32(i),
+			Script:  script,
+			Value:   v,
+		}
+	}
+	return coins
+}
+
+//testSegwitCoins returns P2WPKH coins of key, which must be compressed.
+func testSegwitCoins(t *testing.T, key *address.PrivateKey, values ...uint64) UTXOs {
+	script, err := P2WPKHScript(key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coins := testCoins(t, key, values...)
+	for _, c := range coins {
+		c.Script = script
+	}
+	return coins
+}
+
+func TestLargeMultisig(t *testing.T) {
+	keys := testKeys(t, multisigWIFs)
+	for _, mn := range [][2]int{{5, 11}, {15, 15}, {1, 1}} {
+		m, n := mn[0], mn[1]
+		pi := &PubInfo{
+			Amount: Unit,
+			M:      byte(m),
+			Fee:    0.001 * Unit,
+		}
+		for _, k := range keys[:n] {
+			pi.Pubs = append(pi.Pubs, k.PublicKey)
+		}
+		if _, err := pi.BondTx(testCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address(), 0); err != nil {
+			t.Fatal(m, n, err)
+		}
+		send := []*Send{
+			&Send{
+				Addr:   keys[0].PublicKey.Address(),
+				Amount: Unit - 0.001*Unit,
+			},
+		}
+		sigs := make([][]byte, n)
+		for i := n - m; i < n; i++ {
+			var err error
+			sigs[i], err = pi.SignMultisig(keys[i], 0, send...)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		tx, err := pi.SpendBondTx(0, sigs, send...)
+		if err != nil {
+			t.Fatal(m, n, err)
+		}
+		redeem := pi.redeemScript()
+		script := tx.TxIn[0].Script
+		if len(redeem) != 3+34*n || !bytes.HasSuffix(script, redeem) {
+			t.Error("illegal redeem script", m, n, len(redeem))
+		}
+		ops, err := parseScript(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := ops[len(ops)-1]
+		switch {
+		case len(redeem) > 255 && last.code != opPUSHDATA2,
+			len(redeem) <= 255 && len(redeem) > 75 && last.code != opPUSHDATA1,
+			len(redeem) <= 75 && last.code != byte(len(redeem)):
+			t.Error("illegal push of redeem script", m, n, last.code)
+		}
+		if len(ops) != m+2 {
+			t.Error("illegal number of pushes", len(ops))
+		}
+	}
+
+	ukeys := testKeys(t, uncompressedWIFs)
+	pi := &PubInfo{
+		Amount: Unit,
+		M:      2,
+		Fee:    0.001 * Unit,
+	}
+	for _, k := range ukeys {
+		pi.Pubs = append(pi.Pubs, k.PublicKey)
+	}
+	if _, err := pi.BondTx(testCoins(t, ukeys[0], 2*Unit), ukeys[0].PublicKey.Address(), 0); err == nil {
+		t.Error("must be error for too long redeem script")
+	}
+	pi.Pubs = pi.Pubs[:7]
+	if _, err := pi.BondTx(testCoins(t, ukeys[0], 2*Unit), ukeys[0].PublicKey.Address(), 0); err != nil {
+		t.Error(err)
+	}
+	for _, k := range keys {
+		pi.Pubs = append(pi.Pubs, k.PublicKey)
+	}
+	if _, err := pi.BondTx(testCoins(t, ukeys[0], 2*Unit), ukeys[0].PublicKey.Address(), 0); err == nil {
+		t.Error("must be error for N > 15")
+	}
+}
+
+func TestSortedMultisig(t *testing.T) {
+	//test vector 1 in BIP67.
+	var pubs []*address.PublicKey
+	for _, s := range []string{
+		"02ff12471208c14bd580709cb2358d98975247d8765f92bc25eab3b2763ed605f8",
+		"02fe6f0a5a297eb38c391581c4413e084773ea23954d93f7753db7dc0adc188b2f",
+	} {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := address.NewPublicKey(b, address.BitcoinMain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubs = append(pubs, pub)
+	}
+	pi := &PubInfo{
+		Pubs:   pubs,
+		M:      2,
+		Sorted: true,
+	}
+	if hex.EncodeToString(pi.redeemScript()) != "522102fe6f0a5a297eb38c391581c4413e084773ea23954d93f7753db7dc0adc188b2f2102ff12471208c14bd580709cb2358d98975247d8765f92bc25eab3b2763ed605f852ae" {
+		t.Error("illegal redeem script", hex.EncodeToString(pi.redeemScript()))
+	}
+
+	keys := testKeys(t, multisigWIFs[:5])
+	orders := [][]int{{0, 1, 2, 3, 4}, {4, 2, 0, 3, 1}}
+	var scripts [][]byte
+	for _, order := range orders {
+		pi = &PubInfo{
+			Amount: Unit,
+			M:      3,
+			Fee:    0.001 * Unit,
+			Sorted: true,
+		}
+		for _, i := range order {
+			pi.Pubs = append(pi.Pubs, keys[i].PublicKey)
+		}
+		bond, err := pi.BondTx(testCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scripts = append(scripts, bond.TxOut[0].Script)
+		send := []*Send{
+			&Send{
+				Addr:   keys[0].PublicKey.Address(),
+				Amount: Unit - 0.001*Unit,
+			},
+		}
+		sigs := make([][]byte, len(order))
+		for i := 0; i < 3; i++ {
+			if sigs[i], err = pi.SignMultisig(keys[order[i]], 0, send...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tx, err := pi.SpendBondTx(0, sigs, send...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops, err := parseScript(tx.TxIn[0].Script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := tx.sigHash(0, pi.redeemScript())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ser := make([][]byte, 0, 3)
+		for _, o := range ops[1:4] {
+			for j, k := range pi.Pubs {
+				if k.Verify(o.data[:len(o.data)-1], h) == nil {
+					ser = append(ser, pi.Pubs[j].Serialize())
+				}
+			}
+		}
+		if len(ser) != 3 || bytes.Compare(ser[0], ser[1]) >= 0 || bytes.Compare(ser[1], ser[2]) >= 0 {
+			t.Error("signatures must be in the order of sorted keys")
+		}
+	}
+	if !bytes.Equal(scripts[0], scripts[1]) {
+		t.Error("P2SH scripts must be same regardless of order of keys")
+	}
+
+	pi.Pubs = append(pi.Pubs, testKeys(t, uncompressedWIFs[:1])[0].PublicKey)
+	if _, err := pi.BondTx(testCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address(), 0); err == nil {
+		t.Error("must be error for uncompressed key")
+	}
+}
+
+func TestUnorderedSigs(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:5])
+	pi := &PubInfo{
+		Amount: Unit,
+		M:      3,
+		Fee:    0.001 * Unit,
+	}
+	for _, k := range keys {
+		pi.Pubs = append(pi.Pubs, k.PublicKey)
+	}
+	if _, err := pi.BondTx(testCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address(), 0); err != nil {
+		t.Fatal(err)
+	}
+	send := []*Send{
+		&Send{
+			Addr:   keys[0].PublicKey.Address(),
+			Amount: Unit - 0.001*Unit,
+		},
+	}
+	sigs := make([][]byte, len(keys))
+	for i, k := range keys {
+		var err error
+		if sigs[i], err = pi.SignMultisig(k, 0, send...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other, err := pi.SignMultisig(keys[0], 10, send...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bag := [][]byte{sigs[4], other, sigs[1], sigs[4], sigs[3], sigs[0]}
+	tx, err := pi.SpendBondTxUnordered(0, bag, send...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := parseScript(tx.TxIn[0].Script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 5 {
+		t.Fatal("illegal number of pushes", len(ops))
+	}
+	for i, j := range []int{0, 1, 3} {
+		if !bytes.Equal(ops[i+1].data[:len(ops[i+1].data)-1], sigs[j]) {
+			t.Error("illegal signature at", i)
+		}
+	}
+	if _, err = pi.SpendBondTxUnordered(0, [][]byte{sigs[2], other, sigs[2], sigs[4]}, send...); err == nil {
+		t.Error("must be error for not enough signatures")
+	}
+}
+
+func TestSpendOutpoint(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:3])
+	pi := &PubInfo{
+		Amount: Unit,
+		M:      2,
+		Fee:    0.001 * Unit,
+		Net:    TestNet3,
+	}
+	for _, k := range keys {
+		pi.Pubs = append(pi.Pubs, k.PublicKey)
+	}
+	bond, err := pi.BondTx(testCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := []*Send{
+		&Send{
+			Addr:   keys[0].PublicKey.Address(),
+			Amount: Unit - 0.001*Unit,
+		},
+	}
+	sig0, err := pi.SignMultisig(keys[0], 0, send...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := pi.SpendBondTx(0, [][]byte{sig0, nil, nil}, send...)
+	if err == nil {
+		t.Error("must be error for not enough sigs")
+	}
+
+	//another co-signer after restart knows only redeem script and outpoint.
+	pi2, err := ParseRedeemScript(pi.RedeemScript(), TestNet3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi2.M != 2 || len(pi2.Pubs) != 3 || pi2.Pubs[2].Address() != keys[2].PublicKey.Address() {
+		t.Fatal("illegal PubInfo from redeem script")
+	}
+	pi2.Fee = 0.001 * Unit
+	if _, err = pi2.SignMultisig(keys[2], 0, send...); err == nil {
+		t.Error("must be error without outpoint")
+	}
+	if err = pi2.SetOutpoint(bond.Hash(), 0, Unit); err != nil {
+		t.Fatal(err)
+	}
+	sig2, err := pi2.SignMultisig(keys[2], 0, send...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err = pi2.SpendBondTx(0, [][]byte{sig0, nil, sig2}, send...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx1, err := pi.SpendBondTx(0, [][]byte{sig0, nil, sig2}, send...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tx.Hash(), tx1.Hash()) {
+		t.Error("spending txs must be same")
+	}
+	if !bytes.Equal(tx.TxIn[0].Hash, bond.Hash()) || tx.TxIn[0].Index != 0 {
+		t.Error("illegal outpoint in txin")
+	}
+
+	for _, s := range []string{
+		"52ae",
+		"5121000000000000000000000000000000000000000000000000000000000000000000000051ae",
+		"524c21020202020202020202020202020202020202020202020202020202020202020202020252ae",
+	} {
+		redeem, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ParseRedeemScript(redeem, nil); err == nil {
+			t.Error("must be error for", s)
+		}
+	}
+}
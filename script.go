@@ -0,0 +1,459 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//scriptOp is an opcode and its pushed data in a script.
+type scriptOp struct {
+	code byte
+	data []byte
+}
+
+//parseScript splits script into opcodes.
+func parseScript(script []byte) ([]scriptOp, error) {
+	var ops []scriptOp
+	for i := 0; i < len(script); {
+		code := script[i]
+		i++
+		var l int
+		switch {
+		case code > op0 && code < opPUSHDATA1:
+			l = int(code)
+		case code == opPUSHDATA1:
+			if i+1 > len(script) {
+				return ops, errors.New("script is too short for PUSHDATA1")
+			}
+			l = int(script[i])
+			i++
+		case code == opPUSHDATA2:
+			if i+2 > len(script) {
+				return ops, errors.New("script is too short for PUSHDATA2")
+			}
+			l = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		case code == opPUSHDATA4:
+			if i+4 > len(script) {
+				return ops, errors.New("script is too short for PUSHDATA4")
+			}
+			l = int(binary.LittleEndian.Uint32(script[i:]))
+			i += 4
+		default:
+			ops = append(ops, scriptOp{code: code})
+			continue
+		}
+		if l < 0 || i+l > len(script) {
+			return ops, fmt.Errorf("script is too short for pushing %d bytes", l)
+		}
+		ops = append(ops, scriptOp{code: code, data: script[i : i+l]})
+		i += l
+	}
+	return ops, nil
+}
+
+//pushData appends minimal push of data to script.
+func pushData(script []byte, data []byte) []byte {
+	l := len(data)
+	switch {
+	case l == 0:
+		return append(script, op0)
+	case l == 1 && data[0] >= 1 && data[0] <= 16:
+		return append(script, op1+data[0]-1)
+	case l == 1 && data[0] == 0x81:
+		return append(script, op1NEGATE)
+	case l < int(opPUSHDATA1):
+		script = append(script, byte(l))
+	case l <= 0xff:
+		script = append(script, opPUSHDATA1, byte(l))
+	case l <= 0xffff:
+		script = append(script, opPUSHDATA2, 0, 0)
+		binary.LittleEndian.PutUint16(script[len(script)-2:], uint16(l))
+	default:
+		script = append(script, opPUSHDATA4, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(script[len(script)-4:], uint32(l))
+	}
+	return append(script, data...)
+}
+
+//pushedData returns data pushed by the op, including small integers.
+func (o scriptOp) pushedData() []byte {
+	switch {
+	case o.code == op1NEGATE:
+		return []byte{0x81}
+	case o.code >= op1 && o.code <= op16:
+		return []byte{o.code - op1 + 1}
+	}
+	return o.data
+}
+
+//isPush returns true if the op pushes data or a small integer.
+func (o scriptOp) isPush() bool {
+	return o.code <= op16 && o.code != opRESERVED
+}
+
+//isPushOnly returns true if script consists of pushes only.
+func isPushOnly(script []byte) bool {
+	ops, err := parseScript(script)
+	if err != nil {
+		return false
+	}
+	for _, o := range ops {
+		if !o.isPush() {
+			return false
+		}
+	}
+	return true
+}
+
+//smallInt returns the value of OP_0~OP_16, or -1 for other ops.
+func smallInt(code byte) int {
+	switch {
+	case code == op0:
+		return 0
+	case code >= op1 && code <= op16:
+		return int(code-op1) + 1
+	}
+	return -1
+}
+
+//scriptNum decodes the script number in b.
+func scriptNum(b []byte) int64 {
+	if len(b) == 0 {
+		return 0
+	}
+	var n int64
+	for i, c := range b {
+		n |= int64(c) << uint(8*i)
+	}
+	if b[len(b)-1]&0x80 != 0 {
+		return -(n & ^(int64(0x80) << uint(8*(len(b)-1))))
+	}
+	return n
+}
+
+//scriptNumBytes encodes n as the minimal script number.
+func scriptNumBytes(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+	neg := n < 0
+	if neg {
+		n = -n
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append(b, byte(n))
+	}
+	switch {
+	case b[len(b)-1]&0x80 != 0 && neg:
+		b = append(b, 0x80)
+	case b[len(b)-1]&0x80 != 0:
+		b = append(b, 0)
+	case neg:
+		b[len(b)-1] |= 0x80
+	}
+	return b
+}
+
+var sighashNames = map[byte]string{
+	sigHashAll:                          "ALL",
+	sigHashNone:                         "NONE",
+	sigHashSingle:                       "SINGLE",
+	sigHashAll | sigHashAnyOneCanPay:    "ALL|ANYONECANPAY",
+	sigHashNone | sigHashAnyOneCanPay:   "NONE|ANYONECANPAY",
+	sigHashSingle | sigHashAnyOneCanPay: "SINGLE|ANYONECANPAY",
+}
+
+//disasm returns the script in the same asm format as bitcoind.
+//If sighash is true, hashtypes of signatures are decoded like "[ALL]".
+func disasm(script []byte, sighash bool) string {
+	ops, err := parseScript(script)
+	strs := make([]string, 0, len(ops)+1)
+	for _, o := range ops {
+		if o.code > opPUSHDATA4 {
+			strs = append(strs, opName(o.code))
+			continue
+		}
+		if len(o.data) <= 4 {
+			strs = append(strs, strconv.FormatInt(scriptNum(o.data), 10))
+			continue
+		}
+		if sighash && len(script) > 0 && script[0] != opRETURN &&
+			isStrictDER(o.data) {
+			if name, ok := sighashNames[o.data[len(o.data)-1]]; ok {
+				strs = append(strs,
+					hex.EncodeToString(o.data[:len(o.data)-1])+"["+name+"]")
+				continue
+			}
+		}
+		strs = append(strs, hex.EncodeToString(o.data))
+	}
+	if err != nil {
+		strs = append(strs, "[error]")
+	}
+	return strings.Join(strs, " ")
+}
+
+func opName(code byte) string {
+	if n := smallInt(code); n >= 0 {
+		return strconv.Itoa(n)
+	}
+	if name, ok := opNames[code]; ok {
+		return name
+	}
+	return "OP_UNKNOWN"
+}
+
+var opNames = map[byte]string{
+	opPUSHDATA1: "OP_PUSHDATA1",
+	opPUSHDATA2: "OP_PUSHDATA2",
+	opPUSHDATA4: "OP_PUSHDATA4",
+	op1NEGATE:   "-1",
+	opRESERVED:  "OP_RESERVED",
+
+	0x61: "OP_NOP",
+	0x62: "OP_VER",
+	0x63: "OP_IF",
+	0x64: "OP_NOTIF",
+	0x65: "OP_VERIF",
+	0x66: "OP_VERNOTIF",
+	0x67: "OP_ELSE",
+	0x68: "OP_ENDIF",
+	0x69: "OP_VERIFY",
+	0x6a: "OP_RETURN",
+	0x6b: "OP_TOALTSTACK",
+	0x6c: "OP_FROMALTSTACK",
+	0x6d: "OP_2DROP",
+	0x6e: "OP_2DUP",
+	0x6f: "OP_3DUP",
+	0x70: "OP_2OVER",
+	0x71: "OP_2ROT",
+	0x72: "OP_2SWAP",
+	0x73: "OP_IFDUP",
+	0x74: "OP_DEPTH",
+	0x75: "OP_DROP",
+	0x76: "OP_DUP",
+	0x77: "OP_NIP",
+	0x78: "OP_OVER",
+	0x79: "OP_PICK",
+	0x7a: "OP_ROLL",
+	0x7b: "OP_ROT",
+	0x7c: "OP_SWAP",
+	0x7d: "OP_TUCK",
+	0x7e: "OP_CAT",
+	0x7f: "OP_SUBSTR",
+	0x80: "OP_LEFT",
+	0x81: "OP_RIGHT",
+	0x82: "OP_SIZE",
+	0x83: "OP_INVERT",
+	0x84: "OP_AND",
+	0x85: "OP_OR",
+	0x86: "OP_XOR",
+	0x87: "OP_EQUAL",
+	0x88: "OP_EQUALVERIFY",
+	0x89: "OP_RESERVED1",
+	0x8a: "OP_RESERVED2",
+	0x8b: "OP_1ADD",
+	0x8c: "OP_1SUB",
+	0x8d: "OP_2MUL",
+	0x8e: "OP_2DIV",
+	0x8f: "OP_NEGATE",
+	0x90: "OP_ABS",
+	0x91: "OP_NOT",
+	0x92: "OP_0NOTEQUAL",
+	0x93: "OP_ADD",
+	0x94: "OP_SUB",
+	0x95: "OP_MUL",
+	0x96: "OP_DIV",
+	0x97: "OP_MOD",
+	0x98: "OP_LSHIFT",
+	0x99: "OP_RSHIFT",
+	0x9a: "OP_BOOLAND",
+	0x9b: "OP_BOOLOR",
+	0x9c: "OP_NUMEQUAL",
+	0x9d: "OP_NUMEQUALVERIFY",
+	0x9e: "OP_NUMNOTEQUAL",
+	0x9f: "OP_LESSTHAN",
+	0xa0: "OP_GREATERTHAN",
+	0xa1: "OP_LESSTHANOREQUAL",
+	0xa2: "OP_GREATERTHANOREQUAL",
+	0xa3: "OP_MIN",
+	0xa4: "OP_MAX",
+	0xa5: "OP_WITHIN",
+	0xa6: "OP_RIPEMD160",
+	0xa7: "OP_SHA1",
+	0xa8: "OP_SHA256",
+	0xa9: "OP_HASH160",
+	0xaa: "OP_HASH256",
+	0xab: "OP_CODESEPARATOR",
+	0xac: "OP_CHECKSIG",
+	0xad: "OP_CHECKSIGVERIFY",
+	0xae: "OP_CHECKMULTISIG",
+	0xaf: "OP_CHECKMULTISIGVERIFY",
+	0xb0: "OP_NOP1",
+	0xb1: "OP_CHECKLOCKTIMEVERIFY",
+	0xb2: "OP_CHECKSEQUENCEVERIFY",
+	0xb3: "OP_NOP4",
+	0xb4: "OP_NOP5",
+	0xb5: "OP_NOP6",
+	0xb6: "OP_NOP7",
+	0xb7: "OP_NOP8",
+	0xb8: "OP_NOP9",
+	0xb9: "OP_NOP10",
+	0xba: "OP_CHECKSIGADD",
+}
+
+//p2pkhScript returns P2PKH scriptPubKey of 20 bytes hash.
+func p2pkhScript(hash160 []byte) []byte {
+	script := make([]byte, 0, len(hash160)+5)
+	script = append(script, opDUP, opHASH160, byte(len(hash160)))
+	script = append(script, hash160...)
+	return append(script, opEQUALVERIFY, opCHECKSIG)
+}
+
+//p2shScript returns P2SH scriptPubKey of 20 bytes hash.
+func p2shScript(hash160 []byte) []byte {
+	script := make([]byte, 0, len(hash160)+3)
+	script = append(script, opHASH160, byte(len(hash160)))
+	script = append(script, hash160...)
+	return append(script, opEQUAL)
+}
+
+//isUnspendable returns true if outputs with script can never be spent,
+//i.e. it starts with OP_RETURN or is longer than 10000 bytes.
+func isUnspendable(script []byte) bool {
+	return (len(script) > 0 && script[0] == opRETURN) || len(script) > 10000
+}
+
+//witnessScript returns scriptPubKey of witness program.
+func witnessScript(version byte, program []byte) []byte {
+	script := make([]byte, 0, len(program)+2)
+	if version == 0 {
+		script = append(script, op0)
+	} else {
+		script = append(script, op1+version-1)
+	}
+	script = append(script, byte(len(program)))
+	return append(script, program...)
+}
+
+//Types of scriptPubKey, in the same names as bitcoind.
+const (
+	ScriptNonStandard         = "nonstandard"
+	ScriptPubKey              = "pubkey"
+	ScriptPubKeyHash          = "pubkeyhash"
+	ScriptScriptHash          = "scripthash"
+	ScriptMultisig            = "multisig"
+	ScriptNullData            = "nulldata"
+	ScriptWitnessV0KeyHash    = "witness_v0_keyhash"
+	ScriptWitnessV0ScriptHash = "witness_v0_scripthash"
+	ScriptWitnessV1Taproot    = "witness_v1_taproot"
+	ScriptWitnessUnknown      = "witness_unknown"
+)
+
+//witnessProgram returns version and program if script is a witness program.
+func witnessProgram(script []byte) (byte, []byte, bool) {
+	if len(script) < 4 || len(script) > 42 {
+		return 0, nil, false
+	}
+	if script[0] != op0 && (script[0] < op1 || script[0] > op16) {
+		return 0, nil, false
+	}
+	if int(script[1])+2 != len(script) {
+		return 0, nil, false
+	}
+	return byte(smallInt(script[0])), script[2:], true
+}
+
+//ScriptType returns the type of scriptPubKey.
+func ScriptType(script []byte) string {
+	if v, prog, ok := witnessProgram(script); ok {
+		switch {
+		case v == 0 && len(prog) == 20:
+			return ScriptWitnessV0KeyHash
+		case v == 0 && len(prog) == 32:
+			return ScriptWitnessV0ScriptHash
+		case v == 0:
+			return ScriptNonStandard
+		case v == 1 && len(prog) == 32:
+			return ScriptWitnessV1Taproot
+		}
+		return ScriptWitnessUnknown
+	}
+	if len(script) == 23 && script[0] == opHASH160 && script[1] == 20 &&
+		script[22] == opEQUAL {
+		return ScriptScriptHash
+	}
+	if len(script) == 25 && script[0] == opDUP && script[1] == opHASH160 &&
+		script[2] == 20 && script[23] == opEQUALVERIFY && script[24] == opCHECKSIG {
+		return ScriptPubKeyHash
+	}
+	if len(script) > 0 && script[0] == opRETURN && isPushOnly(script[1:]) {
+		return ScriptNullData
+	}
+	ops, err := parseScript(script)
+	if err != nil {
+		return ScriptNonStandard
+	}
+	if len(ops) == 2 && ops[1].code == opCHECKSIG && isPubKey(ops[0].data) {
+		return ScriptPubKey
+	}
+	if len(ops) >= 4 && ops[len(ops)-1].code == opCHECKMULTISIG {
+		m := smallInt(ops[0].code)
+		n := smallInt(ops[len(ops)-2].code)
+		if m < 1 || n < m || n != len(ops)-3 {
+			return ScriptNonStandard
+		}
+		for _, o := range ops[1 : len(ops)-2] {
+			if !isPubKey(o.data) {
+				return ScriptNonStandard
+			}
+		}
+		return ScriptMultisig
+	}
+	return ScriptNonStandard
+}
+
+//isPubKey returns true if b looks like a serialized public key.
+func isPubKey(b []byte) bool {
+	switch len(b) {
+	case 33:
+		return b[0] == 0x02 || b[0] == 0x03
+	case 65:
+		return b[0] == 0x04
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/bitgoin/address"
+)
+
+var (
+	//curveOrder is the order of secp256k1.
+	curveOrder, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", 16)
+	//halfOrder is the maximum S of low S signatures.
+	halfOrder = new(big.Int).Rsh(curveOrder, 1)
+)
+
+//parseDER returns R and S of sig without hashtype, or an error if sig is not
+//strict DER defined in BIP66.
+func parseDER(sig []byte) (*big.Int, *big.Int, error) {
+	if len(sig) < 8 || len(sig) > 72 {
+		return nil, nil, fmt.Errorf("illegal length %d of sign", len(sig))
+	}
+	if sig[0] != 0x30 {
+		return nil, nil, errors.New("sign is not DER sequence")
+	}
+	if int(sig[1]) != len(sig)-2 {
+		return nil, nil, errors.New("illegal length in DER sequence")
+	}
+	lenR := int(sig[3])
+	if 5+lenR >= len(sig) {
+		return nil, nil, errors.New("R of sign is too long")
+	}
+	lenS := int(sig[5+lenR])
+	if lenR+lenS+6 != len(sig) {
+		return nil, nil, errors.New("illegal length of S in sign")
+	}
+	if err := checkDERInt(sig[2], sig[4:4+lenR]); err != nil {
+		return nil, nil, fmt.Errorf("R of sign %s", err)
+	}
+	if err := checkDERInt(sig[4+lenR], sig[6+lenR:]); err != nil {
+		return nil, nil, fmt.Errorf("S of sign %s", err)
+	}
+	return new(big.Int).SetBytes(sig[4 : 4+lenR]), new(big.Int).SetBytes(sig[6+lenR:]), nil
+}
+
+//checkDERInt returns an error if the DER integer with tag and value is not strict.
+func checkDERInt(tag byte, v []byte) error {
+	switch {
+	case tag != 0x02:
+		return errors.New("is not DER integer")
+	case len(v) == 0:
+		return errors.New("is empty")
+	case v[0]&0x80 != 0:
+		return errors.New("is negative")
+	case len(v) > 1 && v[0] == 0x00 && v[1]&0x80 == 0:
+		return errors.New("has excessive padding")
+	}
+	return nil
+}
+
+//isStrictDER returns true if sig with a hashtype byte is encoded
+//in strict DER defined in BIP66.
+func isStrictDER(sig []byte) bool {
+	if len(sig) == 0 {
+		return false
+	}
+	_, _, err := parseDER(sig[:len(sig)-1])
+	return err == nil
+}
+
+//checkSig returns an error if sig without hashtype is not strict DER or
+//its S is not low (BIP62, BIP146).
+func checkSig(sig []byte) error {
+	_, s, err := parseDER(sig)
+	if err != nil {
+		return err
+	}
+	if s.Cmp(halfOrder) > 0 {
+		return errors.New("S of sign is not low")
+	}
+	return nil
+}
+
+//checkSigHashAll returns an error if sig with hashtype is not valid by checkSig
+//or hashtype is not SIGHASH_ALL.
+func checkSigHashAll(sig []byte) error {
+	if len(sig) == 0 {
+		return errors.New("sign is empty")
+	}
+	if t := sig[len(sig)-1]; t != sigHashAll {
+		return fmt.Errorf("hashtype 0x%02x of sign is not SIGHASH_ALL", t)
+	}
+	return checkSig(sig[:len(sig)-1])
+}
+
+//derInt returns the minimal DER integer of n.
+func derInt(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) == 0 || b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return append([]byte{0x02, byte(len(b))}, b...)
+}
+
+//normalizeSig returns strict DER sig without hashtype whose S is low.
+func normalizeSig(sig []byte) ([]byte, error) {
+	r, s, err := parseDER(sig)
+	if err != nil {
+		return nil, err
+	}
+	if s.Cmp(halfOrder) > 0 {
+		s = new(big.Int).Sub(curveOrder, s)
+	}
+	ri, si := derInt(r), derInt(s)
+	der := append([]byte{0x30, byte(len(ri) + len(si))}, ri...)
+	return append(der, si...), nil
+}
+
+//signHash signs hash with key, and returns strict DER sign with low S.
+func signHash(key *address.PrivateKey, hash []byte) ([]byte, error) {
+	sig, err := key.Sign(hash)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeSig(sig)
+}
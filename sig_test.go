@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+)
+
+//testHighS returns sig whose S is replaced with N-S.
+func testHighS(t *testing.T, sig []byte) []byte {
+	r, s, err := parseDER(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ri, si := derInt(r), derInt(new(big.Int).Sub(curveOrder, s))
+	return append(append([]byte{0x30, byte(len(ri) + len(si))}, ri...), si...)
+}
+
+func TestLowS(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	h := hash([]byte("low s"))
+	sig, err := signHash(keys[0], h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkSig(sig); err != nil {
+		t.Fatal(err)
+	}
+	high := testHighS(t, sig)
+	if err = keys[0].PublicKey.Verify(high, h); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkSig(high); err == nil || !strings.Contains(err.Error(), "not low") {
+		t.Error("must be error for high S", err)
+	}
+	low, err := normalizeSig(high)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(low) != string(sig) {
+		t.Error("illegal normalized sign")
+	}
+
+	if err = checkSigHashAll(append(sig, 0x81)); err == nil || !strings.Contains(err.Error(), "hashtype") {
+		t.Error("must be error for hashtype", err)
+	}
+	if err = checkSigHashAll(append(sig, sigHashAll)); err != nil {
+		t.Error(err)
+	}
+	for _, c := range []struct {
+		mod func([]byte) []byte
+		msg string
+	}{
+		{func(b []byte) []byte { return b[:7] }, "length"},
+		{func(b []byte) []byte { b[0] = 0x31; return b }, "sequence"},
+		{func(b []byte) []byte { b[1]++; return b }, "length in DER"},
+		{func(b []byte) []byte { b[2] = 0x03; return b }, "R of sign is not DER integer"},
+		{func(b []byte) []byte { b[4] |= 0x80; return b }, "R of sign is negative"},
+		{func(b []byte) []byte {
+			//pad S with extra zero.
+			l := int(b[3])
+			s := append([]byte{0x02, b[5+l] + 1, 0}, b[6+l:]...)
+			b = append(b[:4+l], s...)
+			b[1]++
+			return b
+		}, "S of sign has excessive padding"},
+	} {
+		b := c.mod(append([]byte{}, sig...))
+		if err = checkSig(b); err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("must be error with %q, got %v", c.msg, err)
+		}
+	}
+
+	//embedSigns and SignRefund refuse high S.
+	payer, payee := testChannel(t, keys[0], keys[1], 2*Unit, 100)
+	refund := payer.Refund()
+	sign, err := payee.SignRefund(refund, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = payer.SignRefund(refund, testHighS(t, sign)); err == nil || !strings.Contains(err.Error(), "not low") {
+		t.Error("must be error for high S", err)
+	}
+	rh, err := refund.sigHash(0, payer.redeemScript())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mysign, err := signHash(keys[0], rh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = payer.embedSigns(refund, 0, [][]byte{testHighS(t, mysign), sign})
+	if err == nil || err.Error() != "S of sign is not low at 0" {
+		t.Error("must be error for high S", err)
+	}
+}
@@ -0,0 +1,362 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+//errSplicing is returned while splice is in progress.
+var errSplicing = errors.New("splice is in progress")
+
+//errSpliceMalleable is returned if the bond is not segwit.
+var errSpliceMalleable = errors.New("bond must be segwit, otherwise txid of splice can be malleated")
+
+//splice is a splice of channel in progress.
+type splice struct {
+	tx      *Tx
+	info    *PubInfo
+	builder *Builder
+	refund  *Tx
+}
+
+//sameSkeleton returns true if a and b are same except scriptSigs and witnesses.
+func sameSkeleton(a, b *Tx) bool {
+	if a.Version != b.Version || a.Locktime != b.Locktime ||
+		len(a.TxIn) != len(b.TxIn) || len(a.TxOut) != len(b.TxOut) {
+		return false
+	}
+	for i, in := range a.TxIn {
+		in2 := b.TxIn[i]
+		if !bytes.Equal(in.Hash, in2.Hash) || in.Index != in2.Index || in.Seq != in2.Seq {
+			return false
+		}
+	}
+	for i, out := range a.TxOut {
+		out2 := b.TxOut[i]
+		if out.Value != out2.Value || !bytes.Equal(out.Script, out2.Script) {
+			return false
+		}
+	}
+	return true
+}
+
+//Splice returns splice tx without signs, which spends the bond and coins to
+//new bond of amount, pays the paid amount to payee, and pays change to ref.
+//The bond must be segwit and coins must be P2WPKH, so that txid of splice is fixed
+//before it is signed.
+//Payments are stopped until the splice is finished or aborted.
+func (m *MicroPayer) Splice(amount, fee uint64, coins UTXOs, ref string) (*Tx, error) {
+	if m.closed != nil {
+		return nil, ErrChannelClosed
+	}
+	if m.splice != nil {
+		return nil, errSplicing
+	}
+	if !m.Witness {
+		return nil, errSpliceMalleable
+	}
+	if err := checkWitnessCoins(coins); err != nil {
+		return nil, err
+	}
+	info := &PubInfo{
+		Pubs:    m.Pubs,
+		Amount:  amount,
+		Fee:     m.Fee,
+		M:       m.M,
+		Net:     m.Net,
+		Sorted:  m.Sorted,
+		Witness: true,
+	}
+	sends := []*Send{
+		&Send{
+			Script: info.redeemHash(),
+			Amount: amount,
+		},
+	}
+	if m.amount > 0 {
+		sends = append(sends, &Send{
+			Addr:   m.Pubs[1].Address(),
+			Amount: m.amount,
+		})
+	}
+	sends = append(sends, &Send{
+		Addr:   ref,
+		Change: true,
+	})
+	b := &Builder{
+		Multisigs: []*PubInfo{m.PubInfo},
+		Coins:     coins,
+		Sends:     sends,
+		Fee:       fee,
+		Net:       m.Net,
+	}
+	tx, err := b.Tx()
+	if err != nil {
+		return nil, err
+	}
+	m.splice = &splice{
+		tx:      tx,
+		info:    info,
+		builder: b,
+	}
+	return tx, nil
+}
+
+//SignSplice checks splice tx made by payer and signs its txin which spends the bond.
+//Payments are stopped until the splice is finished or aborted, and the splice
+//is persisted to the store.
+func (m *MicroPayee) SignSplice(tx *Tx) ([]byte, error) {
+	if (*mpay)(m).isClosed() {
+		return nil, ErrChannelClosed
+	}
+	if m.splice != nil {
+		return nil, errSplicing
+	}
+	if !m.Witness {
+		return nil, errSpliceMalleable
+	}
+	prev, err := m.Outpoint()
+	if err != nil {
+		return nil, err
+	}
+	if len(tx.TxIn) == 0 || !bytes.Equal(tx.TxIn[0].Hash, prev.Hash) || tx.TxIn[0].Index != prev.Index {
+		return nil, errors.New("splice doesn't spend the bond")
+	}
+	if len(tx.TxOut) == 0 || !bytes.Equal(tx.TxOut[0].Script, m.redeemHash()) {
+		return nil, errors.New("splice doesn't pay to new bond")
+	}
+	if m.amount > 0 {
+		script := p2pkhScript(m.Pubs[1].AddressBytes())
+		paid := false
+		for _, out := range tx.TxOut[1:] {
+			if bytes.Equal(out.Script, script) && out.Value >= m.amount {
+				paid = true
+				break
+			}
+		}
+		if !paid {
+			return nil, fmt.Errorf("splice doesn't pay %d to payee", m.amount)
+		}
+	}
+	h, err := m.PubInfo.sigHash(tx, 0)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := signHash(m.priv, h)
+	if err != nil {
+		return nil, err
+	}
+	m.splice = &splice{
+		tx:   tx,
+		info: (*mpay)(m).spliceInfo(tx),
+	}
+	if err = m.persist(); err != nil {
+		m.splice = nil
+		return nil, err
+	}
+	return sign, nil
+}
+
+//spliceInfo returns PubInfo of new bond in splice tx.
+func (m *mpay) spliceInfo(tx *Tx) *PubInfo {
+	return &PubInfo{
+		Pubs:    m.Pubs,
+		Amount:  tx.TxOut[0].Value,
+		Fee:     m.Fee,
+		M:       m.M,
+		Net:     m.Net,
+		Sorted:  m.Sorted,
+		Witness: true,
+	}
+}
+
+//SpliceRefund fills splice tx with sign of payee and returns refund tx of new bond.
+//Splice tx must not be broadcasted until FinishSplice.
+func (m *MicroPayer) SpliceRefund(sign []byte, locktime uint32) (*Tx, error) {
+	s := m.splice
+	if s == nil {
+		return nil, errors.New("splice is not started")
+	}
+	if s.builder == nil {
+		return nil, errors.New("coins of splice are lost, abort it")
+	}
+	mysign, err := s.builder.SignMultisig(s.tx, 0, m.priv)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.builder.FillMultisig(s.tx, 0, [][]byte{mysign, sign}); err != nil {
+		return nil, err
+	}
+	if err = s.builder.FillP2PK(s.tx); err != nil {
+		return nil, err
+	}
+	if err = checkMalleability(s.tx); err != nil {
+		return nil, fmt.Errorf("illegal splice: %s", err)
+	}
+	s.info.bond = s.tx
+	sends, err := s.info.sendstruct(0)
+	if err != nil {
+		return nil, err
+	}
+	if s.refund, err = s.info.txForSign(locktime, sends...); err != nil {
+		return nil, err
+	}
+	return s.refund, nil
+}
+
+//SignSpliceRefund checks splice tx signed by both and signs refund tx of new bond.
+//Splice tx must spend only segwit outputs, so that its txid cannot be malleated.
+func (m *MicroPayee) SignSpliceRefund(tx, refund *Tx, locktime uint32) ([]byte, error) {
+	s := m.splice
+	if s == nil {
+		return nil, errors.New("splice is not signed")
+	}
+	if !sameSkeleton(s.tx, tx) {
+		return nil, errors.New("splice tx is changed")
+	}
+	if err := checkMalleability(tx); err != nil {
+		return nil, fmt.Errorf("illegal splice: %s", err)
+	}
+	if len(refund.TxIn) != 1 || !bytes.Equal(refund.TxIn[0].Hash, tx.Hash()) {
+		return nil, errors.New("refund doesn't spend new bond")
+	}
+	p := &MicroPayee{
+		PubInfo: s.info,
+		priv:    m.priv,
+	}
+	sign, err := p.SignRefund(refund, locktime)
+	if err != nil {
+		return nil, err
+	}
+	old := *s
+	s.tx = tx
+	s.info.bond = tx
+	s.refund = refund
+	if err = m.persist(); err != nil {
+		*s = old
+		return nil, err
+	}
+	return sign, nil
+}
+
+//FinishSplice signs refund of new bond with sign of payee, and switches to new bond.
+//It returns splice tx to be broadcasted.
+func (m *MicroPayer) FinishSplice(sign []byte) (*Tx, error) {
+	s := m.splice
+	if s == nil || s.refund == nil {
+		return nil, errors.New("refund of splice is not made")
+	}
+	p := &MicroPayer{
+		PubInfo: s.info,
+		priv:    m.priv,
+	}
+	if err := p.SignRefund(s.refund, sign); err != nil {
+		return nil, err
+	}
+	m.PubInfo = s.info
+	m.refund = s.refund
+	m.amount = 0
+	m.splice = nil
+	return s.tx, nil
+}
+
+//FinishSplice switches to new bond after splice tx is broadcasted.
+//New state is persisted to the store as a new channel.
+func (m *MicroPayee) FinishSplice() error {
+	s := m.splice
+	if s == nil || s.refund == nil {
+		return errors.New("refund of splice is not signed")
+	}
+	old := *m
+	m.PubInfo = s.info
+	m.refund = s.refund
+	m.amount = 0
+	m.sign = nil
+	m.saved = nil
+	m.splice = nil
+	if err := m.persist(); err != nil {
+		*m = old
+		return err
+	}
+	return nil
+}
+
+//AbortSplice aborts the splice. Splice tx signed by payee must not be broadcasted
+//after that, or payments by the old bond are lost.
+func (m *MicroPayer) AbortSplice() error {
+	if m.splice == nil {
+		return errors.New("splice is not started")
+	}
+	m.splice = nil
+	return nil
+}
+
+//AbortSplice aborts the splice, and closes the channel because payer can still
+//broadcast splice tx signed by payee. It returns the latest incremented tx to be
+//broadcasted, which conflicts with the splice. If nothing is paid, it returns nil
+//and the channel refuses payments, so that payee can just forget the channel.
+func (m *MicroPayee) AbortSplice() (*Tx, error) {
+	s := m.splice
+	if s == nil {
+		return nil, errors.New("splice is not started")
+	}
+	if m.sign == nil {
+		m.splice = nil
+		m.aborted = true
+		if err := m.persist(); err != nil {
+			m.splice = s
+			m.aborted = false
+			return nil, err
+		}
+		return nil, nil
+	}
+	sends, err := m.sendstruct(m.amount)
+	if err != nil {
+		return nil, err
+	}
+	mysign, err := m.SignMultisig(m.priv, 0, sends...)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := m.SpendBondTx(0, [][]byte{m.sign, mysign}, sends...)
+	if err != nil {
+		return nil, err
+	}
+	m.closed = tx
+	m.splice = nil
+	if err = m.persist(); err != nil {
+		m.closed = nil
+		m.splice = s
+		return nil, err
+	}
+	return tx, nil
+}
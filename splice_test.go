@@ -0,0 +1,261 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bitgoin/address"
+)
+
+//testWitnessChannel returns payer and payee of P2WSH bond, where 20000 is paid.
+func testWitnessChannel(t *testing.T, payerKey, payeeKey *address.PrivateKey) (*MicroPayer, *MicroPayee) {
+	payer, payee := testWitnessBond(t, payerKey, payeeKey)
+	sign, err := payer.SignIncremented(20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = payee.IncrementedTx(20000, sign); err != nil {
+		t.Fatal(err)
+	}
+	return payer, payee
+}
+
+//testWitnessBond opens a channel with P2WSH bond without payments.
+func testWitnessBond(t *testing.T, payerKey, payeeKey *address.PrivateKey) (*MicroPayer, *MicroPayee) {
+	payer := NewMicroPayer(payerKey, payeeKey.PublicKey, Unit, 0.001*Unit)
+	payee := NewMicroPayee(payerKey.PublicKey, payeeKey, Unit, 0.001*Unit)
+	payer.Witness = true
+	payee.Witness = true
+	bond, refund, err := payer.CreateBond(100, testSegwitCoins(t, payerKey, 2*Unit), payerKey.PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign, err := payee.SignRefund(refund, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = payer.SignRefund(refund, sign); err != nil {
+		t.Fatal(err)
+	}
+	if len(payer.Refund().TxIn[0].Script) != 0 || len(payer.Refund().TxIn[0].Witness) != 4 {
+		t.Error("refund must be signed by witness")
+	}
+	if err = payee.CheckBond(refund, bond); err != nil {
+		t.Fatal(err)
+	}
+	return payer, payee
+}
+
+func TestSplice(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	p2sh, _ := testChannel(t, keys[0], keys[1], 2*Unit, 100)
+	coins := testSegwitCoins(t, keys[0], 3*Unit)
+	coins[0].TxHash = bytes.Repeat([]byte{0xff}, 32)
+	if _, err := p2sh.Splice(2*Unit, 1000, coins, keys[0].PublicKey.Address()); err == nil {
+		t.Error("must be error for P2SH bond")
+	}
+	payer, payee := testWitnessChannel(t, keys[0], keys[1])
+	if _, err := payer.Splice(2*Unit, 1000, testCoins(t, keys[0], 3*Unit), keys[0].PublicKey.Address()); err == nil {
+		t.Error("must be error for P2PKH coins")
+	}
+
+	tx, err := payer.Splice(2*Unit, 1000, coins, keys[0].PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.TxIn) != 2 || len(tx.TxOut) != 3 {
+		t.Fatal("illegal splice tx")
+	}
+	if tx.TxOut[0].Value != 2*Unit || tx.TxOut[1].Value != 20000 ||
+		tx.TxOut[2].Value != Unit+3*Unit-2*Unit-20000-1000 {
+		t.Error("illegal outputs of splice tx")
+	}
+	if _, err = payer.SignIncremented(30000); err == nil {
+		t.Error("must be error while splicing")
+	}
+	sign, err := payee.SignSplice(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//splice is persisted.
+	b, err := payee.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payee, err = LoadMicroPayee(b, keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	if payee.splice == nil || !sameSkeleton(payee.splice.tx, tx) {
+		t.Fatal("splice must be loaded")
+	}
+	refund, err := payer.SpliceRefund(sign, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.TxIn[0].Witness) == 0 || len(tx.TxIn[1].Witness) == 0 {
+		t.Error("splice tx must be signed by witness")
+	}
+
+	ill := *tx
+	ill.TxOut = append([]*TxOut{}, tx.TxOut...)
+	ill.TxOut[1] = &TxOut{Value: 10000, Script: tx.TxOut[1].Script}
+	if _, err = payee.SignSpliceRefund(&ill, refund, 200); err == nil {
+		t.Error("must be error for changed splice tx")
+	}
+	if _, err = payee.SignSpliceRefund(tx, refund, 100); err == nil {
+		t.Error("must be error for illegal locktime")
+	}
+	mal := *tx
+	mal.TxIn = append([]*TxIn{}, tx.TxIn...)
+	mal.TxIn[1] = &TxIn{Hash: tx.TxIn[1].Hash, Index: tx.TxIn[1].Index, Script: []byte{0}, Seq: tx.TxIn[1].Seq}
+	if _, err = payee.SignSpliceRefund(&mal, refund, 200); err == nil {
+		t.Error("must be error for malleable splice tx")
+	}
+	noin := *refund
+	noin.TxIn = nil
+	if _, err = payee.SignSpliceRefund(tx, &noin, 200); err == nil {
+		t.Error("must be error for refund without txin")
+	}
+	sign, err = payee.SignSpliceRefund(tx, refund, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err = payee.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if payee, err = LoadMicroPayee(b, keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	if payee.splice == nil || payee.splice.refund == nil {
+		t.Fatal("refund of splice must be loaded")
+	}
+	stx, err := payer.FinishSplice(sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = payee.FinishSplice(); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := payer.ChannelID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := payee.ChannelID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != id2 || !bytes.Equal(payer.Refund().TxIn[0].Hash, stx.Hash()) {
+		t.Error("channel must be on splice tx", id, id2)
+	}
+	if payee.Amount != 2*Unit {
+		t.Error("illegal amount of new bond", payee.Amount)
+	}
+	if sign, err = payer.SignIncremented(5000); err != nil {
+		t.Fatal(err)
+	}
+	itx, err := payee.IncrementedTx(5000, sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(itx.TxIn[0].Hash, stx.Hash()) || itx.TxOut[1].Value != 5000 {
+		t.Error("illegal incremented tx of new bond")
+	}
+}
+
+func TestAbortSplice(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	payer, payee := testWitnessChannel(t, keys[0], keys[1])
+	if _, err := payee.AbortSplice(); err == nil {
+		t.Error("must be error if not splicing")
+	}
+	tx, err := payer.Splice(2*Unit, 1000, testSegwitCoins(t, keys[0], 3*Unit), keys[0].PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = payee.SignSplice(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = payer.AbortSplice(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = payer.SignIncremented(30000); err != nil {
+		t.Fatal(err)
+	}
+	itx, err := payee.AbortSplice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if itx == nil || itx.TxOut[1].Value != 20000 || !bytes.Equal(itx.TxIn[0].Hash, tx.TxIn[0].Hash) {
+		t.Fatal("must return the latest incremented tx")
+	}
+	if payee.Closed() != itx {
+		t.Error("channel must be closed")
+	}
+	if _, err = payee.SignSplice(tx); err != ErrChannelClosed {
+		t.Error("must be closed", err)
+	}
+
+	//nothing is paid.
+	payer, payee = testWitnessBond(t, keys[0], keys[1])
+	if err = payee.SetStore(NewMemoryStore()); err != nil {
+		t.Fatal(err)
+	}
+	if tx, err = payer.Splice(2*Unit, 1000, testSegwitCoins(t, keys[0], 3*Unit), keys[0].PublicKey.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = payee.SignSplice(tx); err != nil {
+		t.Fatal(err)
+	}
+	if itx, err = payee.AbortSplice(); err != nil || itx != nil {
+		t.Fatal("must abort without tx", itx, err)
+	}
+	b, err := payee.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payee, err = LoadMicroPayee(b, keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	if payee.splice != nil {
+		t.Error("splice must be cleared")
+	}
+	if err = payer.AbortSplice(); err != nil {
+		t.Fatal(err)
+	}
+	sign, err := payer.SignIncremented(10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = payee.IncrementedTx(10000, sign); err != ErrChannelClosed {
+		t.Error("aborted channel must refuse payments", err)
+	}
+}
@@ -0,0 +1,427 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/bitgoin/address"
+)
+
+//StateVersion is the version of saved PubInfo and channel state.
+const StateVersion = 1
+
+//knownParams are params of keys which can be loaded when Net is nil.
+var knownParams = []*address.Params{
+	address.BitcoinMain,
+	address.BitcoinTest,
+	address.MonacoinMain,
+	address.MonacoinTest,
+}
+
+//networks are networks which can be loaded by name.
+var networks = []*Network{MainNet, TestNet3, SigNet, RegTest}
+
+type outpointState struct {
+	TxID string `json:"txid"`
+	Vout uint32 `json:"vout"`
+}
+
+type pubInfoState struct {
+	Version  int            `json:"version"`
+	Net      string         `json:"net,omitempty"`
+	KeyID    byte           `json:"keyid"`
+	Pubs     []string       `json:"pubs"`
+	M        byte           `json:"m"`
+	Amount   uint64         `json:"amount"`
+	Fee      uint64         `json:"fee"`
+	Sorted   bool           `json:"sorted,omitempty"`
+	Witness  bool           `json:"witness,omitempty"`
+	Bond     string         `json:"bond,omitempty"`
+	Outpoint *outpointState `json:"outpoint,omitempty"`
+}
+
+type spliceState struct {
+	Tx     string `json:"tx"`
+	Refund string `json:"refund,omitempty"`
+}
+
+type channelState struct {
+	Version int           `json:"version"`
+	PubInfo *pubInfoState `json:"pubinfo"`
+	Refund  string        `json:"refund,omitempty"`
+	Amount  uint64        `json:"amount"`
+	Sign    string        `json:"sign,omitempty"`
+	Close   string        `json:"close,omitempty"`
+	Splice  *spliceState  `json:"splice,omitempty"`
+	Aborted bool          `json:"aborted,omitempty"`
+}
+
+//networkByName returns the network whose name is name.
+func networkByName(name string) (*Network, error) {
+	for _, n := range networks {
+		if n.Name == name {
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown network %s", name)
+}
+
+//keyParams returns params of keys whose P2PKH version is id.
+func keyParams(net *Network, id byte) (*address.Params, error) {
+	if net != nil {
+		if id != net.PubKeyHashID {
+			return nil, fmt.Errorf("keys are not for %s network", net.Name)
+		}
+		return net.Params, nil
+	}
+	for _, p := range knownParams {
+		if p.AddressHeader == id {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown version %d of keys", id)
+}
+
+func (p *PubInfo) state() (*pubInfoState, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	id, _, err := base58CheckDecode(p.Pubs[0].Address())
+	if err != nil {
+		return nil, err
+	}
+	s := &pubInfoState{
+		Version: StateVersion,
+		KeyID:   id,
+		Pubs:    make([]string, len(p.Pubs)),
+		M:       p.M,
+		Amount:  p.Amount,
+		Fee:     p.Fee,
+		Sorted:  p.Sorted,
+		Witness: p.Witness,
+	}
+	if p.Net != nil {
+		s.Net = p.Net.Name
+	}
+	for i, pub := range p.Pubs {
+		s.Pubs[i] = hex.EncodeToString(pub.Serialize())
+	}
+	if p.bond != nil {
+		b, err := p.bond.Pack()
+		if err != nil {
+			return nil, err
+		}
+		s.Bond = hex.EncodeToString(b)
+	}
+	if p.prev != nil {
+		s.Outpoint = &outpointState{
+			TxID: hex.EncodeToString(Reverse(p.prev.Hash)),
+			Vout: p.prev.Index,
+		}
+	}
+	return s, nil
+}
+
+func (s *pubInfoState) pubInfo() (*PubInfo, error) {
+	if s == nil {
+		return nil, errors.New("no PubInfo in state")
+	}
+	if s.Version != StateVersion {
+		return nil, fmt.Errorf("unsupported version %d of state", s.Version)
+	}
+	p := &PubInfo{
+		Pubs:    make([]*address.PublicKey, len(s.Pubs)),
+		M:       s.M,
+		Amount:  s.Amount,
+		Fee:     s.Fee,
+		Sorted:  s.Sorted,
+		Witness: s.Witness,
+	}
+	var err error
+	if s.Net != "" {
+		if p.Net, err = networkByName(s.Net); err != nil {
+			return nil, err
+		}
+	}
+	param, err := keyParams(p.Net, s.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	for i, pub := range s.Pubs {
+		b, err := hex.DecodeString(pub)
+		if err != nil {
+			return nil, fmt.Errorf("illegal key at %d: %s", i, err)
+		}
+		if p.Pubs[i], err = address.NewPublicKey(b, param); err != nil {
+			return nil, fmt.Errorf("illegal key at %d: %s", i, err)
+		}
+	}
+	if err = p.check(); err != nil {
+		return nil, err
+	}
+	if s.Bond != "" {
+		if p.bond, err = parseTxHex(s.Bond); err != nil {
+			return nil, fmt.Errorf("illegal bond: %s", err)
+		}
+		if _, err = p.searchTxout(); err != nil {
+			return nil, errors.New("bond doesn't pay to the redeem script")
+		}
+	}
+	if s.Outpoint != nil {
+		h, err := hex.DecodeString(s.Outpoint.TxID)
+		if err != nil {
+			return nil, fmt.Errorf("illegal outpoint: %s", err)
+		}
+		if err = p.SetOutpoint(Reverse(h), s.Outpoint.Vout, s.Amount); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func parseTxHex(s string) (*Tx, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTX(b)
+}
+
+//Save returns PubInfo with its bond in versioned JSON.
+func (p *PubInfo) Save() ([]byte, error) {
+	s, err := p.state()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(s)
+}
+
+//LoadPubInfo returns PubInfo saved by Save after validating it.
+func LoadPubInfo(b []byte) (*PubInfo, error) {
+	var s pubInfoState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return s.pubInfo()
+}
+
+//save returns channel state in versioned JSON. Private key is not saved.
+func (m *mpay) save() ([]byte, error) {
+	p, err := m.PubInfo.state()
+	if err != nil {
+		return nil, err
+	}
+	s := channelState{
+		Version: StateVersion,
+		PubInfo: p,
+		Amount:  m.amount,
+		Sign:    hex.EncodeToString(m.sign),
+	}
+	if m.refund != nil {
+		b, err := m.refund.Pack()
+		if err != nil {
+			return nil, err
+		}
+		s.Refund = hex.EncodeToString(b)
+	}
+	if m.closed != nil {
+		b, err := m.closed.Pack()
+		if err != nil {
+			return nil, err
+		}
+		s.Close = hex.EncodeToString(b)
+	}
+	if m.splice != nil {
+		if s.Splice, err = m.splice.state(); err != nil {
+			return nil, err
+		}
+	}
+	s.Aborted = m.aborted
+	return json.Marshal(&s)
+}
+
+func (s *splice) state() (*spliceState, error) {
+	b, err := s.tx.Pack()
+	if err != nil {
+		return nil, err
+	}
+	st := &spliceState{
+		Tx: hex.EncodeToString(b),
+	}
+	if s.refund != nil {
+		if b, err = s.refund.Pack(); err != nil {
+			return nil, err
+		}
+		st.Refund = hex.EncodeToString(b)
+	}
+	return st, nil
+}
+
+//loadSplice loads the splice in progress after checking it spends the bond.
+//Coins of payer are not saved, so payer must abort the splice if refund is not made.
+func (m *mpay) loadSplice(s *spliceState) error {
+	tx, err := parseTxHex(s.Tx)
+	if err != nil {
+		return fmt.Errorf("illegal splice: %s", err)
+	}
+	prev, err := m.Outpoint()
+	if err != nil {
+		return err
+	}
+	if len(tx.TxIn) == 0 || !bytes.Equal(tx.TxIn[0].Hash, prev.Hash) || tx.TxIn[0].Index != prev.Index {
+		return errors.New("splice doesn't spend the bond")
+	}
+	sp := &splice{
+		tx:   tx,
+		info: m.spliceInfo(tx),
+	}
+	if len(tx.TxOut) == 0 || !bytes.Equal(tx.TxOut[0].Script, sp.info.redeemHash()) {
+		return errors.New("splice doesn't pay to new bond")
+	}
+	if s.Refund != "" {
+		if sp.refund, err = parseTxHex(s.Refund); err != nil {
+			return fmt.Errorf("illegal refund of splice: %s", err)
+		}
+		if len(sp.refund.TxIn) != 1 || !bytes.Equal(sp.refund.TxIn[0].Hash, tx.Hash()) {
+			return errors.New("refund of splice doesn't spend new bond")
+		}
+		sp.info.bond = tx
+	}
+	m.splice = sp
+	return nil
+}
+
+//loadChannel loads channel state whose i-th key is of priv.
+func loadChannel(b []byte, priv *address.PrivateKey, i int) (*mpay, error) {
+	var s channelState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	if s.Version != StateVersion {
+		return nil, fmt.Errorf("unsupported version %d of state", s.Version)
+	}
+	p, err := s.PubInfo.pubInfo()
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Pubs) != 2 || p.M != 2 {
+		return nil, errors.New("channel must be 2 of 2 multisig")
+	}
+	if priv == nil || !bytes.Equal(priv.PublicKey.Serialize(), p.Pubs[i].Serialize()) {
+		return nil, errors.New("private key doesn't match the channel")
+	}
+	if s.Amount+p.Fee > p.Amount {
+		return nil, errors.New("incremented amount exceeds the bond")
+	}
+	m := &mpay{
+		PubInfo: p,
+		priv:    priv,
+		amount:  s.Amount,
+	}
+	if m.sign, err = hex.DecodeString(s.Sign); err != nil {
+		return nil, fmt.Errorf("illegal sign: %s", err)
+	}
+	if len(m.sign) == 0 {
+		m.sign = nil
+	}
+	if s.Refund != "" {
+		if m.refund, err = parseTxHex(s.Refund); err != nil {
+			return nil, fmt.Errorf("illegal refund: %s", err)
+		}
+		prev, err := p.Outpoint()
+		if err != nil {
+			return nil, err
+		}
+		if len(m.refund.TxIn) != 1 || !bytes.Equal(m.refund.TxIn[0].Hash, prev.Hash) ||
+			m.refund.TxIn[0].Index != prev.Index {
+			return nil, errors.New("refund doesn't spend the bond")
+		}
+	}
+	if s.Close != "" {
+		if m.closed, err = parseTxHex(s.Close); err != nil {
+			return nil, fmt.Errorf("illegal close tx: %s", err)
+		}
+	}
+	if s.Splice != nil {
+		if err = m.loadSplice(s.Splice); err != nil {
+			return nil, err
+		}
+	}
+	m.aborted = s.Aborted
+	return m, nil
+}
+
+//Save returns the channel state in versioned JSON. Private key is not saved.
+func (m *MicroPayer) Save() ([]byte, error) {
+	return (*mpay)(m).save()
+}
+
+//LoadMicroPayer returns MicroPayer saved by Save after validating it
+//with the private key of payer.
+func LoadMicroPayer(b []byte, payer *address.PrivateKey) (*MicroPayer, error) {
+	m, err := loadChannel(b, payer, 0)
+	if err != nil {
+		return nil, err
+	}
+	return (*MicroPayer)(m), nil
+}
+
+//Save returns the channel state in versioned JSON. Private key is not saved.
+func (m *MicroPayee) Save() ([]byte, error) {
+	return (*mpay)(m).save()
+}
+
+//LoadMicroPayee returns MicroPayee saved by Save after validating it
+//with the private key of payee, including the sign of payer.
+func LoadMicroPayee(b []byte, payee *address.PrivateKey) (*MicroPayee, error) {
+	m, err := loadChannel(b, payee, 1)
+	if err != nil {
+		return nil, err
+	}
+	if m.sign == nil {
+		return (*MicroPayee)(m), nil
+	}
+	sends, err := m.sendstruct(m.amount)
+	if err != nil {
+		return nil, err
+	}
+	mtx, err := m.txForSign(0, sends...)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.verify(mtx, 0, m.sign, 0); err != nil {
+		return nil, fmt.Errorf("illegal sign of payer: %s", err)
+	}
+	return (*MicroPayee)(m), nil
+}
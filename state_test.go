@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPubInfoSave(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:3])
+	for _, net := range []*Network{TestNet3, nil} {
+		pi := &PubInfo{
+			M:      2,
+			Fee:    0.001 * Unit,
+			Amount: Unit,
+			Net:    net,
+			Sorted: true,
+		}
+		for _, k := range keys {
+			pi.Pubs = append(pi.Pubs, k.PublicKey)
+		}
+		bond, err := pi.BondTx(testCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := pi.Save()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pi2, err := LoadPubInfo(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pi2.Net != net || !pi2.Sorted || pi2.M != 2 || pi2.Fee != pi.Fee || pi2.Amount != pi.Amount {
+			t.Error("illegal loaded PubInfo")
+		}
+		if !bytes.Equal(pi2.RedeemScript(), pi.RedeemScript()) {
+			t.Error("redeem scripts must be same")
+		}
+		if pi2.Pubs[1].Address() != keys[1].PublicKey.Address() {
+			t.Error("illegal address of loaded key")
+		}
+		prev, err := pi2.Outpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(prev.Hash, bond.Hash()) {
+			t.Error("illegal outpoint of loaded PubInfo")
+		}
+		if _, err = LoadPubInfo([]byte(strings.Replace(string(b), `"version":1`, `"version":2`, 1))); err == nil {
+			t.Error("must be error for unknown version")
+		}
+	}
+}
+
+func TestChannelSave(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	payer := NewMicroPayer(keys[0], keys[1].PublicKey, Unit, 0.001*Unit)
+	payee := NewMicroPayee(keys[0].PublicKey, keys[1], Unit, 0.001*Unit)
+	bond, refund, err := payer.CreateBond(100, testSegwitCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign, err := payee.SignRefund(refund, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = payer.SignRefund(refund, sign); err != nil {
+		t.Fatal(err)
+	}
+	if err = payee.CheckBond(refund, bond); err != nil {
+		t.Fatal(err)
+	}
+	signIP, err := payer.SignIncremented(0.01 * Unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := payee.IncrementedTx(0.01*Unit, signIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := payer.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte(multisigWIFs[0])) {
+		t.Error("private key must not be saved")
+	}
+	if _, err = LoadMicroPayer(b, keys[1]); err == nil {
+		t.Error("must be error for key of payee")
+	}
+	payer2, err := LoadMicroPayer(b, keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payer2.Refund().Hash(), refund.Hash()) {
+		t.Error("refunds must be same")
+	}
+	if _, err = payer2.SignIncremented(0.02 * Unit); err != nil {
+		t.Error(err)
+	}
+
+	b, err = payee.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payee2, err := LoadMicroPayee(b, keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx2, err := payee2.LastIncrementedTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tx.Hash(), tx2.Hash()) {
+		t.Error("incremented txs must be same")
+	}
+
+	payee.sign = sign
+	b, err = payee.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadMicroPayee(b, keys[1]); err == nil {
+		t.Error("must be error for illegal sign")
+	}
+}
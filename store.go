@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Errors of ChannelStore.
+var (
+	ErrChannelNotFound = errors.New("channel is not found")
+	ErrStateChanged    = errors.New("state of channel was changed")
+)
+
+//ChannelStore saves channel states, which are made by Save of MicroPayer or MicroPayee,
+//by channel ID.
+type ChannelStore interface {
+	//Get returns the state of channel id, or ErrChannelNotFound.
+	Get(id string) ([]byte, error)
+	//CompareAndSwap replaces the state of channel id with state atomically
+	//if the current one is old, or returns ErrStateChanged.
+	//If old is nil, the channel must not be saved yet.
+	CompareAndSwap(id string, old, state []byte) error
+	//Delete deletes the state of channel id.
+	Delete(id string) error
+}
+
+//ChannelID returns the ID of channel, which is "<txid of bond>:<vout>".
+func (p *PubInfo) ChannelID() (string, error) {
+	prev, err := p.Outpoint()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d", hex.EncodeToString(Reverse(prev.Hash)), prev.Index), nil
+}
+
+//checkChannelID returns an error if id is not in the form of ChannelID.
+func checkChannelID(id string) error {
+	i := strings.IndexByte(id, ':')
+	if i < 0 {
+		return fmt.Errorf("illegal channel id %s", id)
+	}
+	h, err := hex.DecodeString(id[:i])
+	if err != nil || len(h) != 32 {
+		return fmt.Errorf("illegal txid in channel id %s", id)
+	}
+	if _, err := strconv.ParseUint(id[i+1:], 10, 32); err != nil {
+		return fmt.Errorf("illegal vout in channel id %s", id)
+	}
+	return nil
+}
+
+//MemoryStore is ChannelStore on memory.
+type MemoryStore struct {
+	mutex  sync.Mutex
+	states map[string][]byte
+}
+
+//NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		states: make(map[string][]byte),
+	}
+}
+
+//Get returns the state of channel id.
+func (s *MemoryStore) Get(id string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, ok := s.states[id]
+	if !ok {
+		return nil, ErrChannelNotFound
+	}
+	return append([]byte{}, state...), nil
+}
+
+//CompareAndSwap replaces the state of channel id if the current one is old.
+func (s *MemoryStore) CompareAndSwap(id string, old, state []byte) error {
+	if err := checkChannelID(id); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cur, ok := s.states[id]
+	if ok != (old != nil) || !bytes.Equal(cur, old) {
+		return ErrStateChanged
+	}
+	s.states[id] = append([]byte{}, state...)
+	return nil
+}
+
+//Delete deletes the state of channel id.
+func (s *MemoryStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.states[id]; !ok {
+		return ErrChannelNotFound
+	}
+	delete(s.states, id)
+	return nil
+}
+
+//FileStore is ChannelStore which saves a state to a file per channel in a directory.
+//CompareAndSwap is atomic only among goroutines which share the FileStore.
+type FileStore struct {
+	mutex sync.Mutex
+	dir   string
+}
+
+//NewFileStore returns FileStore which saves states in dir, making it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{
+		dir: dir,
+	}, nil
+}
+
+func (s *FileStore) path(id string) (string, error) {
+	if err := checkChannelID(id); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, strings.Replace(id, ":", "_", 1)+".json"), nil
+}
+
+func (s *FileStore) get(id string) ([]byte, error) {
+	p, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	state, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, ErrChannelNotFound
+	}
+	return state, err
+}
+
+//Get returns the state of channel id.
+func (s *FileStore) Get(id string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.get(id)
+}
+
+//CompareAndSwap replaces the state of channel id if the current one is old.
+//The file is replaced by renaming a synced temporary file.
+func (s *FileStore) CompareAndSwap(id string, old, state []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cur, err := s.get(id)
+	switch {
+	case err == ErrChannelNotFound:
+		cur = nil
+	case err != nil:
+		return err
+	}
+	if (cur != nil) != (old != nil) || !bytes.Equal(cur, old) {
+		return ErrStateChanged
+	}
+	p, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(state)
+	if err == nil {
+		err = f.Sync()
+	}
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+//Delete deletes the state of channel id.
+func (s *FileStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return ErrChannelNotFound
+	}
+	return err
+}
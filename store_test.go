@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testStore(t *testing.T, s ChannelStore) {
+	id := "5c3ee51385106f819802482039250649c9fdc0dfe4156714382b9b831df6c212:1"
+	if _, err := s.Get(id); err != ErrChannelNotFound {
+		t.Error("must be ErrChannelNotFound", err)
+	}
+	if err := s.CompareAndSwap(id, []byte("a"), []byte("b")); err != ErrStateChanged {
+		t.Error("must be ErrStateChanged for new channel", err)
+	}
+	if err := s.CompareAndSwap(id, nil, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CompareAndSwap(id, nil, []byte("b")); err != ErrStateChanged {
+		t.Error("must be ErrStateChanged for existing channel", err)
+	}
+	if err := s.CompareAndSwap(id, []byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CompareAndSwap(id, []byte("a"), []byte("c")); err != ErrStateChanged {
+		t.Error("must be ErrStateChanged for old state", err)
+	}
+	state, err := s.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(state, []byte("b")) {
+		t.Error("illegal state", string(state))
+	}
+	if err = s.CompareAndSwap("../a:1", nil, []byte("a")); err == nil {
+		t.Error("must be error for illegal id")
+	}
+	if err = s.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get(id); err != ErrChannelNotFound {
+		t.Error("must be ErrChannelNotFound after delete", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "channels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+func TestPayeeStore(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	payer := NewMicroPayer(keys[0], keys[1].PublicKey, Unit, 0.001*Unit)
+	payee := NewMicroPayee(keys[0].PublicKey, keys[1], Unit, 0.001*Unit)
+	bond, refund, err := payer.CreateBond(100, testSegwitCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign, err := payee.SignRefund(refund, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = payer.SignRefund(refund, sign); err != nil {
+		t.Fatal(err)
+	}
+	if err = payee.CheckBond(refund, bond); err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	if err = payee.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	id, err := payee.ChannelID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var best *Tx
+	for _, amount := range []uint64{0.02 * Unit, 0.03 * Unit, 0.01 * Unit} {
+		signIP, err := payer.SignIncremented(amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := payee.IncrementedTx(amount, signIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if amount == 0.03*Unit {
+			best = tx
+		}
+	}
+	payee2, err := LoadMicroPayeeFrom(store, id, keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := payee2.LastIncrementedTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tx.Hash(), best.Hash()) {
+		t.Error("best incremented tx must be persisted")
+	}
+
+	//payee2 persists a new state, so payee has stale one.
+	signIP, err := payer.SignIncremented(0.04 * Unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = payee2.IncrementedTx(0.04*Unit, signIP); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = payee.IncrementedTx(0.04*Unit, signIP); err != ErrStateChanged {
+		t.Error("must be ErrStateChanged for stale payee", err)
+	}
+	if payee.amount != 0.03*Unit {
+		t.Error("state must not be changed when persisting fails")
+	}
+}
@@ -31,64 +31,384 @@ package tx
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"log"
-
-	"github.com/bitgoin/packer"
 )
 
 //TxIn is the info of input transaction.
 type TxIn struct {
-	Hash   []byte `len:"32"`
-	Index  uint32
-	Script []byte `len:"prefix"`
-	Seq    uint32
+	Hash    []byte
+	Index   uint32
+	Script  []byte
+	Seq     uint32
+	Witness [][]byte
 }
 
 //TxOut is the info of output transaction.
 type TxOut struct {
 	Value  uint64
-	Script []byte `len:"prefix"`
+	Script []byte
+}
+
+//Outpoint points an output of a tx.
+type Outpoint struct {
+	Hash  []byte
+	Index uint32
 }
 
 //Tx describes a bitcoin transaction,
 type Tx struct {
 	Version  uint32
-	TxIn     []*TxIn  `len:"prefix"`
-	TxOut    []*TxOut `len:"prefix"`
+	TxIn     []*TxIn
+	TxOut    []*TxOut
 	Locktime uint32
 }
 
-func hash(b interface{}) []byte {
-	var buf bytes.Buffer
-	if err := packer.Pack(&buf, b); err != nil {
-		log.Fatal(err)
-	}
-	bs := buf.Bytes()
-	h := sha256.Sum256(bs)
+func hash(b []byte) []byte {
+	h := sha256.Sum256(b)
 	h = sha256.Sum256(h[:])
 	return h[:]
 }
 
-//Hash returns hash of the tx.
+//Hash returns hash of the tx, i.e. txid, which doesn't cover witnesses.
 func (t *Tx) Hash() []byte {
-	return hash(*t)
+	var buf bytes.Buffer
+	if err := t.serialize(&buf, false); err != nil {
+		log.Fatal(err)
+	}
+	return hash(buf.Bytes())
+}
+
+//WitnessHash returns hash of the tx including witnesses (wtxid).
+//It is same as Hash if the tx has no witness.
+func (t *Tx) WitnessHash() []byte {
+	var buf bytes.Buffer
+	if err := t.serialize(&buf, t.HasWitness()); err != nil {
+		log.Fatal(err)
+	}
+	return hash(buf.Bytes())
+}
+
+//HasWitness returns true if any txin has witness.
+func (t *Tx) HasWitness() bool {
+	for _, in := range t.TxIn {
+		if len(in.Witness) > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 //Pack packs Tx struct to bin.
+//Witnesses are packed with BIP144 format if the tx has any.
 func (t *Tx) Pack() ([]byte, error) {
 	buf := new(bytes.Buffer)
-	err := packer.Pack(buf, *t)
+	err := t.serialize(buf, t.HasWitness())
 	return buf.Bytes(), err
 }
 
+//Size returns length of packed tx in bytes.
+func (t *Tx) Size() int {
+	b, err := t.Pack()
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+//Weight returns weight of the tx defined in BIP141.
+func (t *Tx) Weight() int {
+	var buf bytes.Buffer
+	if err := t.serialize(&buf, false); err != nil {
+		return 0
+	}
+	return buf.Len()*3 + t.Size()
+}
+
+//VSize returns virtual size of the tx defined in BIP141.
+func (t *Tx) VSize() int {
+	return (t.Weight() + 3) / 4
+}
+
+func (t *Tx) serialize(w io.Writer, witness bool) error {
+	if err := binary.Write(w, binary.LittleEndian, t.Version); err != nil {
+		return err
+	}
+	if witness {
+		if _, err := w.Write([]byte{0x00, 0x01}); err != nil {
+			return err
+		}
+	}
+	if err := writeVarInt(w, uint64(len(t.TxIn))); err != nil {
+		return err
+	}
+	for i, in := range t.TxIn {
+		if len(in.Hash) != 32 {
+			return fmt.Errorf("length of hash in txin %d must be 32", i)
+		}
+		if _, err := w.Write(in.Hash); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, in.Index); err != nil {
+			return err
+		}
+		if err := writeVarBytes(w, in.Script); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, in.Seq); err != nil {
+			return err
+		}
+	}
+	if err := writeVarInt(w, uint64(len(t.TxOut))); err != nil {
+		return err
+	}
+	for _, out := range t.TxOut {
+		if err := binary.Write(w, binary.LittleEndian, out.Value); err != nil {
+			return err
+		}
+		if err := writeVarBytes(w, out.Script); err != nil {
+			return err
+		}
+	}
+	if witness {
+		for _, in := range t.TxIn {
+			if err := writeVarInt(w, uint64(len(in.Witness))); err != nil {
+				return err
+			}
+			for _, item := range in.Witness {
+				if err := writeVarBytes(w, item); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, t.Locktime)
+}
+
 //ParseTX parses byte array and returns Tx struct.
 func ParseTX(dat []byte) (*Tx, error) {
 	tx := Tx{}
-	buf := bytes.NewBuffer(dat)
-	err := packer.Unpack(buf, &tx)
+	buf := bytes.NewReader(dat)
+	err := tx.deserialize(buf)
+	if err == nil && buf.Len() != 0 {
+		err = errors.New("extra bytes after tx")
+	}
 	return &tx, err
 }
 
+func (t *Tx) deserialize(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &t.Version); err != nil {
+		return err
+	}
+	nin, err := readVarInt(r)
+	if err != nil {
+		return err
+	}
+	var witness bool
+	if nin == 0 {
+		var flag [1]byte
+		if _, err = io.ReadFull(r, flag[:]); err != nil {
+			return err
+		}
+		if flag[0] != 0x01 {
+			return errors.New("unknown flag in tx")
+		}
+		witness = true
+		if nin, err = readVarInt(r); err != nil {
+			return err
+		}
+	}
+	if t.TxIn, err = readTxIns(r, nin); err != nil {
+		return err
+	}
+	nout, err := readVarInt(r)
+	if err != nil {
+		return err
+	}
+	if t.TxOut, err = readTxOuts(r, nout); err != nil {
+		return err
+	}
+	if witness {
+		for _, in := range t.TxIn {
+			if in.Witness, err = readWitness(r); err != nil {
+				return err
+			}
+		}
+		if !t.HasWitness() {
+			return errors.New("witness flag is set but witnesses are empty")
+		}
+	}
+	return binary.Read(r, binary.LittleEndian, &t.Locktime)
+}
+
+func readTxIns(r io.Reader, n uint64) ([]*TxIn, error) {
+	if n > maxItems {
+		return nil, fmt.Errorf("too many txins %d", n)
+	}
+	txins := make([]*TxIn, 0, allocCap(n))
+	for i := uint64(0); i < n; i++ {
+		in := TxIn{
+			Hash: make([]byte, 32),
+		}
+		if _, err := io.ReadFull(r, in.Hash); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &in.Index); err != nil {
+			return nil, err
+		}
+		var err error
+		if in.Script, err = readVarBytes(r); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &in.Seq); err != nil {
+			return nil, err
+		}
+		txins = append(txins, &in)
+	}
+	return txins, nil
+}
+
+func readTxOuts(r io.Reader, n uint64) ([]*TxOut, error) {
+	if n > maxItems {
+		return nil, fmt.Errorf("too many txouts %d", n)
+	}
+	txouts := make([]*TxOut, 0, allocCap(n))
+	for i := uint64(0); i < n; i++ {
+		out := TxOut{}
+		if err := binary.Read(r, binary.LittleEndian, &out.Value); err != nil {
+			return nil, err
+		}
+		var err error
+		if out.Script, err = readVarBytes(r); err != nil {
+			return nil, err
+		}
+		txouts = append(txouts, &out)
+	}
+	return txouts, nil
+}
+
+func readWitness(r io.Reader) ([][]byte, error) {
+	n, err := readVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxItems {
+		return nil, fmt.Errorf("too many witness items %d", n)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	items := make([][]byte, 0, allocCap(n))
+	for i := uint64(0); i < n; i++ {
+		item, err := readVarBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+//maxItems is the max number of items (txins, txouts, witness items)
+//and bytes in one variable field accepted when parsing.
+const maxItems = 4000000
+
+//maxAlloc is the max number of items or bytes allocated in advance when parsing.
+//Slices grow as items are actually read, so that a small input cannot force
+//a large allocation by a large count.
+const maxAlloc = 1024
+
+//allocCap returns the capacity allocated in advance for n items.
+func allocCap(n uint64) int {
+	if n > maxAlloc {
+		return maxAlloc
+	}
+	return int(n)
+}
+
+func writeVarInt(w io.Writer, n uint64) error {
+	var b []byte
+	switch {
+	case n < 0xfd:
+		b = []byte{byte(n)}
+	case n <= 0xffff:
+		b = make([]byte, 3)
+		b[0] = 0xfd
+		binary.LittleEndian.PutUint16(b[1:], uint16(n))
+	case n <= 0xffffffff:
+		b = make([]byte, 5)
+		b[0] = 0xfe
+		binary.LittleEndian.PutUint32(b[1:], uint32(n))
+	default:
+		b = make([]byte, 9)
+		b[0] = 0xff
+		binary.LittleEndian.PutUint64(b[1:], n)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readVarInt(r io.Reader) (uint64, error) {
+	var b [9]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return 0, err
+	}
+	switch b[0] {
+	case 0xfd:
+		_, err := io.ReadFull(r, b[1:3])
+		return uint64(binary.LittleEndian.Uint16(b[1:3])), err
+	case 0xfe:
+		_, err := io.ReadFull(r, b[1:5])
+		return uint64(binary.LittleEndian.Uint32(b[1:5])), err
+	case 0xff:
+		_, err := io.ReadFull(r, b[1:9])
+		return binary.LittleEndian.Uint64(b[1:9]), err
+	}
+	return uint64(b[0]), nil
+}
+
+func writeVarBytes(w io.Writer, b []byte) error {
+	if err := writeVarInt(w, uint64(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readVarBytes(r io.Reader) ([]byte, error) {
+	n, err := readVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxItems {
+		return nil, fmt.Errorf("too long bytes %d", n)
+	}
+	b := make([]byte, 0, allocCap(n))
+	for uint64(len(b)) < n {
+		//read at most as many bytes as already read, so that
+		//the allocation grows only while input continues.
+		l := len(b)
+		c := uint64(l)
+		if c < maxAlloc {
+			c = maxAlloc
+		}
+		if rem := n - uint64(l); c > rem {
+			c = rem
+		}
+		b = append(b, make([]byte, c)...)
+		if _, err = io.ReadFull(r, b[l:]); err != nil {
+			if err == io.EOF && l > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
 //Reverse reverse bits.
 func Reverse(bs []byte) []byte {
 	b := make([]byte, len(bs))
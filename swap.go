@@ -0,0 +1,338 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bitgoin/address"
+)
+
+//Default margins between locktimes of initiator and participant, which are
+//half of 48 hours locktime of initiator as in the reference atomicswap tool.
+const (
+	DefaultSwapTimeMargin  = 24 * time.Hour
+	DefaultSwapBlockMargin = 144
+)
+
+//Swap is one side of cross-chain atomic swap with HTLCs.
+//Initiator creates a contract with the hash of its secret, and participant
+//creates a contract on another chain with the same hash after auditing it.
+//Initiator redeems participant's contract, which reveals the secret to participant.
+type Swap struct {
+	//Fee is the fee of contract, refund and redeem txs.
+	Fee uint64
+	//Witness is true if own contract is P2WSH, otherwise P2SH.
+	Witness bool
+	Net     *Network
+	//TimeMargin is the minimum gap between locktimes in unix time, so that initiator
+	//cannot redeem participant's contract just before refunding own contract.
+	TimeMargin time.Duration
+	//BlockMargin is the minimum gap between locktimes in block height.
+	BlockMargin uint32
+	priv        *address.PrivateKey
+	remote      *address.PublicKey
+	secret      []byte
+	hash        []byte
+	//contract is own HTLC, and counter is counterparty's one.
+	contract   *HTLC
+	contractTx *Tx
+	refund     *Tx
+	counter    *HTLC
+	counterTx  *Tx
+	counterIdx uint32
+}
+
+//NewSwap returns one side of swap with remote.
+func NewSwap(priv *address.PrivateKey, remote *address.PublicKey, fee uint64, net *Network) *Swap {
+	return &Swap{
+		Fee:         fee,
+		Net:         net,
+		TimeMargin:  DefaultSwapTimeMargin,
+		BlockMargin: DefaultSwapBlockMargin,
+		priv:        priv,
+		remote:      remote,
+	}
+}
+
+//Secret returns the secret if known.
+func (s *Swap) Secret() []byte {
+	return s.secret
+}
+
+//Hash returns SHA256 of the secret.
+func (s *Swap) Hash() []byte {
+	return s.hash
+}
+
+//Contract returns own HTLC, whose script must be sent to counterparty for audit.
+func (s *Swap) Contract() *HTLC {
+	return s.contract
+}
+
+//Initiate creates a secret and returns contract and refund tx of initiator.
+//The contract pays amount to participant with the secret, or back to initiator after locktime.
+//coins must be P2WPKH, so that txid of the contract and the refund are not malleated.
+func (s *Swap) Initiate(amount uint64, locktime uint32, coins UTXOs, ref string) (*Tx, *Tx, error) {
+	if s.contract != nil || s.counter != nil {
+		return nil, nil, errors.New("swap is already started")
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, err
+	}
+	contract, refund, err := s.createContract(secret, amount, locktime, coins, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.secret = secret
+	return contract, refund, nil
+}
+
+//Participate returns contract and refund tx of participant with the hash of
+//initiator's contract audited by AuditContract. locktime must be before that of
+//initiator by the margin. coins must be P2WPKH as in Initiate.
+func (s *Swap) Participate(amount uint64, locktime uint32, coins UTXOs, ref string) (*Tx, *Tx, error) {
+	if s.counter == nil {
+		return nil, nil, errors.New("contract of initiator is not audited")
+	}
+	if s.contract != nil {
+		return nil, nil, errors.New("swap is already started")
+	}
+	if err := s.checkMargin(locktime, s.counter.Timeout); err != nil {
+		return nil, nil, err
+	}
+	return s.createContract(nil, amount, locktime, coins, ref)
+}
+
+//checkMargin returns an error if locktime of participant is not before that of
+//initiator by the margin.
+func (s *Swap) checkMargin(participant, initiator uint32) error {
+	if (participant >= LocktimeThreshold) != (initiator >= LocktimeThreshold) {
+		return errors.New("locktimes of initiator and participant must be of the same type")
+	}
+	margin := uint64(s.BlockMargin)
+	if initiator >= LocktimeThreshold {
+		margin = uint64(s.TimeMargin / time.Second)
+	}
+	if uint64(participant)+margin > uint64(initiator) {
+		return fmt.Errorf("locktime %d of participant must be before %d of initiator by %d",
+			participant, initiator, margin)
+	}
+	return nil
+}
+
+//createContract returns the contract tx which pays amount to HTLC and its refund tx.
+func (s *Swap) createContract(secret []byte, amount uint64, locktime uint32, coins UTXOs, ref string) (*Tx, *Tx, error) {
+	h := &HTLC{
+		Hash:      s.hash,
+		Recipient: s.remote,
+		Sender:    s.priv.PublicKey,
+		Timeout:   locktime,
+		Witness:   s.Witness,
+		Sized:     true,
+		Net:       s.Net,
+	}
+	if secret != nil {
+		hash := sha256.Sum256(secret)
+		h.Hash = hash[:]
+	}
+	script, err := h.ScriptPubKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	out := &TxOut{
+		Value:  amount,
+		Script: script,
+	}
+	if err = s.Net.checkDust(out); err != nil {
+		return nil, nil, err
+	}
+	txins, used, change, err := newTxins(s.Net, amount+s.Fee, coins, &Send{Addr: ref}, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	//malleated txid of the contract would invalidate the refund.
+	if err = checkWitnessCoins(used); err != nil {
+		return nil, nil, err
+	}
+	contract := &Tx{
+		Version: 1,
+		TxIn:    txins,
+		TxOut:   []*TxOut{out},
+	}
+	if change != nil {
+		contract.TxOut = append(contract.TxOut, change)
+	}
+	if err = FillP2PKsign(contract, used); err != nil {
+		return nil, nil, err
+	}
+	refund, err := h.Refund(&UTXO{
+		Key:    s.priv,
+		TxHash: contract.Hash(),
+		Value:  amount,
+		Script: script,
+	}, ref, s.Fee)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.hash = h.Hash
+	s.contract = h
+	s.contractTx = contract
+	s.refund = refund
+	return contract, refund, nil
+}
+
+//AuditContract checks that contract tx of counterparty pays at least amount to
+//the sized HTLC with script, which pays to own with the hash, and refunds after
+//minLocktime or later. Initiator can pass 0 as minLocktime, and locktime of
+//participant must be before own by the margin.
+func (s *Swap) AuditContract(contract *Tx, script []byte, amount uint64, minLocktime uint32) error {
+	h, err := ParseHTLC(script, s.Net)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Recipient.Serialize(), s.priv.PublicKey.Serialize()) {
+		return errors.New("contract doesn't pay to own")
+	}
+	if !bytes.Equal(h.Sender.Serialize(), s.remote.Serialize()) {
+		return errors.New("contract is not refunded to counterparty")
+	}
+	if s.hash != nil && !bytes.Equal(h.Hash, s.hash) {
+		return errors.New("hash in contract is illegal")
+	}
+	if !h.Sized {
+		return errors.New("size of the secret is not checked in contract")
+	}
+	if h.Relative {
+		return errors.New("relative locktime is not allowed in contract")
+	}
+	if h.Timeout < minLocktime {
+		return fmt.Errorf("locktime %d is before %d", h.Timeout, minLocktime)
+	}
+	if s.contract != nil {
+		if err = s.checkMargin(h.Timeout, s.contract.Timeout); err != nil {
+			return err
+		}
+	}
+	for _, witness := range []bool{false, true} {
+		h.Witness = witness
+		spk, err := h.ScriptPubKey()
+		if err != nil {
+			continue
+		}
+		for i, out := range contract.TxOut {
+			if !bytes.Equal(out.Script, spk) {
+				continue
+			}
+			if out.Value < amount {
+				return fmt.Errorf("amount %d in contract is less than %d", out.Value, amount)
+			}
+			s.hash = h.Hash
+			s.counter = h
+			s.counterTx = contract
+			s.counterIdx = uint32(i)
+			return nil
+		}
+	}
+	return errors.New("contract tx doesn't pay to the script")
+}
+
+//Redeem returns tx which redeems the contract of counterparty to addr with the secret.
+func (s *Swap) Redeem(addr string) (*Tx, error) {
+	if s.counter == nil {
+		return nil, errors.New("contract of counterparty is not audited")
+	}
+	if s.secret == nil {
+		return nil, errors.New("secret is unknown")
+	}
+	out := s.counterTx.TxOut[s.counterIdx]
+	return s.counter.Claim(&UTXO{
+		Key:     s.priv,
+		TxHash:  s.counterTx.Hash(),
+		Value:   out.Value,
+		Script:  out.Script,
+		TxIndex: s.counterIdx,
+	}, s.secret, addr, s.Fee)
+}
+
+//ExtractSecret extracts the secret from redeem tx of own contract by counterparty.
+func (s *Swap) ExtractSecret(redeem *Tx) ([]byte, error) {
+	if s.contractTx == nil {
+		return nil, errors.New("contract is not created")
+	}
+	spk, err := s.contract.ScriptPubKey()
+	if err != nil {
+		return nil, err
+	}
+	idx := -1
+	for i, out := range s.contractTx.TxOut {
+		if bytes.Equal(out.Script, spk) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, errors.New("contract tx doesn't pay to the contract")
+	}
+	h := s.contractTx.Hash()
+	for _, in := range redeem.TxIn {
+		if in.Index != uint32(idx) || !bytes.Equal(in.Hash, h) {
+			continue
+		}
+		items := in.Witness
+		if len(items) == 0 {
+			ops, err := parseScript(in.Script)
+			if err != nil {
+				return nil, err
+			}
+			for _, o := range ops {
+				items = append(items, o.pushedData())
+			}
+		}
+		for _, item := range items {
+			if hash := sha256.Sum256(item); bytes.Equal(hash[:], s.hash) {
+				s.secret = item
+				return item, nil
+			}
+		}
+		return nil, errors.New("secret is not in redeem tx")
+	}
+	return nil, errors.New("tx doesn't redeem the contract")
+}
+
+//Refund returns the refund tx of own contract, which is valid after its locktime.
+func (s *Swap) Refund() *Tx {
+	return s.refund
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSwap(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	alice := NewSwap(keys[0], keys[1].PublicKey, 0.001*Unit, nil)
+	alice.Witness = true
+	bob := NewSwap(keys[1], keys[0].PublicKey, 0.001*Unit, nil)
+
+	if _, _, err := alice.Initiate(Unit, 500300, testCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address()); err == nil {
+		t.Error("must be error for non-witness coins")
+	}
+	acontract, arefund, err := alice.Initiate(Unit, 500300, testSegwitCoins(t, keys[0], 2*Unit), keys[0].PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arefund.Locktime != 500300 || !bytes.Equal(arefund.TxIn[0].Hash, acontract.Hash()) {
+		t.Error("illegal refund of initiator")
+	}
+	ascript, err := alice.Contract().Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bob.AuditContract(acontract, ascript, Unit, 500400); err == nil {
+		t.Error("must be error for too early locktime")
+	}
+	if err = bob.AuditContract(acontract, ascript, 2*Unit, 500100); err == nil {
+		t.Error("must be error for insufficient amount")
+	}
+	unsized := *alice.Contract()
+	unsized.Sized = false
+	uscript, err := unsized.Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bob.AuditContract(acontract, uscript, Unit, 500100); err == nil {
+		t.Error("must be error for contract without size check")
+	}
+	if err = bob.AuditContract(acontract, ascript, Unit, 500100); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bob.Hash(), alice.Hash()) || bob.Secret() != nil {
+		t.Error("illegal hash of participant")
+	}
+	if _, _, err = bob.Participate(2*Unit, 500300, testSegwitCoins(t, keys[1], 3*Unit), keys[1].PublicKey.Address()); err == nil {
+		t.Error("must be error for locktime not before initiator")
+	}
+	if _, _, err = bob.Participate(2*Unit, 500200, testSegwitCoins(t, keys[1], 3*Unit), keys[1].PublicKey.Address()); err == nil {
+		t.Error("must be error for locktime within the margin")
+	}
+	bcontract, brefund, err := bob.Participate(2*Unit, 500100, testSegwitCoins(t, keys[1], 3*Unit), keys[1].PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if brefund.Locktime != 500100 {
+		t.Error("illegal refund of participant")
+	}
+	bscript, err := bob.Contract().Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.BlockMargin = 300
+	if err = alice.AuditContract(bcontract, bscript, 2*Unit, 0); err == nil {
+		t.Error("must be error for locktime within the margin")
+	}
+	alice.BlockMargin = DefaultSwapBlockMargin
+	if err = alice.AuditContract(bcontract, bscript, 2*Unit, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	aredeem, err := alice.Redeem(keys[0].PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bob.ExtractSecret(arefund); err == nil {
+		t.Error("must be error for tx which doesn't redeem")
+	}
+	if _, err = bob.Redeem(keys[1].PublicKey.Address()); err == nil {
+		t.Error("must be error before extracting secret")
+	}
+	other := *aredeem
+	in := *aredeem.TxIn[0]
+	in.Index = 1
+	other.TxIn = []*TxIn{&in}
+	if _, err = bob.ExtractSecret(&other); err == nil {
+		t.Error("must be error for tx which spends another output")
+	}
+	secret, err := bob.ExtractSecret(aredeem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secret, alice.Secret()) {
+		t.Error("illegal secret")
+	}
+	bredeem, err := bob.Redeem(keys[1].PublicKey.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bredeem.TxIn[0].Witness) != 4 || bredeem.TxOut[0].Value != 0.999*Unit {
+		t.Error("illegal redeem of participant")
+	}
+	if s, err := alice.ExtractSecret(bredeem); err != nil || !bytes.Equal(s, secret) {
+		t.Error("secret must be in redeem tx", err)
+	}
+}
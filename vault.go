@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/bitgoin/address"
+)
+
+//Vault is an output locked by OP_CHECKLOCKTIMEVERIFY (BIP65), which Owner can spend
+//alone after Locktime. If Cosigner is set, Owner and Cosigner can spend it together
+//at any time, e.g. as a bond whose refund doesn't need a presigned tx by Cosigner.
+type Vault struct {
+	Owner    *address.PublicKey
+	Cosigner *address.PublicKey
+	//Locktime is the block height, or unix time if it is LocktimeThreshold or more.
+	Locktime uint32
+	//Witness is true if the output is P2WSH, otherwise P2SH.
+	Witness bool
+	Net     *Network
+}
+
+func (v *Vault) check() error {
+	if v.Owner == nil {
+		return errors.New("owner must be set")
+	}
+	if v.Locktime == 0 {
+		return errors.New("locktime must not be 0")
+	}
+	if err := v.Net.checkKey(v.Owner); err != nil {
+		return err
+	}
+	return v.Net.checkKey(v.Cosigner)
+}
+
+//Script returns the redeem script, or the witness script if Witness.
+//It is <Locktime> OP_CHECKLOCKTIMEVERIFY OP_DROP <Owner> OP_CHECKSIG without Cosigner, or
+//OP_IF 2 <Owner> <Cosigner> 2 OP_CHECKMULTISIG OP_ELSE (the former) OP_ENDIF with Cosigner.
+func (v *Vault) Script() ([]byte, error) {
+	if err := v.check(); err != nil {
+		return nil, err
+	}
+	var s []byte
+	if v.Cosigner != nil {
+		s = []byte{opIF, op1 + 1}
+		s = pushData(s, v.Owner.Serialize())
+		s = pushData(s, v.Cosigner.Serialize())
+		s = append(s, op1+1, opCHECKMULTISIG, opELSE)
+	}
+	s = pushData(s, scriptNumBytes(int64(v.Locktime)))
+	s = append(s, opCHECKLOCKTIMEVERIFY, opDROP)
+	s = pushData(s, v.Owner.Serialize())
+	s = append(s, opCHECKSIG)
+	if v.Cosigner != nil {
+		s = append(s, opENDIF)
+	}
+	return s, nil
+}
+
+//ScriptPubKey returns the script of the output which pays to the vault.
+func (v *Vault) ScriptPubKey() ([]byte, error) {
+	s, err := v.Script()
+	if err != nil {
+		return nil, err
+	}
+	if v.Witness {
+		sh := sha256.Sum256(s)
+		return witnessScript(0, sh[:]), nil
+	}
+	if len(s) > MaxRedeemScriptSize {
+		return nil, fmt.Errorf("length of redeem script %d exceeds %d", len(s), MaxRedeemScriptSize)
+	}
+	return p2shScript(address.AddressBytes(s)), nil
+}
+
+//Address returns the address of the vault in Net.
+func (v *Vault) Address() (string, error) {
+	s, err := v.ScriptPubKey()
+	if err != nil {
+		return "", err
+	}
+	net := v.Net
+	if net == nil {
+		net = DefaultNet
+	}
+	return net.ScriptAddress(s), nil
+}
+
+//spend returns tx without signs which spends coin to addr.
+func (v *Vault) spend(coin *UTXO, addr string, fee uint64) (*Tx, []byte, error) {
+	spk, err := v.ScriptPubKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(coin.Script, spk) {
+		return nil, nil, errors.New("coin is not paid to the vault")
+	}
+	script, err := v.Script()
+	if err != nil {
+		return nil, nil, err
+	}
+	tx, err := scriptSpend(v.Net, coin, addr, fee)
+	return tx, script, err
+}
+
+//Unlock returns tx which spends coin paid to the vault to addr by Owner alone.
+//The tx is valid after Locktime. Key of coin must be of Owner.
+func (v *Vault) Unlock(coin *UTXO, addr string, fee uint64) (*Tx, error) {
+	if !bytes.Equal(coin.Key.PublicKey.Serialize(), v.Owner.Serialize()) {
+		return nil, errors.New("key is not of owner")
+	}
+	tx, script, err := v.spend(coin, addr, fee)
+	if err != nil {
+		return nil, err
+	}
+	//non-final sequence enables locktime.
+	tx.Locktime = v.Locktime
+	tx.TxIn[0].Seq = math.MaxUint32 - 1
+	sign, err := scriptSign(tx, 0, coin.Key, script, coin.Value, v.Witness)
+	if err != nil {
+		return nil, err
+	}
+	items := [][]byte{sign}
+	if v.Cosigner != nil {
+		//OP_0 selects OP_ELSE branch.
+		items = append(items, []byte{})
+	}
+	setScriptItems(tx.TxIn[0], append(items, script), v.Witness)
+	return tx, nil
+}
+
+//CosignTx returns tx without signs which spends coin paid to the vault to addr
+//by Owner and Cosigner. Key of coin is not used.
+func (v *Vault) CosignTx(coin *UTXO, addr string, fee uint64) (*Tx, error) {
+	if v.Cosigner == nil {
+		return nil, errors.New("vault has no cosigner")
+	}
+	tx, _, err := v.spend(coin, addr, fee)
+	return tx, err
+}
+
+//SignCosign returns the sign of tx by CosignTx with key of Owner or Cosigner.
+//amount is the value of the spent coin.
+func (v *Vault) SignCosign(tx *Tx, amount uint64, key *address.PrivateKey) ([]byte, error) {
+	script, err := v.Script()
+	if err != nil {
+		return nil, err
+	}
+	return scriptSign(tx, 0, key, script, amount, v.Witness)
+}
+
+//FillCosign verifies and embeds signs of Owner and Cosigner into tx by CosignTx.
+func (v *Vault) FillCosign(tx *Tx, amount uint64, owner, cosigner []byte) error {
+	if v.Cosigner == nil {
+		return errors.New("vault has no cosigner")
+	}
+	script, err := v.Script()
+	if err != nil {
+		return err
+	}
+	hash, err := scriptSigHash(tx, 0, script, amount, v.Witness)
+	if err != nil {
+		return err
+	}
+	pubs := []*address.PublicKey{v.Owner, v.Cosigner}
+	for i, s := range [][]byte{owner, cosigner} {
+		if err := checkSigHashAll(s); err != nil {
+			return fmt.Errorf("%s at %d", err, i)
+		}
+		if err := pubs[i].Verify(s[:len(s)-1], hash); err != nil {
+			return fmt.Errorf("%s at %d", err, i)
+		}
+	}
+	//OP_0 is the dummy for OP_CHECKMULTISIG, and OP_1 selects OP_IF branch.
+	items := [][]byte{{}, owner, cosigner, {1}, script}
+	setScriptItems(tx.TxIn[0], items, v.Witness)
+	return nil
+}
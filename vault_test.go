@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVault(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	for _, witness := range []bool{false, true} {
+		v := &Vault{
+			Owner:    keys[0].PublicKey,
+			Locktime: 500000,
+			Witness:  witness,
+		}
+		script, err := v.Script()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := disasm(script, false); !strings.Contains(d, "OP_CHECKLOCKTIMEVERIFY OP_DROP") ||
+			!strings.HasSuffix(d, "OP_CHECKSIG") {
+			t.Error("illegal script", d)
+		}
+		spk, err := v.ScriptPubKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		coin := &UTXO{
+			Key:    keys[0],
+			TxHash: hash([]byte("vault")),
+			Value:  Unit,
+			Script: spk,
+		}
+		tx, err := v.Unlock(coin, keys[0].PublicKey.Address(), 0.001*Unit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tx.Locktime != 500000 || tx.TxIn[0].Seq != 0xfffffffe {
+			t.Error("illegal locktime or sequence")
+		}
+		items := tx.TxIn[0].Witness
+		if !witness {
+			items = testPushes(t, tx.TxIn[0].Script)
+		}
+		if len(items) != 2 {
+			t.Error("illegal number of items", len(items))
+		}
+		if _, err = v.CosignTx(coin, keys[0].PublicKey.Address(), 0.001*Unit); err == nil {
+			t.Error("must be error without cosigner")
+		}
+
+		v.Cosigner = keys[1].PublicKey
+		if spk, err = v.ScriptPubKey(); err != nil {
+			t.Fatal(err)
+		}
+		coin.Script = spk
+		if tx, err = v.Unlock(coin, keys[0].PublicKey.Address(), 0.001*Unit); err != nil {
+			t.Fatal(err)
+		}
+		items = tx.TxIn[0].Witness
+		if !witness {
+			items = testPushes(t, tx.TxIn[0].Script)
+		}
+		if len(items) != 3 || len(items[1]) != 0 {
+			t.Error("illegal items of unlock")
+		}
+		coin.Key = keys[1]
+		if _, err = v.Unlock(coin, keys[1].PublicKey.Address(), 0.001*Unit); err == nil {
+			t.Error("must be error for key of cosigner")
+		}
+
+		tx, err = v.CosignTx(coin, keys[1].PublicKey.Address(), 0.001*Unit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tx.Locktime != 0 || tx.TxIn[0].Seq != 0xffffffff {
+			t.Error("cosigned tx must not be locked")
+		}
+		signs := make([][]byte, 2)
+		for i, k := range keys {
+			if signs[i], err = v.SignCosign(tx, Unit, k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = v.FillCosign(tx, Unit, signs[1], signs[0]); err == nil {
+			t.Error("must be error for swapped signs")
+		}
+		if err = v.FillCosign(tx, Unit, signs[0], signs[1]); err != nil {
+			t.Fatal(err)
+		}
+		items = tx.TxIn[0].Witness
+		if !witness {
+			items = testPushes(t, tx.TxIn[0].Script)
+		}
+		if len(items) != 5 || len(items[0]) != 0 {
+			t.Error("illegal items of cosigned tx")
+		}
+	}
+}
+
+//testPushes returns data pushed by script.
+func testPushes(t *testing.T, script []byte) [][]byte {
+	ops, err := parseScript(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := make([][]byte, len(ops))
+	for i, o := range ops {
+		items[i] = o.pushedData()
+	}
+	return items
+}
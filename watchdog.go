@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+//LocktimeThreshold is the locktime below which it is a block height, otherwise unix time.
+const LocktimeThreshold = 500000000
+
+//Clock is the source of current time and block height.
+type Clock interface {
+	Now() time.Time
+	//Height returns the height of the best block.
+	Height() (uint32, error)
+}
+
+//Locktime returns the locktime of refund tx checked by CheckBond.
+func (m *MicroPayee) Locktime() (uint32, error) {
+	if m.refund == nil {
+		return 0, errors.New("bond is not checked")
+	}
+	return m.refund.Locktime, nil
+}
+
+//Watchdog closes channels in Manager before their refund txs become valid.
+type Watchdog struct {
+	Manager *PayeeManager
+	Clock   Clock
+	//TimeMargin is the margin before locktime in unix time.
+	TimeMargin time.Duration
+	//BlockMargin is the margin in blocks before locktime in block height.
+	BlockMargin uint32
+	//OnClose is called with the latest incremented tx, which must be broadcasted,
+	//when a channel is closed. tx is nil if nothing is paid.
+	OnClose func(id string, tx *Tx)
+	//OnError is called with the error of each channel in Check if not nil.
+	OnError func(error)
+}
+
+//expiring returns true if refund with locktime will be valid within the margin.
+//height is got from Clock only when needed.
+func (w *Watchdog) expiring(locktime uint32, height func() (uint32, error)) (bool, error) {
+	if locktime >= LocktimeThreshold {
+		deadline := time.Unix(int64(locktime), 0).Add(-w.TimeMargin)
+		return !w.Clock.Now().Before(deadline), nil
+	}
+	h, err := height()
+	if err != nil {
+		return false, err
+	}
+	//refund can be in the next block if h >= locktime.
+	return uint64(h)+uint64(w.BlockMargin) >= uint64(locktime), nil
+}
+
+//Check closes channels whose refund txs will be valid within the margin
+//and calls OnClose for them.
+//An error of a channel is passed to OnError and doesn't stop checking others.
+//It returns the first error after all channels are checked.
+func (w *Watchdog) Check() error {
+	var h uint32
+	var herr error
+	got := false
+	height := func() (uint32, error) {
+		if !got {
+			h, herr = w.Clock.Height()
+			got = true
+		}
+		return h, herr
+	}
+	var first error
+	for _, id := range w.Manager.OpenChannels() {
+		err := w.check(id, height)
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("channel %s: %s", id, err)
+		if w.OnError != nil {
+			w.OnError(err)
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+//check closes channel id if its refund tx will be valid within the margin.
+func (w *Watchdog) check(id string, height func() (uint32, error)) error {
+	var locktime uint32
+	err := w.Manager.Do(id, func(m *MicroPayee) error {
+		var err error
+		locktime, err = m.Locktime()
+		return err
+	})
+	if err == ErrChannelNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	exp, err := w.expiring(locktime, height)
+	if err != nil || !exp {
+		return err
+	}
+	tx, err := w.Manager.Close(id)
+	if err != nil {
+		return err
+	}
+	if w.OnClose != nil {
+		w.OnClose(id, tx)
+	}
+	return nil
+}
+
+//Run calls Check every interval until stop is closed.
+func (w *Watchdog) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		//errors are passed to OnError by Check.
+		w.Check()
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright (c) 2016, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tx
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now    time.Time
+	height uint32
+}
+
+func (c *fakeClock) Now() time.Time          { return c.now }
+func (c *fakeClock) Height() (uint32, error) { return c.height, nil }
+
+func TestWatchdog(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	start := time.Unix(1500000000, 0)
+	clock := &fakeClock{
+		now:    start,
+		height: 1000,
+	}
+	pm := NewPayeeManager()
+	locktimes := []uint32{1010, uint32(start.Add(2 * time.Hour).Unix())}
+	payers := make([]*MicroPayer, len(locktimes))
+	ids := make([]string, len(locktimes))
+	for i, l := range locktimes {
+		var payee *MicroPayee
+		payers[i], payee = testChannel(t, keys[0], keys[1], uint64(2+i)*Unit, l)
+		var err error
+		if ids[i], err = pm.Add(payee); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sign, err := payers[0].SignIncremented(10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pm.IncrementedTx(ids[0], 10000, sign); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(map[string]*Tx)
+	w := &Watchdog{
+		Manager:     pm,
+		Clock:       clock,
+		TimeMargin:  time.Hour,
+		BlockMargin: 6,
+		OnClose: func(id string, tx *Tx) {
+			if _, ok := closed[id]; ok {
+				t.Error("closed twice", id)
+			}
+			closed[id] = tx
+		},
+	}
+	check := func(n int) {
+		if err := w.Check(); err != nil {
+			t.Fatal(err)
+		}
+		if len(closed) != n {
+			t.Fatal("illegal number of closed channels", len(closed), n)
+		}
+	}
+	check(0)
+	clock.height = 1003
+	check(0)
+	clock.height = 1004
+	check(1)
+	if tx := closed[ids[0]]; tx == nil || tx.TxOut[1].Value != 10000 {
+		t.Error("best incremented tx must be passed")
+	}
+	clock.now = start.Add(time.Hour - time.Second)
+	check(1)
+	clock.now = start.Add(time.Hour)
+	check(2)
+	if tx, ok := closed[ids[1]]; !ok || tx != nil {
+		t.Error("tx must be nil for channel without payment")
+	}
+	if p := pm.PendingClose(); len(p) != 2 {
+		t.Error("channels must be pending close", p)
+	}
+}
+
+func TestWatchdogError(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	clock := &fakeClock{
+		now:    time.Unix(1500000000, 0),
+		height: 1000,
+	}
+	pm := NewPayeeManager()
+	//restored without refund, which is checked first.
+	broken := NewMicroPayee(keys[0].PublicKey, keys[1], Unit, 0.001*Unit)
+	if err := broken.SetOutpoint(bytes.Repeat([]byte{0}, 32), 0, Unit); err != nil {
+		t.Fatal(err)
+	}
+	bid, err := pm.Add(broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payee := testChannel(t, keys[0], keys[1], 2*Unit, 1000)
+	id, err := pm.Add(payee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chs := pm.OpenChannels(); len(chs) != 2 || chs[0] != bid {
+		t.Fatal("illegal order of channels", chs)
+	}
+	var errs []error
+	closed := false
+	w := &Watchdog{
+		Manager: pm,
+		Clock:   clock,
+		OnClose: func(cid string, tx *Tx) {
+			closed = cid == id
+		},
+		OnError: func(err error) {
+			errs = append(errs, err)
+		},
+	}
+	if err = w.Check(); err == nil {
+		t.Error("must be error for channel without refund")
+	}
+	if !closed {
+		t.Error("expiring channel must be closed after an error of another channel")
+	}
+	if len(errs) != 1 {
+		t.Error("error must be passed to OnError", errs)
+	}
+}
+
+func TestWatchdogRetry(t *testing.T) {
+	keys := testKeys(t, multisigWIFs[:2])
+	clock := &fakeClock{
+		now:    time.Unix(1500000000, 0),
+		height: 1000,
+	}
+	pm := NewPayeeManager()
+	payer, payee := testChannel(t, keys[0], keys[1], 2*Unit, 1000)
+	sign, err := payer.SignIncremented(20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = payee.IncrementedTx(20000, sign); err != nil {
+		t.Fatal(err)
+	}
+	id, err := pm.Add(payee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var closed *Tx
+	w := &Watchdog{
+		Manager: pm,
+		Clock:   clock,
+		OnClose: func(cid string, tx *Tx) {
+			closed = tx
+		},
+	}
+	//LastIncrementedTx fails with the broken sign.
+	err = pm.Do(id, func(m *MicroPayee) error {
+		m.sign = []byte{1, 2, 3}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Check(); err == nil {
+		t.Error("must be error for broken sign")
+	}
+	if chs := pm.OpenChannels(); len(chs) != 1 || closed != nil {
+		t.Fatal("channel must stay open after an error", chs)
+	}
+	err = pm.Do(id, func(m *MicroPayee) error {
+		m.sign = sign
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if closed == nil || closed.TxOut[1].Value != 20000 {
+		t.Error("latest incremented tx must be closed on retry")
+	}
+	if chs := pm.PendingClose(); len(chs) != 1 || chs[0] != id {
+		t.Error("channel must be closing", chs)
+	}
+}